@@ -2,16 +2,45 @@ package router
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/shake-on-it/app-tmpl/backend/api"
 	"github.com/shake-on-it/app-tmpl/backend/api/admin/v1"
+	"github.com/shake-on-it/app-tmpl/backend/auth"
 )
 
 const (
 	pathV1 = "/v1"
 
 	pathUser        = "/user"
+	pathUserExport  = "/user/export"
 	pathUserSession = "/user/session"
+	pathUserVerify  = "/user/verify"
+
+	pathUserSessionTOTP = "/user/session/totp"
+	pathUserTOTP        = "/user/totp"
+
+	pathUserPassword      = "/user/password"
+	pathUserPasswordReset = "/user/password/reset"
+
+	pathUserSessions  = "/user/sessions"
+	pathUserSessionID = "/user/sessions/{id}"
+
+	pathUserAPIKeys  = "/user/api_keys"
+	pathUserAPIKeyID = "/user/api_keys/{id}"
+
+	pathUserImpersonation = "/user/impersonation"
+
+	pathUserIDLockout       = "/users/{id}/lockout"
+	pathUserIDImpersonation = "/users/{id}/impersonation"
+
+	pathAuditEvents = "/audit/events"
+
+	pathInvites  = "/invites"
+	pathInviteID = "/invites/{id}"
+
+	pathOAuthProvider = "/oauth/{provider}"
+	pathOAuthCallback = "/oauth/{provider}/callback"
 
 	systemStatus  = "/system/status"
 	systemVersion = "/system/version"
@@ -20,6 +49,9 @@ const (
 var (
 	Versions = []string{pathV1}
 
+	// limitAuth keeps anonymous callers from guessing credentials or flooding inboxes
+	limitAuth = api.RouteLimit{20, time.Minute}
+
 	Registry = map[string][]api.RouteRegistration{
 		pathV1: {
 			// auth routes
@@ -27,26 +59,220 @@ var (
 				v1.Whoami,
 				api.RouteEndpoint{http.MethodGet, pathUser, false},
 				api.RouteNeedsSession,
+				api.RouteAccessAny.WithAPIKeyScope(auth.APIKeyScopeUserRead),
+				api.RouteLimitDefault,
 			},
 			{
 				v1.Register,
 				api.RouteEndpoint{http.MethodPost, pathUser, false},
 				api.RouteNeedsNothing,
+				api.RouteAccessAny.WithoutCSRFCheck(),
+				limitAuth,
 			},
 			{
 				v1.Login,
 				api.RouteEndpoint{http.MethodPost, pathUserSession, true},
 				api.RouteNeedsNothing,
+				api.RouteAccessAny.WithoutCSRFCheck(),
+				limitAuth,
+			},
+			{
+				v1.LoginTOTP,
+				api.RouteEndpoint{http.MethodPost, pathUserSessionTOTP, true},
+				api.RouteNeedsNothing,
+				api.RouteAccessAny.WithoutCSRFCheck(),
+				limitAuth,
+			},
+			{
+				v1.StartOAuth,
+				api.RouteEndpoint{http.MethodGet, pathOAuthProvider, false},
+				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
+			},
+			{
+				v1.OAuthCallback,
+				api.RouteEndpoint{http.MethodGet, pathOAuthCallback, false},
+				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
 			},
 			{
 				v1.RefreshAccess,
 				api.RouteEndpoint{http.MethodPut, pathUserSession, false},
 				api.RouteNeedsRefreshToken,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
 			},
 			{
 				v1.Logout,
 				api.RouteEndpoint{http.MethodDelete, pathUserSession, false},
 				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
+			},
+			{
+				v1.RequestVerification,
+				api.RouteEndpoint{http.MethodPost, pathUserVerify, true},
+				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				limitAuth,
+			},
+			{
+				v1.VerifyEmail,
+				api.RouteEndpoint{http.MethodPut, pathUserVerify, true},
+				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				limitAuth,
+			},
+			{
+				v1.DeleteUser,
+				api.RouteEndpoint{http.MethodDelete, pathUser, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithoutImpersonation(),
+				limitAuth,
+			},
+			{
+				v1.ExportUser,
+				api.RouteEndpoint{http.MethodGet, pathUserExport, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithoutImpersonation().WithAPIKeyScope(auth.APIKeyScopeUserRead),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.ChangePassword,
+				api.RouteEndpoint{http.MethodPut, pathUserPassword, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithoutImpersonation(),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.RequestPasswordReset,
+				api.RouteEndpoint{http.MethodPost, pathUserPasswordReset, true},
+				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				limitAuth,
+			},
+			{
+				v1.ResetPassword,
+				api.RouteEndpoint{http.MethodPut, pathUserPasswordReset, true},
+				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				limitAuth,
+			},
+			{
+				v1.EnrollTOTP,
+				api.RouteEndpoint{http.MethodPost, pathUserTOTP, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithoutImpersonation(),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.ConfirmTOTP,
+				api.RouteEndpoint{http.MethodPut, pathUserTOTP, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithoutImpersonation(),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.DisableTOTP,
+				api.RouteEndpoint{http.MethodDelete, pathUserTOTP, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithoutImpersonation(),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.ListSessions,
+				api.RouteEndpoint{http.MethodGet, pathUserSessions, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithAPIKeyScope(auth.APIKeyScopeSessionsRead),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.LogoutAll,
+				api.RouteEndpoint{http.MethodDelete, pathUserSessions, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithoutImpersonation().WithAPIKeyScope(auth.APIKeyScopeSessionsWrite),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.RevokeSession,
+				api.RouteEndpoint{http.MethodDelete, pathUserSessionID, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithoutImpersonation().WithAPIKeyScope(auth.APIKeyScopeSessionsWrite),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.ListAPIKeys,
+				api.RouteEndpoint{http.MethodGet, pathUserAPIKeys, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithoutImpersonation().WithAPIKeyScope(auth.APIKeyScopeAPIKeysRead),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.CreateAPIKey,
+				api.RouteEndpoint{http.MethodPost, pathUserAPIKeys, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithoutImpersonation(),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.RevokeAPIKey,
+				api.RouteEndpoint{http.MethodDelete, pathUserAPIKeyID, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny.WithoutImpersonation().WithAPIKeyScope(auth.APIKeyScopeAPIKeysWrite),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.EndImpersonation,
+				api.RouteEndpoint{http.MethodDelete, pathUserImpersonation, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
+			},
+
+			// admin routes
+			{
+				v1.UnlockUser,
+				api.RouteEndpoint{http.MethodDelete, pathUserIDLockout, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAdmin.WithAPIKeyScope(auth.APIKeyScopeUsersWrite),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.Impersonate,
+				api.RouteEndpoint{http.MethodPost, pathUserIDImpersonation, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAdmin.WithoutImpersonation(),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.ListAuditEvents,
+				api.RouteEndpoint{http.MethodGet, pathAuditEvents, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAdmin.WithAPIKeyScope(auth.APIKeyScopeAuditRead),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.ListInvites,
+				api.RouteEndpoint{http.MethodGet, pathInvites, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAdmin.WithAPIKeyScope(auth.APIKeyScopeInvitesRead),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.CreateInvite,
+				api.RouteEndpoint{http.MethodPost, pathInvites, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAdmin.WithAPIKeyScope(auth.APIKeyScopeInvitesWrite),
+				api.RouteLimitDefault,
+			},
+			{
+				v1.RevokeInvite,
+				api.RouteEndpoint{http.MethodDelete, pathInviteID, false},
+				api.RouteNeedsSession,
+				api.RouteAccessAdmin.WithAPIKeyScope(auth.APIKeyScopeInvitesWrite),
+				api.RouteLimitDefault,
 			},
 		},
 	}
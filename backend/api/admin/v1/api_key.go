@@ -0,0 +1,64 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/shake-on-it/app-tmpl/backend/api"
+	"github.com/shake-on-it/app-tmpl/backend/api/admin"
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	var create auth.APIKeyCreate
+	if err := json.NewDecoder(r.Body).Decode(&create); err != nil {
+		api.ErrorResponse(w, r, common.NewErr("failed to parse api key", common.ErrCodeBadRequest))
+		return
+	}
+
+	apiKey, err := srvCtx.AuthService.CreateAPIKey(r.Context(), user.ID, create)
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.JSONResponse(w, r, http.StatusCreated, apiKey)
+}
+
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	apiKeys, err := srvCtx.AuthService.APIKeys(r.Context(), user.ID)
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.JSONResponse(w, r, 0, apiKeys)
+}
+
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	apiKeyID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		api.ErrorResponse(w, r, common.NewErr("invalid api key id", common.ErrCodeBadRequest))
+		return
+	}
+
+	if err := srvCtx.AuthService.RevokeAPIKey(r.Context(), user.ID, apiKeyID); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.Response(w, r, http.StatusNoContent)
+}
@@ -0,0 +1,74 @@
+package v1_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/common/test"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestAPIKey(t *testing.T) {
+	t.Run("should only use api keys on routes their scopes allow", func(t *testing.T) {
+		th := test.NewHarness(t)
+		defer th.Close()
+
+		assert.Nil(t, th.Login())
+
+		createAPIKey := func(name string, scopes ...string) auth.NewAPIKey {
+			res, err := th.Do(test.Request{
+				Method: http.MethodPost,
+				Path:   "/api/admin/v1/user/api_keys",
+				Body:   auth.APIKeyCreate{Name: name, Scopes: scopes},
+				Auth:   true,
+			})
+			assert.Nil(t, err)
+			assert.Nil(t, res.Is(http.StatusCreated))
+
+			var apiKey auth.NewAPIKey
+			assert.Nil(t, res.Decode(&apiKey))
+			return apiKey
+		}
+
+		reader := createAPIKey("reader", auth.APIKeyScopeUserRead, auth.APIKeyScopeAPIKeysRead)
+		writer := createAPIKey("writer", auth.APIKeyScopeAPIKeysWrite)
+		unused := createAPIKey("unused")
+
+		res, err := th.Do(test.Request{
+			Method: http.MethodDelete,
+			Path:   "/api/admin/v1/user/api_keys/" + unused.ID.Hex(),
+			Anon:   true,
+			APIKey: reader.Key,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusForbidden))
+
+		assert.Equal(t, res.Err(), common.ErrResponse{
+			Code:    common.ErrCodeInsufficientAuth,
+			Message: "insufficient access",
+		})
+
+		res, err = th.Do(test.Request{
+			Method: http.MethodDelete,
+			Path:   "/api/admin/v1/user/api_keys/" + unused.ID.Hex(),
+			Anon:   true,
+			APIKey: writer.Key,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusNoContent))
+
+		res, err = th.Do(test.Request{
+			Path:   "/api/admin/v1/user/api_keys",
+			Anon:   true,
+			APIKey: reader.Key,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusOK))
+
+		var apiKeys []auth.APIKey
+		assert.Nil(t, res.Decode(&apiKeys))
+		assert.Equal(t, len(apiKeys), 2)
+	})
+}
@@ -0,0 +1,93 @@
+package v1
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/api"
+	"github.com/shake-on-it/app-tmpl/backend/api/admin"
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	queryAuditUserID = "user_id"
+	queryAuditAction = "action"
+	queryAuditFrom   = "from"
+	queryAuditTo     = "to"
+	queryAuditBefore = "before"
+	queryAuditLimit  = "limit"
+)
+
+// ListAuditEvents pages through the audit log, times are rfc 3339 and
+// before is the next value of the previous page
+func ListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	srvCtx := admin.MustHaveServerContext(r)
+
+	query, err := parseAuditQuery(r)
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	page, err := srvCtx.AuthService.AuditEvents(r.Context(), query)
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.JSONResponse(w, r, 0, page)
+}
+
+func parseAuditQuery(r *http.Request) (auth.AuditQuery, error) {
+	values := r.URL.Query()
+
+	query := auth.AuditQuery{Action: values.Get(queryAuditAction)}
+
+	for _, id := range []struct {
+		param string
+		value *primitive.ObjectID
+	}{
+		{queryAuditUserID, &query.UserID},
+		{queryAuditBefore, &query.Before},
+	} {
+		if values.Get(id.param) == "" {
+			continue
+		}
+		value, err := primitive.ObjectIDFromHex(values.Get(id.param))
+		if err != nil {
+			return auth.AuditQuery{}, common.NewErr("invalid "+id.param, common.ErrCodeBadRequest)
+		}
+		*id.value = value
+	}
+
+	for _, t := range []struct {
+		param string
+		value *time.Time
+	}{
+		{queryAuditFrom, &query.From},
+		{queryAuditTo, &query.To},
+	} {
+		if values.Get(t.param) == "" {
+			continue
+		}
+		value, err := time.Parse(time.RFC3339, values.Get(t.param))
+		if err != nil {
+			return auth.AuditQuery{}, common.NewErr("invalid "+t.param+" time", common.ErrCodeBadRequest)
+		}
+		*t.value = value
+	}
+
+	if limit := values.Get(queryAuditLimit); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 {
+			return auth.AuditQuery{}, common.NewErr("invalid limit", common.ErrCodeBadRequest)
+		}
+		query.Limit = value
+	}
+
+	return query, nil
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/shake-on-it/app-tmpl/backend/auth"
 	"github.com/shake-on-it/app-tmpl/backend/common"
 
+	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -27,17 +28,114 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, tokens, err := srvCtx.AuthService.Login(r.Context(), creds)
+	user, tokens, err := srvCtx.AuthService.Login(r.Context(), creds, api.RequestClientIP(r))
 	if err != nil {
 		api.ErrorResponse(w, r, err)
 		return
 	}
 
-	if err := authResponse(w, srvCtx, user, tokens); err != nil {
+	if tokens.Challenge != nil {
+		challenge, err := srvCtx.AuthService.SignToken(tokens.Challenge)
+		if err != nil {
+			api.ErrorResponse(w, r, common.WrapErr(fmt.Errorf("failed to sign totp challenge: %w", err), common.ErrCodeServer))
+			return
+		}
+		api.JSONResponse(w, r, http.StatusAccepted, auth.TOTPChallengeResponse{challenge})
+		return
+	}
+
+	authResponse(w, r, srvCtx, user, tokens)
+}
+
+func LoginTOTP(w http.ResponseWriter, r *http.Request) {
+	srvCtx := admin.MustHaveServerContext(r)
+
+	var login auth.TOTPLogin
+	if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
+		api.ErrorResponse(w, r, common.NewErr("failed to parse two-factor login", common.ErrCodeBadRequest))
+		return
+	}
+
+	// oauth logins left their challenge in a cookie instead
+	if login.Challenge == "" {
+		if cookie, err := r.Cookie(auth.CookieTOTPChallenge); err == nil {
+			login.Challenge = cookie.Value
+		}
+	}
+
+	var challenge auth.TOTPChallenge
+	if err := srvCtx.AuthService.ParseToken(login.Challenge, &challenge); err != nil {
 		api.ErrorResponse(w, r, err)
 		return
 	}
-	api.Response(w, r, http.StatusCreated)
+
+	user, tokens, err := srvCtx.AuthService.LoginTOTP(r.Context(), challenge, login.Code, api.RequestClientIP(r))
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.CookieTOTPChallenge,
+		Value:    "",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   srvCtx.Config.Server.SSLEnabled,
+		Path:     "/",
+		MaxAge:   -1,
+	})
+
+	authResponse(w, r, srvCtx, user, tokens)
+}
+
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	enrollment, err := srvCtx.AuthService.EnrollTOTP(r.Context(), user.ID)
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.JSONResponse(w, r, http.StatusCreated, enrollment)
+}
+
+func ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	var confirmation auth.TOTPConfirmation
+	if err := json.NewDecoder(r.Body).Decode(&confirmation); err != nil {
+		api.ErrorResponse(w, r, common.NewErr("failed to parse totp confirmation", common.ErrCodeBadRequest))
+		return
+	}
+
+	recoveryCodes, err := srvCtx.AuthService.ConfirmTOTP(r.Context(), user.ID, confirmation.Code)
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.JSONResponse(w, r, 0, recoveryCodes)
+}
+
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	var disable auth.TOTPDisable
+	if err := json.NewDecoder(r.Body).Decode(&disable); err != nil {
+		api.ErrorResponse(w, r, common.NewErr("failed to parse totp removal", common.ErrCodeBadRequest))
+		return
+	}
+
+	if err := srvCtx.AuthService.DisableTOTP(r.Context(), user.ID, disable.Password); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.Response(w, r, http.StatusNoContent)
 }
 
 func Logout(w http.ResponseWriter, r *http.Request) {
@@ -45,23 +143,34 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 
 	clearAuth(w, srvCtx)
 
-	var userID primitive.ObjectID
-	if user, ok := api.CtxUser(r); ok {
-		userID = user.ID
-	}
+	var userID, sessionID primitive.ObjectID
 	if refreshToken, ok := api.CtxRefreshToken(r); ok {
-		userID = refreshToken.UserID
+		userID, sessionID = refreshToken.UserID, refreshToken.SessionID
 	}
 	if accessToken, ok := api.CtxAccessToken(r); ok {
-		userID = accessToken.UserID
+		userID, sessionID = accessToken.UserID, accessToken.SessionID
 	}
 
-	if userID.IsZero() {
+	if sessionID.IsZero() {
 		api.Response(w, r, http.StatusNoContent)
 		return
 	}
 
-	if err := srvCtx.AuthService.Logout(r.Context(), userID); err != nil {
+	if err := srvCtx.AuthService.Logout(r.Context(), userID, sessionID); err != nil {
+		api.ErrorResponse(w, r, common.WrapErr(fmt.Errorf("failed to logout: %s", err), common.ErrCodeServer))
+		return
+	}
+
+	api.Response(w, r, 0)
+}
+
+func LogoutAll(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	clearAuth(w, srvCtx)
+
+	if err := srvCtx.AuthService.LogoutAll(r.Context(), user.ID); err != nil {
 		api.ErrorResponse(w, r, common.WrapErr(fmt.Errorf("failed to logout: %s", err), common.ErrCodeServer))
 		return
 	}
@@ -69,6 +178,49 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 	api.Response(w, r, 0)
 }
 
+// currentSessionID is the session the request was made with, api keys have none
+func currentSessionID(r *http.Request) primitive.ObjectID {
+	if accessToken, ok := api.CtxAccessToken(r); ok {
+		return accessToken.SessionID
+	}
+	return primitive.NilObjectID
+}
+
+func ListSessions(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	sessions, err := srvCtx.AuthService.Sessions(r.Context(), user.ID, currentSessionID(r))
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.JSONResponse(w, r, 0, sessions)
+}
+
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	sessionID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		api.ErrorResponse(w, r, common.NewErr("invalid session id", common.ErrCodeBadRequest))
+		return
+	}
+
+	if err := srvCtx.AuthService.RevokeSession(r.Context(), user.ID, sessionID); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	if sessionID == currentSessionID(r) {
+		clearAuth(w, srvCtx)
+	}
+
+	api.Response(w, r, http.StatusNoContent)
+}
+
 func RefreshAccess(w http.ResponseWriter, r *http.Request) {
 	refreshToken := api.MustHaveRefreshToken(r)
 	srvCtx := admin.MustHaveServerContext(r)
@@ -80,11 +232,7 @@ func RefreshAccess(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := authResponse(w, srvCtx, user, tokens); err != nil {
-		api.ErrorResponse(w, r, err)
-		return
-	}
-	api.Response(w, r, http.StatusCreated)
+	authResponse(w, r, srvCtx, user, tokens)
 }
 
 func Register(w http.ResponseWriter, r *http.Request) {
@@ -105,28 +253,173 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	api.JSONResponse(w, r, http.StatusCreated, user)
 }
 
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	accessToken := api.MustHaveAccessToken(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	var change auth.PasswordChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		api.ErrorResponse(w, r, common.NewErr("failed to parse password change", common.ErrCodeBadRequest))
+		return
+	}
+
+	if err := srvCtx.AuthService.ChangePassword(r.Context(), accessToken.UserID, accessToken.SessionID, change); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.Response(w, r, http.StatusNoContent)
+}
+
+func RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	srvCtx := admin.MustHaveServerContext(r)
+
+	var req auth.PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.ErrorResponse(w, r, common.NewErr("failed to parse password reset", common.ErrCodeBadRequest))
+		return
+	}
+
+	user, _, err := srvCtx.AuthService.RequestPasswordReset(r.Context(), req.Email)
+	if err != nil {
+		// do not reveal whether the email belongs to a user
+		if !isNotFound(err) {
+			api.ErrorResponse(w, r, err)
+			return
+		}
+		api.Response(w, r, http.StatusAccepted)
+		return
+	}
+
+	api.MustHaveLogger(r).With(common.LoggerFieldUserID, user.ID.Hex()).Info("issued password reset")
+
+	api.Response(w, r, http.StatusAccepted)
+}
+
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	srvCtx := admin.MustHaveServerContext(r)
+
+	var reset auth.PasswordReset
+	if err := json.NewDecoder(r.Body).Decode(&reset); err != nil {
+		api.ErrorResponse(w, r, common.NewErr("failed to parse password reset", common.ErrCodeBadRequest))
+		return
+	}
+
+	if err := srvCtx.AuthService.ResetPassword(r.Context(), reset); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	clearAuth(w, srvCtx)
+	api.Response(w, r, http.StatusNoContent)
+}
+
+func RequestVerification(w http.ResponseWriter, r *http.Request) {
+	srvCtx := admin.MustHaveServerContext(r)
+
+	var req auth.VerificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.ErrorResponse(w, r, common.NewErr("failed to parse verification", common.ErrCodeBadRequest))
+		return
+	}
+
+	// do not reveal whether the email belongs to a user
+	if err := srvCtx.AuthService.RequestVerification(r.Context(), req.Email); err != nil && !isNotFound(err) {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.Response(w, r, http.StatusAccepted)
+}
+
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	srvCtx := admin.MustHaveServerContext(r)
+
+	var verification auth.Verification
+	if err := json.NewDecoder(r.Body).Decode(&verification); err != nil {
+		api.ErrorResponse(w, r, common.NewErr("failed to parse verification", common.ErrCodeBadRequest))
+		return
+	}
+
+	user, err := srvCtx.AuthService.VerifyEmail(r.Context(), verification.Token)
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.JSONResponse(w, r, 0, user)
+}
+
 func Whoami(w http.ResponseWriter, r *http.Request) {
 	user := api.MustHaveUser(r)
-	api.JSONResponse(w, r, 0, user)
+
+	whoami := auth.Whoami{User: user}
+	if accessToken, ok := api.CtxAccessToken(r); ok && accessToken.Impersonating() {
+		whoami.ImpersonatedBy = &accessToken.Actor
+	}
+
+	api.JSONResponse(w, r, 0, whoami)
 }
 
-func authResponse(w http.ResponseWriter, srvCtx admin.ServerContext, user auth.User, tokens auth.Tokens) error {
+// authResponse hands the session's tokens to the client, as cookies
+// or in the response body for clients using the token auth mode
+func authResponse(w http.ResponseWriter, r *http.Request, srvCtx admin.ServerContext, user auth.User, tokens auth.Tokens) {
+	if api.RequestAuthMode(r) == api.AuthModeToken {
+		accessToken, refreshToken, err := signTokens(srvCtx, tokens)
+		if err != nil {
+			api.ErrorResponse(w, r, err)
+			return
+		}
+
+		api.JSONResponse(w, r, http.StatusCreated, auth.TokenResponse{
+			AccessToken:           accessToken,
+			AccessTokenExpiresAt:  tokens.AccessToken.ExpiresAt,
+			RefreshToken:          refreshToken,
+			RefreshTokenExpiresAt: tokens.RefreshToken.ExpiresAt,
+			TokenType:             auth.TokenTypeBearer,
+			User:                  user,
+		})
+		return
+	}
+
+	if err := setAuthCookies(w, srvCtx, user, tokens); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.Response(w, r, http.StatusCreated)
+}
+
+func signTokens(srvCtx admin.ServerContext, tokens auth.Tokens) (string, string, error) {
 	accessToken, err := srvCtx.AuthService.SignToken(&tokens.AccessToken)
 	if err != nil {
-		return common.WrapErr(fmt.Errorf("failed to sign access token: %w", err), common.ErrCodeServer)
+		return "", "", common.WrapErr(fmt.Errorf("failed to sign access token: %w", err), common.ErrCodeServer)
 	}
 
 	refreshToken, err := srvCtx.AuthService.SignToken(&tokens.RefreshToken)
 	if err != nil {
+		return "", "", common.WrapErr(fmt.Errorf("failed to sign refresh token: %w", err), common.ErrCodeServer)
+	}
+
+	return accessToken, refreshToken, nil
+}
 
-		return common.WrapErr(fmt.Errorf("failed to sign refresh token: %w", err), common.ErrCodeServer)
+func setAuthCookies(w http.ResponseWriter, srvCtx admin.ServerContext, user auth.User, tokens auth.Tokens) error {
+	accessToken, refreshToken, err := signTokens(srvCtx, tokens)
+	if err != nil {
+		return err
 	}
 
-	userToken, err := srvCtx.AuthService.SignToken(&user)
+	userToken, err := srvCtx.AuthService.SignUserToken(user)
 	if err != nil {
 		return common.WrapErr(fmt.Errorf("failed to sign user token: %w", err), common.ErrCodeServer)
 	}
 
+	csrfToken, err := auth.NewCSRFToken()
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to generate csrf token: %w", err), common.ErrCodeServer)
+	}
+
 	for _, cookie := range []struct {
 		name      string
 		token     string
@@ -147,14 +440,30 @@ func authResponse(w http.ResponseWriter, srvCtx admin.ServerContext, user auth.U
 		})
 	}
 
+	// the client reads the csrf token to send it back in a header so it cannot be http only
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.CookieCSRFToken,
+		Value:    csrfToken,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   srvCtx.Config.Server.SSLEnabled,
+		Path:     "/",
+		Expires:  tokens.RefreshToken.ExpiresAt,
+	})
+
 	return nil
 }
 
+func isNotFound(err error) bool {
+	code, ok := err.(common.ErrCodeProvider)
+	return ok && code.Code() == common.ErrCodeNotFound
+}
+
 func clearAuth(w http.ResponseWriter, srvCtx admin.ServerContext) {
 	for _, cookieName := range []string{
 		auth.CookieUserToken,
 		auth.CookieAccessToken,
 		auth.CookieRefreshToken,
+		auth.CookieCSRFToken,
 	} {
 		http.SetCookie(w, &http.Cookie{
 			Name:     cookieName,
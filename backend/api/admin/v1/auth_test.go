@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/shake-on-it/app-tmpl/backend/auth"
 	"github.com/shake-on-it/app-tmpl/backend/common"
 	"github.com/shake-on-it/app-tmpl/backend/common/test"
 	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
@@ -55,6 +56,165 @@ func TestAuth(t *testing.T) {
 		})
 	})
 
+	t.Run("should fail to log in again right after a wrong password", func(t *testing.T) {
+		th := test.NewHarness(t)
+		defer th.Close()
+
+		assert.Nil(t, th.Login())
+
+		login := test.Request{
+			Method: http.MethodPost,
+			Path:   "/api/admin/v1/user/session",
+			Body:   auth.Credentials{"test-user", "wrong password"},
+			Anon:   true,
+		}
+
+		res, err := th.Do(login)
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusBadRequest))
+
+		res, err = th.Do(login)
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusTooManyRequests))
+		assert.Equal(t, res.Header().Get("Retry-After"), "1")
+		assert.Equal(t, res.Header().Get("X-RateLimit-Limit"), "20")
+
+		assert.Equal(t, res.Err(), common.ErrResponse{
+			Code:    common.ErrCodeTooManyRequests,
+			Message: "too many failed login attempts",
+			Data:    map[string]interface{}{common.ErrDataRetryAfterSecs: 1.0},
+		})
+	})
+
+	t.Run("should fail to log out without the csrf token", func(t *testing.T) {
+		th := test.NewHarness(t)
+		defer th.Close()
+
+		assert.Nil(t, th.Login())
+
+		res, err := th.Do(test.Request{
+			Method:   http.MethodDelete,
+			Path:     "/api/admin/v1/user/session",
+			Auth:     true,
+			SkipCSRF: true,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusForbidden))
+
+		assert.Equal(t, res.Err(), common.ErrResponse{
+			Code:    common.ErrCodeInsufficientAuth,
+			Message: "invalid csrf token",
+		})
+
+		res, err = th.Do(test.Request{
+			Method: http.MethodDelete,
+			Path:   "/api/admin/v1/user/session",
+			Auth:   true,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusOK))
+	})
+
+	t.Run("should let a client logged in before the csrf cookie log in again", func(t *testing.T) {
+		th := test.NewHarness(t)
+		defer th.Close()
+
+		assert.Nil(t, th.Login())
+
+		res, err := th.Do(test.Request{
+			Method: http.MethodDelete,
+			Path:   "/api/admin/v1/user/session",
+			Auth:   true,
+			Legacy: true,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusForbidden))
+
+		res, err = th.Do(test.Request{
+			Method:  http.MethodPut,
+			Path:    "/api/admin/v1/user/session",
+			Refresh: true,
+			Legacy:  true,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusForbidden))
+
+		res, err = th.Do(test.Request{
+			Method: http.MethodPost,
+			Path:   "/api/admin/v1/user/session",
+			Body:   auth.Credentials{"test-user", "p@sSw0rd"},
+			Auth:   true,
+			Legacy: true,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusCreated))
+
+		var csrfCookie bool
+		for _, cookie := range (&http.Response{Header: res.Header()}).Cookies() {
+			if cookie.Name == auth.CookieCSRFToken && cookie.Value != "" {
+				csrfCookie = true
+			}
+		}
+		assert.True(t, csrfCookie)
+	})
+
+	t.Run("should fail to register an email that is already taken", func(t *testing.T) {
+		th := test.NewHarness(t)
+		defer th.Close()
+
+		assert.Nil(t, th.Login())
+
+		res, err := th.Do(test.Request{
+			Method: http.MethodPost,
+			Path:   "/api/admin/v1/user",
+			Body:   auth.Registration{auth.Credentials{"other-user", "p@sSw0rd"}, "Test-User@Domain.com", ""},
+			Anon:   true,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusConflict))
+
+		assert.Equal(t, res.Err(), common.ErrResponse{
+			Code:    common.ErrCodeConflict,
+			Message: "user already exists with this name or email",
+		})
+	})
+
+	t.Run("should export the user and then delete them", func(t *testing.T) {
+		th := test.NewHarness(t)
+		defer th.Close()
+
+		assert.Nil(t, th.Login())
+
+		res, err := th.Do(test.Request{
+			Path: "/api/admin/v1/user/export",
+			Auth: true,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusOK))
+
+		var export auth.UserExport
+		assert.Nil(t, res.Decode(&export))
+		assert.Equal(t, export.User.Name, "test-user")
+
+		res, err = th.Do(test.Request{
+			Method: http.MethodDelete,
+			Path:   "/api/admin/v1/user",
+			Body:   auth.AccountDeletion{"p@sSw0rd"},
+			Auth:   true,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusNoContent))
+
+		res, err = th.Do(test.Request{
+			Method: http.MethodPost,
+			Path:   "/api/admin/v1/user/session",
+			Body:   auth.Credentials{"test-user", "p@sSw0rd"},
+			Anon:   true,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, res.Is(http.StatusNotFound))
+	})
+
 	t.Run("should be able to log in and get system status", func(t *testing.T) {
 		th := test.NewHarness(t)
 		defer th.Close()
@@ -0,0 +1,63 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/shake-on-it/app-tmpl/backend/api"
+	"github.com/shake-on-it/app-tmpl/backend/api/admin"
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func CreateInvite(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	var create auth.InviteCreate
+	if err := json.NewDecoder(r.Body).Decode(&create); err != nil {
+		api.ErrorResponse(w, r, common.NewErr("failed to parse invite", common.ErrCodeBadRequest))
+		return
+	}
+
+	invite, err := srvCtx.AuthService.CreateInvite(r.Context(), user.ID, create)
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.JSONResponse(w, r, http.StatusCreated, invite)
+}
+
+func ListInvites(w http.ResponseWriter, r *http.Request) {
+	srvCtx := admin.MustHaveServerContext(r)
+
+	invites, err := srvCtx.AuthService.Invites(r.Context())
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.JSONResponse(w, r, 0, invites)
+}
+
+func RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	inviteID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		api.ErrorResponse(w, r, common.NewErr("invalid invite id", common.ErrCodeBadRequest))
+		return
+	}
+
+	if err := srvCtx.AuthService.RevokeInvite(r.Context(), user.ID, inviteID); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.Response(w, r, http.StatusNoContent)
+}
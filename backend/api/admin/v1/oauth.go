@@ -0,0 +1,123 @@
+package v1
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/shake-on-it/app-tmpl/backend/api"
+	"github.com/shake-on-it/app-tmpl/backend/api/admin"
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"github.com/gorilla/mux"
+)
+
+func StartOAuth(w http.ResponseWriter, r *http.Request) {
+	srvCtx := admin.MustHaveServerContext(r)
+
+	state, authURL, err := srvCtx.AuthService.StartOAuth(r.Context(), mux.Vars(r)["provider"])
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	stateToken, err := srvCtx.AuthService.SignToken(&state)
+	if err != nil {
+		api.ErrorResponse(w, r, common.WrapErr(fmt.Errorf("failed to sign oauth state: %w", err), common.ErrCodeServer))
+		return
+	}
+
+	// the provider sends the user back from another site, which strict cookies are not sent along with
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.CookieOAuthState,
+		Value:    stateToken,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   srvCtx.Config.Server.SSLEnabled,
+		Path:     "/",
+		Expires:  state.ExpiresAt,
+	})
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OAuthCallback finishes the login once the provider sends the user back,
+// the user is then sent on to the return url with their session cookies
+func OAuthCallback(w http.ResponseWriter, r *http.Request) {
+	srvCtx := admin.MustHaveServerContext(r)
+
+	cookie, err := r.Cookie(auth.CookieOAuthState)
+	if err != nil || cookie.Value == "" {
+		api.ErrorResponse(w, r, auth.ErrInvalidOAuthState)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.CookieOAuthState,
+		Value:    "",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   srvCtx.Config.Server.SSLEnabled,
+		Path:     "/",
+		MaxAge:   -1,
+	})
+
+	var state auth.OAuthState
+	if err := srvCtx.AuthService.ParseToken(cookie.Value, &state); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		api.ErrorResponse(w, r, common.NewErr(fmt.Sprintf("provider did not authorize login: %s", providerErr), common.ErrCodeInvalidAuth))
+		return
+	}
+
+	user, tokens, err := srvCtx.AuthService.LoginOAuth(r.Context(), mux.Vars(r)["provider"], state, query.Get("state"), query.Get("code"))
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	returnURL, err := url.Parse(srvCtx.Config.Auth.OAuthReturnURL)
+	if err != nil {
+		api.ErrorResponse(w, r, common.WrapErr(fmt.Errorf("invalid oauth return url: %w", err), common.ErrCodeServer))
+		return
+	}
+
+	// users with a second factor finish logging in with the challenge, it is kept out of
+	// the return url so it never lands in the browser's history or the logs of proxies
+	if tokens.Challenge != nil {
+		challenge, err := srvCtx.AuthService.SignToken(tokens.Challenge)
+		if err != nil {
+			api.ErrorResponse(w, r, common.WrapErr(fmt.Errorf("failed to sign totp challenge: %w", err), common.ErrCodeServer))
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     auth.CookieTOTPChallenge,
+			Value:    challenge,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+			Secure:   srvCtx.Config.Server.SSLEnabled,
+			Path:     "/",
+			Expires:  tokens.Challenge.ExpiresAt,
+		})
+
+		returnQuery := returnURL.Query()
+		returnQuery.Set("totp", "required")
+		returnURL.RawQuery = returnQuery.Encode()
+
+		http.Redirect(w, r, returnURL.String(), http.StatusFound)
+		return
+	}
+
+	if err := setAuthCookies(w, srvCtx, user, tokens); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, returnURL.String(), http.StatusFound)
+}
@@ -0,0 +1,101 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/shake-on-it/app-tmpl/backend/api"
+	"github.com/shake-on-it/app-tmpl/backend/api/admin"
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	accessToken := api.MustHaveAccessToken(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	var deletion auth.AccountDeletion
+	if err := json.NewDecoder(r.Body).Decode(&deletion); err != nil {
+		api.ErrorResponse(w, r, common.NewErr("failed to parse account deletion", common.ErrCodeBadRequest))
+		return
+	}
+
+	if err := srvCtx.AuthService.DeleteUser(r.Context(), accessToken.UserID, accessToken.SessionID, deletion.Password); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	clearAuth(w, srvCtx)
+
+	api.Response(w, r, http.StatusNoContent)
+}
+
+// ExportUser downloads everything stored about the user as a json archive
+func ExportUser(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	export, err := srvCtx.AuthService.ExportUser(r.Context(), user.ID)
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set(api.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.json"`, user.ID.Hex()))
+	api.JSONResponse(w, r, 0, export)
+}
+
+func UnlockUser(w http.ResponseWriter, r *http.Request) {
+	user := api.MustHaveUser(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	userID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		api.ErrorResponse(w, r, common.NewErr("invalid user id", common.ErrCodeBadRequest))
+		return
+	}
+
+	if err := srvCtx.AuthService.UnlockUser(r.Context(), user.ID, userID); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.Response(w, r, http.StatusNoContent)
+}
+
+func Impersonate(w http.ResponseWriter, r *http.Request) {
+	accessToken := api.MustHaveAccessToken(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	userID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		api.ErrorResponse(w, r, common.NewErr("invalid user id", common.ErrCodeBadRequest))
+		return
+	}
+
+	user, tokens, err := srvCtx.AuthService.Impersonate(r.Context(), accessToken, userID)
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	authResponse(w, r, srvCtx, user, tokens)
+}
+
+func EndImpersonation(w http.ResponseWriter, r *http.Request) {
+	accessToken := api.MustHaveAccessToken(r)
+	srvCtx := admin.MustHaveServerContext(r)
+
+	user, tokens, err := srvCtx.AuthService.EndImpersonation(r.Context(), accessToken)
+	if err != nil {
+		clearAuth(w, srvCtx)
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	authResponse(w, r, srvCtx, user, tokens)
+}
@@ -15,12 +15,19 @@ const (
 	ctxKeyUserToken
 	ctxKeyAccessToken
 	ctxKeyRefreshToken
+	ctxKeyAPIKey
+	ctxKeyClientIP
 )
 
 type Contexter interface {
 	Context() context.Context
 }
 
+func CtxAPIKey(r Contexter) (auth.APIKey, bool) {
+	apiKey, ok := r.Context().Value(ctxKeyAPIKey).(auth.APIKey)
+	return apiKey, ok
+}
+
 func CtxAccessToken(r Contexter) (auth.AccessToken, bool) {
 	accessToken, ok := r.Context().Value(ctxKeyAccessToken).(auth.AccessToken)
 	return accessToken, ok
@@ -34,6 +41,11 @@ func MustHaveAccessToken(r Contexter) auth.AccessToken {
 	return accessToken
 }
 
+func CtxClientIP(r Contexter) (string, bool) {
+	clientIP, ok := r.Context().Value(ctxKeyClientIP).(string)
+	return clientIP, ok
+}
+
 func CtxLogger(r Contexter) (common.Logger, bool) {
 	logger, ok := r.Context().Value(ctxKeyLogger).(common.Logger)
 	return logger, ok
@@ -91,6 +103,8 @@ type ContextBuilder interface {
 	Context() context.Context
 
 	AttachAccessToken(accessToken auth.AccessToken) ContextBuilder
+	AttachAPIKey(apiKey auth.APIKey) ContextBuilder
+	AttachClientIP(clientIP string) ContextBuilder
 	AttachLogger(logger common.Logger) ContextBuilder
 	AttachRequestID(requestID string) ContextBuilder
 	AttachRefreshToken(refreshToken auth.RefreshToken) ContextBuilder
@@ -118,6 +132,14 @@ func (b *contextBuilder) AttachAccessToken(accessToken auth.AccessToken) Context
 	return b.Attach(ctxKeyAccessToken, accessToken)
 }
 
+func (b *contextBuilder) AttachAPIKey(apiKey auth.APIKey) ContextBuilder {
+	return b.Attach(ctxKeyAPIKey, apiKey)
+}
+
+func (b *contextBuilder) AttachClientIP(clientIP string) ContextBuilder {
+	return b.Attach(ctxKeyClientIP, clientIP)
+}
+
 func (b *contextBuilder) AttachLogger(logger common.Logger) ContextBuilder {
 	return b.Attach(ctxKeyLogger, logger)
 }
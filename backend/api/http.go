@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -28,10 +29,18 @@ func errorStatus(code common.ErrCode) int {
 	case common.ErrCodeInsufficientAuth:
 		return http.StatusForbidden
 
-		// 403
+		// 404
 	case common.ErrCodeNotFound:
 		return http.StatusNotFound
 
+		// 409
+	case common.ErrCodeConflict:
+		return http.StatusConflict
+
+		// 429
+	case common.ErrCodeTooManyRequests:
+		return http.StatusTooManyRequests
+
 		// 500
 	case common.ErrCodeServer, common.ErrCodeUnknownError:
 		return http.StatusInternalServerError
@@ -61,6 +70,10 @@ func ErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 		body.Data = e.Data()
 	}
 
+	if retryAfter, ok := body.Data[common.ErrDataRetryAfterSecs].(int); ok {
+		w.Header().Set(HeaderRetryAfter, strconv.Itoa(retryAfter))
+	}
+
 	JSONResponse(w, r, errorStatus(body.Code), body)
 }
 
@@ -105,6 +118,10 @@ const (
 	HeaderAuthorization = "Authorization"
 	AuthorizationBearer = "Bearer "
 
+	HeaderAuthMode = "Auth-Mode"
+	AuthModeCookie = "cookie"
+	AuthModeToken  = "token"
+
 	HeaderContentDisposition = "Content-Disposition"
 
 	HeaderContentType = "Content-Type"
@@ -113,12 +130,23 @@ const (
 
 	HeaderCredentials = "Credentials"
 
+	HeaderCSRFToken = "CSRF-Token"
+
 	HeaderLocation = "Location"
 
 	HeaderRequestOrigin = "Request-Origin"
 
+	HeaderRetryAfter = "Retry-After"
+
+	HeaderWWWAuthenticate = "WWW-Authenticate"
+	AuthenticateBasic     = "Basic"
+
 	HeaderXForwardedFor = "X-Forwarded-For"
 
+	HeaderXRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderXRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderXRateLimitReset     = "X-RateLimit-Reset"
+
 	HeaderXAPP = "X-APP-"
 )
 
@@ -133,12 +161,112 @@ func RequestAuthorization(r *http.Request) (string, error) {
 	return strings.TrimPrefix(authorization, AuthorizationBearer), nil
 }
 
+func RequestHasAuthorization(r *http.Request) bool {
+	return r.Header.Get(HeaderAuthorization) != ""
+}
+
+// RequestAuthMode reports how the client wants to receive tokens,
+// browsers use cookies by default while other clients ask for a token body
+func RequestAuthMode(r *http.Request) string {
+	if r.Header.Get(HeaderXAPP+HeaderAuthMode) == AuthModeToken {
+		return AuthModeToken
+	}
+	return AuthModeCookie
+}
+
+// RequestIPAddresses lists the addresses the request says it was forwarded for,
+// anyone can send these so they are only fit for logging
 func RequestIPAddresses(r *http.Request) []string {
-	ipAddresses := r.Header.Get(HeaderXForwardedFor)
-	if ipAddresses == "" {
-		return nil
+	var ipAddresses []string
+	for _, header := range r.Header[HeaderXForwardedFor] {
+		for _, ipAddress := range strings.Split(header, ",") {
+			if ipAddress = strings.TrimSpace(ipAddress); ipAddress != "" {
+				ipAddresses = append(ipAddresses, ipAddress)
+			}
+		}
+	}
+	return ipAddresses
+}
+
+// RequestClientIP is the client's address as resolved through the trusted proxies,
+// or the remote address when it was never resolved
+func RequestClientIP(r *http.Request) string {
+	if clientIP, ok := CtxClientIP(r); ok {
+		return clientIP
+	}
+	return requestRemoteIP(r)
+}
+
+func requestRemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// TrustedProxies are the proxies whose x-forwarded-for entries are believed
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies reads each proxy as an address or cidr range
+func ParseTrustedProxies(proxies []string) (TrustedProxies, error) {
+	trusted := make(TrustedProxies, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an ip address or cidr range", proxy)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			trusted = append(trusted, &net.IPNet{ip, net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an ip address or cidr range", proxy)
+		}
+		trusted = append(trusted, ipNet)
+	}
+	return trusted, nil
+}
+
+func (p TrustedProxies) Trusts(ipAddress string) bool {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range p {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP walks back from the remote address through the x-forwarded-for entries each
+// trusted proxy appended, the first address not trusted is the client. Entries left of
+// it were sent by the client itself so they are never believed
+func (p TrustedProxies) ClientIP(r *http.Request) string {
+	clientIP := requestRemoteIP(r)
+	if !p.Trusts(clientIP) {
+		return clientIP
+	}
+
+	forwarded := RequestIPAddresses(r)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			// garbage from whoever the last trusted proxy forwarded for
+			break
+		}
+		clientIP = forwarded[i]
+		if !p.Trusts(clientIP) {
+			break
+		}
 	}
-	return strings.Split(ipAddresses, ", ")
+	return clientIP
 }
 
 type HTTPResponseWriter struct {
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestRequestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.1", "172.16.0.0/12"})
+	assert.Nil(t, err)
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		clientIP   string
+	}{
+		{"should use the remote address when not forwarded", "203.0.113.7:1234", "", "203.0.113.7"},
+		{"should not believe an untrusted remote address", "203.0.113.7:1234", "198.51.100.1", "203.0.113.7"},
+		{"should believe a trusted proxy", "10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"should walk back through trusted proxies", "10.0.0.1:1234", "198.51.100.1, 172.16.0.5", "198.51.100.1"},
+		{"should not believe what the client forwarded itself", "10.0.0.1:1234", "192.0.2.99, 198.51.100.1", "198.51.100.1"},
+		{"should split entries without spaces", "10.0.0.1:1234", "192.0.2.99,198.51.100.1", "198.51.100.1"},
+		{"should stop at garbage", "10.0.0.1:1234", "198.51.100.1, not an ip", "10.0.0.1"},
+		{"should use the leftmost when every entry is trusted", "10.0.0.1:1234", "172.16.0.6, 172.16.0.5", "172.16.0.6"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.forwarded != "" {
+				r.Header.Set(HeaderXForwardedFor, tc.forwarded)
+			}
+			assert.Equal(t, proxies.ClientIP(r), tc.clientIP)
+		})
+	}
+
+	t.Run("should never read a forwarded address without resolving it", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "203.0.113.7:1234"
+		r.Header.Set(HeaderXForwardedFor, "198.51.100.1")
+		assert.Equal(t, RequestClientIP(r), "203.0.113.7")
+
+		r = r.WithContext(NewContextBuilder(r.Context()).AttachClientIP("198.51.100.2").Context())
+		assert.Equal(t, RequestClientIP(r), "198.51.100.2")
+	})
+
+	t.Run("should not parse invalid proxies", func(t *testing.T) {
+		_, err := ParseTrustedProxies([]string{"proxy.local"})
+		assert.Equal(t, err.Error(), `trusted proxy "proxy.local" is not an ip address or cidr range`)
+	})
+}
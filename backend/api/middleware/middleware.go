@@ -21,6 +21,8 @@ func CORS(allowedOrigins []string) func(http.Handler) http.Handler {
 			api.HeaderAuthorization,
 			api.HeaderContentType,
 			api.HeaderCredentials,
+			api.HeaderXAPP + api.HeaderAuthMode,
+			api.HeaderXAPP + api.HeaderCSRFToken,
 			api.HeaderXAPP + api.HeaderRequestOrigin,
 		},
 		AllowedMethods: []string{
@@ -36,6 +38,10 @@ func CORS(allowedOrigins []string) func(http.Handler) http.Handler {
 			api.HeaderXAPP + api.HeaderLocation,
 			api.HeaderContentDisposition,
 			api.HeaderLocation,
+			api.HeaderRetryAfter,
+			api.HeaderXRateLimitLimit,
+			api.HeaderXRateLimitRemaining,
+			api.HeaderXRateLimitReset,
 		},
 	})
 	return corsMiddleware.Handler
@@ -64,6 +70,19 @@ func RequestLimiter(limit int) func(http.Handler) http.Handler {
 	}
 }
 
+// RequestClientIP resolves the client's address once for the rest of the request
+func RequestClientIP(proxies api.TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(
+				api.NewContextBuilder(r.Context()).
+					AttachClientIP(proxies.ClientIP(r)).
+					Context(),
+			))
+		})
+	}
+}
+
 func RequestLogger(logger common.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
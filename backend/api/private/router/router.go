@@ -13,6 +13,11 @@ const (
 	pathHealth  = "/health"
 	pathVersion = "/version"
 
+	pathJWKS = "/.well-known/jwks.json"
+
+	pathIntrospect = "/introspect"
+	pathRevoke     = "/revoke"
+
 	pathErrorsJSONBasic    = "/errors/json/basic"
 	pathErrorsJSONComplete = "/errors/json/complete"
 	pathErrorsPayload      = "/errors/payload"
@@ -29,32 +34,67 @@ var (
 				v1.GetHealth,
 				api.RouteEndpoint{http.MethodGet, pathHealth, false},
 				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
 			},
 			{
 				v1.GetVersion,
 				api.RouteEndpoint{http.MethodGet, pathVersion, false},
 				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
+			},
+			// key routes
+			{
+				v1.GetJWKS,
+				api.RouteEndpoint{http.MethodGet, pathJWKS, false},
+				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
+			},
+			// token routes
+			{
+				v1.IntrospectToken,
+				api.RouteEndpoint{http.MethodPost, pathIntrospect, false},
+				api.RouteNeedsClient,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
+			},
+			{
+				v1.RevokeToken,
+				api.RouteEndpoint{http.MethodPost, pathRevoke, false},
+				api.RouteNeedsClient,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
 			},
 			// error routes
 			{
 				v1.GetJSONBasicError,
 				api.RouteEndpoint{http.MethodGet, pathErrorsJSONBasic, false},
 				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
 			},
 			{
 				v1.GetJSONCompleteError,
 				api.RouteEndpoint{http.MethodGet, pathErrorsJSONComplete, false},
 				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
 			},
 			{
 				v1.GetPayloadError,
 				api.RouteEndpoint{http.MethodGet, pathErrorsPayload, false},
 				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
 			},
 			{
 				v1.GetTextError,
 				api.RouteEndpoint{http.MethodGet, pathErrorsText, false},
 				api.RouteNeedsNothing,
+				api.RouteAccessAny,
+				api.RouteLimitDefault,
 			},
 		},
 	}
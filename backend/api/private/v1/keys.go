@@ -0,0 +1,14 @@
+package v1
+
+import (
+	"net/http"
+
+	"github.com/shake-on-it/app-tmpl/backend/api"
+	"github.com/shake-on-it/app-tmpl/backend/api/private"
+)
+
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	srvCtx := private.MustHaveServerContext(r)
+
+	api.JSONResponse(w, r, 0, srvCtx.AuthService.JWKS())
+}
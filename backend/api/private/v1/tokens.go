@@ -0,0 +1,50 @@
+package v1
+
+import (
+	"net/http"
+
+	"github.com/shake-on-it/app-tmpl/backend/api"
+	"github.com/shake-on-it/app-tmpl/backend/api/private"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+)
+
+// tokens are posted as a form the way rfc 7662 and 7009 describe
+const (
+	formToken         = "token"
+	formTokenTypeHint = "token_type_hint"
+)
+
+func IntrospectToken(w http.ResponseWriter, r *http.Request) {
+	srvCtx := private.MustHaveServerContext(r)
+
+	token := r.PostFormValue(formToken)
+	if token == "" {
+		api.ErrorResponse(w, r, common.NewErr("must provide token", common.ErrCodeBadRequest))
+		return
+	}
+
+	introspection, err := srvCtx.AuthService.IntrospectToken(r.Context(), token, r.PostFormValue(formTokenTypeHint))
+	if err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.JSONResponse(w, r, 0, introspection)
+}
+
+func RevokeToken(w http.ResponseWriter, r *http.Request) {
+	srvCtx := private.MustHaveServerContext(r)
+
+	token := r.PostFormValue(formToken)
+	if token == "" {
+		api.ErrorResponse(w, r, common.NewErr("must provide token", common.ErrCodeBadRequest))
+		return
+	}
+
+	if err := srvCtx.AuthService.RevokeToken(r.Context(), token, r.PostFormValue(formTokenTypeHint)); err != nil {
+		api.ErrorResponse(w, r, err)
+		return
+	}
+
+	api.Response(w, r, http.StatusOK)
+}
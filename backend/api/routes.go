@@ -1,7 +1,12 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
 )
 
 // https://go.dev/play/p/ze3l4tDCCQK
@@ -12,15 +17,140 @@ const (
 	RouteNeedsAccessToken
 	RouteNeedsRefreshToken
 
+	// RouteNeedsClient is for private routes only other services may call
+	RouteNeedsClient
+
 	RouteNeedsSession = RouteNeedsAccessToken | RouteNeedsUser
 
 	RouteNeedsNothing RouteNeeds = 0
 )
 
+func (n RouteNeeds) String() string {
+	if n == RouteNeedsNothing {
+		return "nothing"
+	}
+
+	var needs []string
+	if n&RouteNeedsSession == RouteNeedsSession {
+		needs = append(needs, "session")
+	} else if n&RouteNeedsUser != 0 {
+		needs = append(needs, "user")
+	} else if n&RouteNeedsAccessToken != 0 {
+		needs = append(needs, "access token")
+	}
+	if n&RouteNeedsRefreshToken != 0 {
+		needs = append(needs, "refresh token")
+	}
+	if n&RouteNeedsClient != 0 {
+		needs = append(needs, "client")
+	}
+	return strings.Join(needs, ", ")
+}
+
+var (
+	RouteAccessAny   = RouteAccess{}
+	RouteAccessAdmin = RouteAccess{[]string{auth.UserTypeMe, auth.UserTypeAdmin}, "", false, false}
+)
+
+// RouteAccess lists the user types allowed to use a route,
+// an empty list leaves the route open to anyone that meets its needs
+type RouteAccess struct {
+	UserTypes []string
+
+	// APIKeyScope is the scope an api key needs to use the route,
+	// routes without one cannot be used with api keys at all
+	APIKeyScope string
+
+	// NoImpersonation keeps admins impersonating a user from the route
+	NoImpersonation bool
+
+	// NoCSRFCheck is only for the routes that start a new session from credentials in the body.
+	// A forged request cannot use cookies there since none are read, and clients still holding
+	// session cookies from before the csrf cookie was issued must be able to log in again to get one.
+	// Routes that act on an existing session, refreshing it included, are always checked
+	NoCSRFCheck bool
+}
+
+func (a RouteAccess) WithAPIKeyScope(scope string) RouteAccess {
+	a.APIKeyScope = scope
+	return a
+}
+
+func (a RouteAccess) WithoutImpersonation() RouteAccess {
+	a.NoImpersonation = true
+	return a
+}
+
+func (a RouteAccess) WithoutCSRFCheck() RouteAccess {
+	a.NoCSRFCheck = true
+	return a
+}
+
+func (a RouteAccess) Restricted() bool {
+	return len(a.UserTypes) > 0
+}
+
+func (a RouteAccess) Allows(user auth.User) bool {
+	if !a.Restricted() {
+		return true
+	}
+	for _, userType := range a.UserTypes {
+		if user.Type == userType {
+			return true
+		}
+	}
+	return false
+}
+
+func (a RouteAccess) String() string {
+	access := "any"
+	if a.Restricted() {
+		access = strings.Join(a.UserTypes, ", ")
+	}
+	if a.APIKeyScope != "" {
+		access += " (api key scope: " + a.APIKeyScope + ")"
+	}
+	if a.NoImpersonation {
+		access += " (no impersonation)"
+	}
+	if a.NoCSRFCheck {
+		access += " (no csrf check)"
+	}
+	return access
+}
+
+var (
+	RouteLimitDefault = RouteLimit{}
+)
+
+// RouteLimit is how many requests a user, or client ip when anonymous, may make
+// to a route. Burst requests are allowed at once and refill evenly over the period,
+// the zero limit leaves the route to the configured default
+type RouteLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+func (l RouteLimit) Or(fallback RouteLimit) RouteLimit {
+	if l.Burst == 0 || l.Period == 0 {
+		return fallback
+	}
+	return l
+}
+
+func (l RouteLimit) String() string {
+	if l == RouteLimitDefault {
+		return "default"
+	}
+	return fmt.Sprintf("%d per %s", l.Burst, l.Period)
+}
+
 type RouteRegistration struct {
 	Handler  http.HandlerFunc
 	Endpoint RouteEndpoint
 	Needs    RouteNeeds
+	Access   RouteAccess
+	Limit    RouteLimit
 }
 
 type RouteEndpoint struct {
@@ -28,3 +158,10 @@ type RouteEndpoint struct {
 	Path    string
 	UseCORS bool
 }
+
+// RouteHandler keeps a route's registration alongside the handler built for it
+// so the registered routes can be described when walking the router
+type RouteHandler struct {
+	http.Handler
+	Route RouteRegistration
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestRouteAccess(t *testing.T) {
+	for _, tc := range []struct {
+		userType string
+		any      bool
+		admin    bool
+	}{
+		{auth.UserTypeGuest, true, false},
+		{auth.UserTypeNormal, true, false},
+		{auth.UserTypeAdmin, true, true},
+		{auth.UserTypeMe, true, true},
+	} {
+		t.Run("should check access for user type "+strconv.Quote(tc.userType), func(t *testing.T) {
+			user := auth.User{Type: tc.userType}
+			assert.Equal(t, RouteAccessAny.Allows(user), tc.any)
+			assert.Equal(t, RouteAccessAdmin.Allows(user), tc.admin)
+		})
+	}
+
+	t.Run("should describe route requirements", func(t *testing.T) {
+		assert.Equal(t, RouteNeedsNothing.String(), "nothing")
+		assert.Equal(t, RouteNeedsSession.String(), "session")
+		assert.Equal(t, RouteNeedsRefreshToken.String(), "refresh token")
+		assert.Equal(t, (RouteNeedsAccessToken | RouteNeedsRefreshToken).String(), "access token, refresh token")
+		assert.Equal(t, RouteNeedsClient.String(), "client")
+
+		assert.Equal(t, RouteAccessAny.String(), "any")
+		assert.Equal(t, RouteAccessAdmin.String(), "me, admin")
+		assert.Equal(t, RouteAccessAny.WithAPIKeyScope(auth.APIKeyScopeUserRead).String(), "any (api key scope: user:read)")
+		assert.Equal(t, RouteAccessAny.WithoutImpersonation().String(), "any (no impersonation)")
+		assert.Equal(t, RouteAccessAny.WithoutCSRFCheck().String(), "any (no csrf check)")
+
+		assert.Equal(t, RouteLimitDefault.String(), "default")
+		assert.Equal(t, RouteLimit{20, time.Minute}.String(), "20 per 1m0s")
+	})
+
+	t.Run("should fall back to the default limit", func(t *testing.T) {
+		fallback := RouteLimit{300, time.Minute}
+		assert.Equal(t, RouteLimitDefault.Or(fallback), fallback)
+		assert.Equal(t, RouteLimit{20, time.Second}.Or(fallback), RouteLimit{20, time.Second})
+	})
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/shake-on-it/app-tmpl/backend/api"
@@ -14,6 +16,7 @@ import (
 	"github.com/shake-on-it/app-tmpl/backend/auth"
 	"github.com/shake-on-it/app-tmpl/backend/common"
 	"github.com/shake-on-it/app-tmpl/backend/core"
+	"github.com/shake-on-it/app-tmpl/backend/core/mail"
 	"github.com/shake-on-it/app-tmpl/backend/core/mongodb"
 
 	"github.com/gorilla/mux"
@@ -25,13 +28,20 @@ var (
 
 type apiAdmin struct {
 	config        common.Config
+	crypter       common.Crypter
 	logger        common.Logger
 	mongoProvider mongodb.Provider
 
 	AuthService core.AuthService
 
+	APIKeyStore       core.APIKeyStore
+	AuditStore        core.AuditStore
+	InviteStore       core.InviteStore
+	LoginAttemptStore core.LoginAttemptStore
+	RateLimitStore    core.RateLimitStore
 	RefreshTokenStore core.RefreshTokenStore
 	PasswordStore     core.PasswordStore
+	UserDataStore     core.UserDataStore
 	UserStore         core.UserStore
 }
 
@@ -55,9 +65,66 @@ func (a *apiAdmin) setup(ctx context.Context) error {
 		return err
 	}
 
-	a.AuthService = core.NewAuthService(a.config, userStore, passwordStore, refreshTokenStore)
+	apiKeyStore, err := core.NewAPIKeyStore(a.mongoProvider.Client())
+	if err != nil {
+		return err
+	}
+
+	loginAttemptStore, err := core.NewLoginAttemptStore(a.mongoProvider.Client())
+	if err != nil {
+		return err
+	}
+
+	auditStore, err := core.NewAuditStore(a.mongoProvider.Client())
+	if err != nil {
+		return err
+	}
+
+	inviteStore, err := core.NewInviteStore(a.mongoProvider.Client())
+	if err != nil {
+		return err
+	}
+
+	userDataStore, err := core.NewUserDataStore(a.mongoProvider.Client())
+	if err != nil {
+		return err
+	}
+
+	rateLimitStore := core.NewMemoryRateLimitStore()
+	if a.config.API.RateLimit.Backend == common.RateLimitBackendMongoDB {
+		rateLimitStore, err = core.NewRateLimitStore(a.mongoProvider.Client())
+		if err != nil {
+			return err
+		}
+	}
+
+	mailer, err := mail.NewMailer(a.config.Mail, a.logger)
+	if err != nil {
+		return err
+	}
+
+	keyring, err := auth.LoadKeyring(a.config.Auth)
+	if err != nil {
+		return err
+	}
+
+	breachedPasswords, err := auth.LoadBreachedPasswords(a.config.Auth.PasswordPolicy)
+	if err != nil {
+		return err
+	}
+	if breachedPasswords != nil {
+		a.logger.Infof("loaded %d breached passwords", breachedPasswords.Len())
+	}
+
+	a.AuthService = core.NewAuthService(a.config, a.crypter, keyring, breachedPasswords, a.logger, mailer, mongodb.NewTransactor(a.mongoProvider.Client()), userStore, passwordStore, refreshTokenStore, apiKeyStore, loginAttemptStore, auditStore, userDataStore, inviteStore)
+	a.APIKeyStore = apiKeyStore
+	a.AuditStore = auditStore
+	a.InviteStore = inviteStore
+	a.LoginAttemptStore = loginAttemptStore
+	a.RateLimitStore = rateLimitStore
 	a.RefreshTokenStore = refreshTokenStore
 	a.PasswordStore = passwordStore
+	a.UserDataStore = userDataStore
 	a.UserStore = userStore
 	return nil
 }
@@ -74,29 +141,50 @@ func (a *apiAdmin) ApplyRoutes(r *mux.Router) {
 		for _, route := range router.Registry[version] {
 			var handler http.Handler = route.Handler
 
-			// TODO: check access
-			// TODO: user request limit (admin only?)
+			needs := route.Needs
+			if route.Access.Restricted() {
+				// access is checked against the stored user so it always needs a session
+				needs |= api.RouteNeedsSession
+				handler = a.checkAccess(route.Access, handler)
+			}
 
-			if route.Needs&api.RouteNeedsUser != 0 {
+			if route.Access.NoImpersonation {
+				handler = a.checkImpersonation(handler)
+			}
+
+			if needs&api.RouteNeedsUser != 0 {
 				handler = a.loadUser(handler)
 			}
 
-			if route.Needs&api.RouteNeedsAccessToken != 0 {
+			if needs&api.RouteNeedsAccessToken != 0 {
 				handler = a.loadAccessToken(handler)
 			}
 
-			if route.Needs&api.RouteNeedsRefreshToken != 0 {
+			if needs&api.RouteNeedsRefreshToken != 0 {
 				handler = a.loadRefreshToken(handler)
 			}
 
-			handler = a.attachRefreshToken(handler)
-			handler = a.attachAccessToken(handler)
+			// callers are limited once they are known but before anything is loaded for them
+			handler = a.limitRate(version, route, handler)
+
+			// a bearer token is the refresh token on routes that need one, otherwise it is the access token
+			bearerRefresh := needs&api.RouteNeedsRefreshToken != 0
+
+			handler = a.attachRefreshToken(handler, bearerRefresh)
+			handler = a.attachAccessToken(handler, !bearerRefresh)
+			handler = a.attachAPIKey(route.Access.APIKeyScope, handler)
 			handler = a.attachUserToken(handler)
 			handler = a.attachServerContext(handler)
+			handler = a.attachAuditSource(handler)
+			handler = a.attachSessionClient(handler)
 
 			switch route.Endpoint.Method {
 			case http.MethodGet, http.MethodHead:
 				handler = middleware.RequestCacheBuster(handler)
+			default:
+				if !route.Access.NoCSRFCheck {
+					handler = a.checkCSRFToken(handler)
+				}
 			}
 
 			methods := make([]string, 0, 2)
@@ -105,7 +193,7 @@ func (a *apiAdmin) ApplyRoutes(r *mux.Router) {
 				methods = append(methods, http.MethodOptions)
 			}
 
-			r.Path(version + route.Endpoint.Path).Methods(methods...).Handler(handler)
+			r.Path(version + route.Endpoint.Path).Methods(methods...).Handler(api.RouteHandler{handler, route})
 		}
 	}
 }
@@ -116,39 +204,96 @@ func (a apiAdmin) attachServerContext(next http.Handler) http.Handler {
 	})
 }
 
-func (a apiAdmin) attachAccessToken(next http.Handler) http.Handler {
+func (a apiAdmin) attachAuditSource(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID, _ := api.CtxRequestID(r)
+		next.ServeHTTP(w, r.WithContext(core.AttachAuditSource(r.Context(), api.RequestClientIP(r), requestID)))
+	})
+}
+
+func (a apiAdmin) attachSessionClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := auth.NewSessionClient(r.UserAgent(), api.RequestClientIP(r))
+		next.ServeHTTP(w, r.WithContext(core.AttachSessionClient(r.Context(), client)))
+	})
+}
+
+func (a apiAdmin) attachAccessToken(next http.Handler, allowBearer bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie(auth.CookieAccessToken)
+		token, ok, err := requestToken(r, auth.CookieAccessToken, allowBearer)
 		if err != nil {
-			if err == http.ErrNoCookie {
-				next.ServeHTTP(w, r)
-			} else {
-				api.ErrorResponse(w, r, auth.ErrMalformedCookie)
-			}
+			api.ErrorResponse(w, r, err)
 			return
 		}
-
-		if cookie.Value == "" {
-			api.ErrorResponse(w, r, auth.ErrMustAuthenticate)
+		if !ok {
+			next.ServeHTTP(w, r)
 			return
 		}
 
 		var accessToken auth.AccessToken
-		if err := a.AuthService.ParseToken(cookie.Value, &accessToken); err != nil {
+		if err := a.AuthService.ParseToken(token, &accessToken); err != nil {
 			api.ErrorResponse(w, r, err)
 			return
 		}
 
+		ctx := r.Context()
+		if accessToken.Impersonating() {
+			ctx = core.AttachAuditImpersonator(ctx, accessToken.Actor)
+		}
+
 		next.ServeHTTP(w, r.WithContext(
-			api.NewContextBuilder(r.Context()).
+			api.NewContextBuilder(ctx).
 				AttachAccessToken(accessToken).
 				Context(),
 		))
 	})
 }
 
+// attachAPIKey authenticates requests made with an api key as the key's user,
+// there is no session for these requests so the key stands in for the access token
+func (a apiAdmin) attachAPIKey(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !api.RequestHasAuthorization(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, err := api.RequestAuthorization(r)
+		if err != nil {
+			api.ErrorResponse(w, r, err)
+			return
+		}
+		if !auth.IsAPIKey(token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		apiKey, user, err := a.AuthService.CheckAPIKey(r.Context(), token)
+		if err != nil {
+			api.ErrorResponse(w, r, err)
+			return
+		}
+		if scope == "" || !apiKey.Allows(scope) {
+			api.ErrorResponse(w, r, auth.ErrInsufficientAccess)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(
+			api.NewContextBuilder(r.Context()).
+				AttachAPIKey(apiKey).
+				AttachUserToken(user).
+				Context(),
+		))
+	})
+}
+
 func (a apiAdmin) loadAccessToken(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := api.CtxAPIKey(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		_, ok := api.CtxAccessToken(r)
 		if !ok {
 			api.ErrorResponse(w, r, auth.ErrMustAuthenticate)
@@ -159,25 +304,20 @@ func (a apiAdmin) loadAccessToken(next http.Handler) http.Handler {
 	})
 }
 
-func (a apiAdmin) attachRefreshToken(next http.Handler) http.Handler {
+func (a apiAdmin) attachRefreshToken(next http.Handler, allowBearer bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie(auth.CookieRefreshToken)
+		token, ok, err := requestToken(r, auth.CookieRefreshToken, allowBearer)
 		if err != nil {
-			if err == http.ErrNoCookie {
-				next.ServeHTTP(w, r)
-			} else {
-				api.ErrorResponse(w, r, auth.ErrMalformedCookie)
-			}
+			api.ErrorResponse(w, r, err)
 			return
 		}
-
-		if cookie.Value == "" {
-			api.ErrorResponse(w, r, auth.ErrMustAuthenticate)
+		if !ok {
+			next.ServeHTTP(w, r)
 			return
 		}
 
 		var refreshToken auth.RefreshToken
-		if err := a.AuthService.ParseToken(cookie.Value, &refreshToken); err != nil {
+		if err := a.AuthService.ParseToken(token, &refreshToken); err != nil {
 			api.ErrorResponse(w, r, err)
 			return
 		}
@@ -197,13 +337,95 @@ func (a apiAdmin) loadRefreshToken(next http.Handler) http.Handler {
 			api.ErrorResponse(w, r, auth.ErrMustAuthenticate)
 			return
 		}
-		ok, err := a.RefreshTokenStore.Check(r.Context(), refreshToken.SessionID)
+		if err := a.AuthService.CheckRefreshToken(r.Context(), refreshToken); err != nil {
+			api.ErrorResponse(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitRate counts the request against the caller's bucket for the route,
+// callers are the authenticated user or otherwise the client ip
+func (a apiAdmin) limitRate(version string, route api.RouteRegistration, next http.Handler) http.Handler {
+	limit := route.Limit.Or(api.RouteLimit{a.config.API.RateLimit.Burst, a.config.API.RateLimit.Period()})
+	routeKey := route.Endpoint.Method + " " + version + route.Endpoint.Path
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller := "ip:" + api.RequestClientIP(r)
+		if apiKey, ok := api.CtxAPIKey(r); ok {
+			caller = "user:" + apiKey.UserID.Hex()
+		} else if accessToken, ok := api.CtxAccessToken(r); ok {
+			caller = "user:" + accessToken.UserID.Hex()
+		}
+
+		bucket, err := a.RateLimitStore.Take(r.Context(), caller+" "+routeKey, limit.Burst, limit.Period, time.Now())
 		if err != nil {
-			api.ErrorResponse(w, r, common.WrapErr(err, common.ErrCodeServer))
+			// a failing store must not take the whole api down with it
+			api.MustHaveLogger(r).Warnf("failed to check rate limit: %s", err)
+			next.ServeHTTP(w, r)
 			return
 		}
-		if !ok {
-			api.ErrorResponse(w, r, auth.ErrInvalidSession)
+
+		w.Header().Set(api.HeaderXRateLimitLimit, strconv.Itoa(limit.Burst))
+		w.Header().Set(api.HeaderXRateLimitRemaining, strconv.Itoa(bucket.Remaining()))
+		w.Header().Set(api.HeaderXRateLimitReset, strconv.Itoa(int(math.Ceil(bucket.ResetAfter(limit.Burst, limit.Period).Seconds()))))
+
+		if !bucket.Allowed {
+			api.ErrorResponse(w, r, core.ErrRateLimited(bucket.RetryAfter(limit.Burst, limit.Period)))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkCSRFToken makes requests authenticated by session cookies send the csrf
+// cookie's token back in a header, requests without the cookies have nothing to forge
+func (a apiAdmin) checkCSRFToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cookieAuth bool
+		for _, cookieName := range []string{auth.CookieAccessToken, auth.CookieRefreshToken} {
+			if _, err := r.Cookie(cookieName); err == nil {
+				cookieAuth = true
+			}
+		}
+		if !cookieAuth {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var cookieToken string
+		if cookie, err := r.Cookie(auth.CookieCSRFToken); err == nil {
+			cookieToken = cookie.Value
+		}
+		if !auth.CheckCSRFToken(cookieToken, r.Header.Get(api.HeaderXAPP+api.HeaderCSRFToken)) {
+			api.ErrorResponse(w, r, auth.ErrInvalidCSRFToken)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a apiAdmin) checkAccess(access api.RouteAccess, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !access.Allows(api.MustHaveUser(r)) {
+			api.ErrorResponse(w, r, auth.ErrInsufficientAccess)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkImpersonation keeps impersonated sessions from routes
+// that should only ever be used by the user themselves
+func (a apiAdmin) checkImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accessToken, ok := api.CtxAccessToken(r); ok && accessToken.Impersonating() {
+			api.ErrorResponse(w, r, auth.ErrImpersonating)
 			return
 		}
 
@@ -228,15 +450,15 @@ func (a apiAdmin) attachUserToken(next http.Handler) http.Handler {
 			return
 		}
 
-		var user auth.User
-		if err := a.AuthService.ParseToken(cookie.Value, &user); err != nil {
+		var userToken auth.UserToken
+		if err := a.AuthService.ParseToken(cookie.Value, &userToken); err != nil {
 			api.ErrorResponse(w, r, err)
 			return
 		}
 
 		next.ServeHTTP(w, r.WithContext(
 			api.NewContextBuilder(r.Context()).
-				AttachUserToken(user).
+				AttachUserToken(userToken.User).
 				Context(),
 		))
 	})
@@ -244,20 +466,33 @@ func (a apiAdmin) attachUserToken(next http.Handler) http.Handler {
 
 func (a apiAdmin) loadUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		prevUser, ok := api.CtxUser(r)
+		// the api key's user was loaded when the key was checked
+		if _, ok := api.CtxAPIKey(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		accessToken, ok := api.CtxAccessToken(r)
 		if !ok {
 			api.ErrorResponse(w, r, auth.ErrMustAuthenticate)
 			return
 		}
 
-		user, err := a.UserStore.FindByID(r.Context(), prevUser.ID)
+		// bearer clients have no user token, otherwise it must match the session's user
+		if prevUser, ok := api.CtxUser(r); ok && prevUser.ID != accessToken.UserID {
+			api.ErrorResponse(w, r, auth.ErrInvalidSession)
+			return
+		} else if !ok && !api.RequestHasAuthorization(r) {
+			api.ErrorResponse(w, r, auth.ErrMustAuthenticate)
+			return
+		}
+
+		user, err := a.UserStore.FindByID(r.Context(), accessToken.UserID)
 		if err != nil {
 			api.ErrorResponse(w, r, err)
 			return
 		}
 
-		accessToken := api.MustHaveAccessToken(r)
-
 		var activeSession bool
 		for _, sessionID := range user.Sessions {
 			if sessionID == accessToken.SessionID {
@@ -270,21 +505,23 @@ func (a apiAdmin) loadUser(next http.Handler) http.Handler {
 			return
 		}
 
-		userToken, err := a.AuthService.SignToken(&user)
-		if err != nil {
-			api.ErrorResponse(w, r, common.WrapErr(fmt.Errorf("failed to sign user token: %w", err), common.ErrCodeServer))
-			return
-		}
+		if _, ok := api.CtxUser(r); ok {
+			userToken, err := a.AuthService.SignUserToken(user)
+			if err != nil {
+				api.ErrorResponse(w, r, common.WrapErr(fmt.Errorf("failed to sign user token: %w", err), common.ErrCodeServer))
+				return
+			}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     auth.CookieUserToken,
-			Value:    userToken,
-			HttpOnly: true,
-			SameSite: http.SameSiteStrictMode,
-			Secure:   a.config.Server.SSLEnabled,
-			Path:     "/",
-			Expires:  time.Now().Add(tenYears),
-		})
+			http.SetCookie(w, &http.Cookie{
+				Name:     auth.CookieUserToken,
+				Value:    userToken,
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+				Secure:   a.config.Server.SSLEnabled,
+				Path:     "/",
+				Expires:  time.Now().Add(tenYears),
+			})
+		}
 
 		next.ServeHTTP(w, r.WithContext(
 			api.NewContextBuilder(r.Context()).
@@ -293,3 +530,32 @@ func (a apiAdmin) loadUser(next http.Handler) http.Handler {
 		))
 	})
 }
+
+// requestToken reads the token from its cookie, falling back to the
+// authorization header when allowed and no cookie is present
+func requestToken(r *http.Request, cookieName string, allowBearer bool) (string, bool, error) {
+	cookie, err := r.Cookie(cookieName)
+	if err == nil {
+		if cookie.Value == "" {
+			return "", false, auth.ErrMustAuthenticate
+		}
+		return cookie.Value, true, nil
+	}
+	if err != http.ErrNoCookie {
+		return "", false, auth.ErrMalformedCookie
+	}
+
+	if !allowBearer || !api.RequestHasAuthorization(r) {
+		return "", false, nil
+	}
+
+	token, err := api.RequestAuthorization(r)
+	if err != nil {
+		return "", false, err
+	}
+	if auth.IsAPIKey(token) {
+		// api keys are handled on their own
+		return "", false, nil
+	}
+	return token, true, nil
+}
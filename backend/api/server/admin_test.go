@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/api"
+	"github.com/shake-on-it/app-tmpl/backend/api/middleware"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+	"github.com/shake-on-it/app-tmpl/backend/core"
+)
+
+func TestAPIAdminLimitRate(t *testing.T) {
+	a := apiAdmin{RateLimitStore: core.NewMemoryRateLimitStore()}
+
+	route := api.RouteRegistration{
+		Endpoint: api.RouteEndpoint{http.MethodPost, "/auth/login", true},
+		Limit:    api.RouteLimit{1, time.Minute},
+	}
+
+	proxies, err := api.ParseTrustedProxies([]string{"10.0.0.1"})
+	assert.Nil(t, err)
+
+	handler := middleware.RequestClientIP(proxies)(a.limitRate("/api/admin/v1", route, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.Response(w, r, http.StatusNoContent)
+	})))
+
+	request := func(remoteAddr, forwarded string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/admin/v1/auth/login", nil)
+		r.RemoteAddr = remoteAddr
+		if forwarded != "" {
+			r.Header.Set(api.HeaderXForwardedFor, forwarded)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	t.Run("should not give a forged forwarded address a fresh bucket", func(t *testing.T) {
+		assert.Equal(t, request("203.0.113.7:1234", "198.51.100.1"), http.StatusNoContent)
+		assert.Equal(t, request("203.0.113.7:1234", "198.51.100.2"), http.StatusTooManyRequests)
+		assert.Equal(t, request("203.0.113.7:5678", ""), http.StatusTooManyRequests)
+	})
+
+	t.Run("should key clients behind a trusted proxy on their own address", func(t *testing.T) {
+		assert.Equal(t, request("10.0.0.1:1234", "198.51.100.3"), http.StatusNoContent)
+		assert.Equal(t, request("10.0.0.1:1234", "198.51.100.3"), http.StatusTooManyRequests)
+		assert.Equal(t, request("10.0.0.1:1234", "192.0.2.99, 198.51.100.3"), http.StatusTooManyRequests)
+		assert.Equal(t, request("10.0.0.1:1234", "198.51.100.4"), http.StatusNoContent)
+	})
+}
@@ -5,9 +5,11 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/shake-on-it/app-tmpl/backend/api"
 	"github.com/shake-on-it/app-tmpl/backend/api/middleware"
 	"github.com/shake-on-it/app-tmpl/backend/api/private"
 	"github.com/shake-on-it/app-tmpl/backend/api/private/router"
+	"github.com/shake-on-it/app-tmpl/backend/auth"
 	"github.com/shake-on-it/app-tmpl/backend/common"
 )
 
@@ -20,18 +22,25 @@ func (a *apiPrivate) setup(ctx context.Context) error {
 	return nil
 }
 
-func (api apiPrivate) ServerContext() private.ServerContext {
+func (a apiPrivate) ServerContext() private.ServerContext {
 	return private.ServerContext{
-		api.adminAPI.ServerContext(),
+		a.adminAPI.ServerContext(),
 	}
 }
 
-func (api *apiPrivate) ApplyRoutes(r *mux.Router) {
+func (a *apiPrivate) ApplyRoutes(r *mux.Router) {
 	for _, version := range router.Versions {
 		for _, route := range router.Registry[version] {
 			var handler http.Handler = route.Handler
 
-			handler = api.attachServerContext(handler)
+			if route.Needs&api.RouteNeedsClient != 0 {
+				handler = a.checkClient(handler)
+			}
+
+			// the limit is taken before the client is checked so that its secret cannot be guessed freely
+			handler = a.adminAPI.limitRate(pathPrivate+version, route, handler)
+
+			handler = a.attachServerContext(handler)
 
 			switch route.Endpoint.Method {
 			case http.MethodGet, http.MethodHead:
@@ -44,7 +53,7 @@ func (api *apiPrivate) ApplyRoutes(r *mux.Router) {
 				methods = append(methods, http.MethodOptions)
 			}
 
-			r.Path(version + route.Endpoint.Path).Methods(methods...).Handler(handler)
+			r.Path(version + route.Endpoint.Path).Methods(methods...).Handler(api.RouteHandler{handler, route})
 		}
 	}
 }
@@ -60,3 +69,23 @@ func (a apiPrivate) attachServerContext(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(private.AttachServerContext(r.Context(), a.ServerContext())))
 	})
 }
+
+// checkClient lets only the configured service clients through, they send their id and secret with http basic auth
+func (a apiPrivate) checkClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set(api.HeaderWWWAuthenticate, api.AuthenticateBasic)
+			api.ErrorResponse(w, r, auth.ErrMustAuthenticate)
+			return
+		}
+
+		if err := a.adminAPI.AuthService.CheckServiceClient(id, secret); err != nil {
+			w.Header().Set(api.HeaderWWWAuthenticate, api.AuthenticateBasic)
+			api.ErrorResponse(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+	"github.com/shake-on-it/app-tmpl/backend/core"
+)
+
+func TestAPIPrivateLimitRate(t *testing.T) {
+	var config common.Config
+	config.API.RateLimit = common.RateLimitConfig{common.RateLimitBackendMemory, 1, 60}
+
+	a := apiPrivate{adminAPI: &apiAdmin{config: config, RateLimitStore: core.NewMemoryRateLimitStore()}}
+
+	r := mux.NewRouter()
+	a.ApplyRoutes(r.PathPrefix(pathPrivate).Subrouter())
+
+	request := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "203.0.113.7:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("should limit the private routes", func(t *testing.T) {
+		assert.Equal(t, request(http.MethodGet, "/private/v1/version"), http.StatusOK)
+		assert.Equal(t, request(http.MethodGet, "/private/v1/version"), http.StatusTooManyRequests)
+	})
+
+	t.Run("should limit clients before their secret is checked", func(t *testing.T) {
+		assert.Equal(t, request(http.MethodPost, "/private/v1/introspect"), http.StatusUnauthorized)
+		assert.Equal(t, request(http.MethodPost, "/private/v1/introspect"), http.StatusTooManyRequests)
+		assert.Equal(t, request(http.MethodPost, "/private/v1/revoke"), http.StatusUnauthorized)
+		assert.Equal(t, request(http.MethodPost, "/private/v1/revoke"), http.StatusTooManyRequests)
+	})
+}
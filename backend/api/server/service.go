@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/shake-on-it/app-tmpl/backend/api"
 	"github.com/shake-on-it/app-tmpl/backend/api/middleware"
 	"github.com/shake-on-it/app-tmpl/backend/common"
 	"github.com/shake-on-it/app-tmpl/backend/core/mongodb"
@@ -32,6 +33,9 @@ type Service struct {
 	httpServer *http.Server
 	wg         sync.WaitGroup
 
+	workers     sync.WaitGroup
+	stopWorkers context.CancelFunc
+
 	AdminAPI   *apiAdmin
 	PrivateAPI *apiPrivate
 }
@@ -49,8 +53,15 @@ func (s *Service) Setup(ctx context.Context) error {
 		return err
 	}
 
+	proxies, err := api.ParseTrustedProxies(s.config.API.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
 	r := mux.NewRouter()
-	s.configureRouter(r)
+	s.configureRouter(r, proxies)
+
+	s.startWorkers()
 
 	s.httpServer = &http.Server{
 		Addr:    fmt.Sprintf(":%d", s.config.Server.Port),
@@ -90,6 +101,12 @@ func (s *Service) Shutdown(ctx context.Context) error {
 	}
 	s.logger.Info("no longer accepting incoming requests")
 
+	if s.stopWorkers != nil {
+		s.stopWorkers()
+		s.workers.Wait()
+	}
+	s.logger.Info("stopped background workers")
+
 	s.mongoProvider.Close(ctx)
 	s.logger.Info("disconnected from mongodb")
 
@@ -108,9 +125,10 @@ func (s *Service) buildServers(ctx context.Context) error {
 	}
 
 	s.AdminAPI = &apiAdmin{
-		config:          s.config,
+		config:        s.config,
+		crypter:       s.crypter,
 		mongoProvider: s.mongoProvider,
-		logger:          s.logger,
+		logger:        s.logger,
 	}
 	if err := s.AdminAPI.setup(ctx); err != nil {
 		return err
@@ -127,9 +145,10 @@ func (s *Service) buildServers(ctx context.Context) error {
 	return nil
 }
 
-func (s *Service) configureRouter(router *mux.Router) {
+func (s *Service) configureRouter(router *mux.Router, proxies api.TrustedProxies) {
 	r := router.PathPrefix(pathAPI).Subrouter()
 
+	r.Use(middleware.RequestClientIP(proxies))
 	r.Use(middleware.RequestLimiter(s.config.API.RequestLimit))
 	r.Use(middleware.RequestTimeouter(s.config.API.RequestTimeout()))
 	r.Use(middleware.RequestLogger(s.logger))
@@ -162,7 +181,11 @@ func (s *Service) configureRouter(router *mux.Router) {
 			}
 			methods = []string{""}
 		}
-		routeTree.WriteString(routeString(path, methods))
+		var requirements string
+		if handler, ok := route.GetHandler().(api.RouteHandler); ok {
+			requirements = fmt.Sprintf("needs: %s; access: %s; limit: %s", handler.Route.Needs, handler.Route.Access, handler.Route.Limit)
+		}
+		routeTree.WriteString(routeString(path, methods, requirements))
 		return nil
 	}); err != nil {
 		s.logger.Warnf("failed to walk the route tree: %s", err)
@@ -172,15 +195,15 @@ func (s *Service) configureRouter(router *mux.Router) {
 	}
 }
 
-func routeString(path string, methods []string) string {
+func routeString(path string, methods []string, requirements string) string {
 	paths := make([]string, 0, len(methods))
 	for _, method := range methods {
 		if method == http.MethodOptions {
 			continue
 		}
-		paths = append(paths, fmt.Sprintf("%-8s %s", method, path))
+		paths = append(paths, strings.TrimSpace(fmt.Sprintf("%-8s %-40s %s", method, path, requirements)))
 	}
-	return "\n"+strings.Join(paths, "\n")
+	return "\n" + strings.Join(paths, "\n")
 }
 
 // type errLogWriter struct{}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+)
+
+func (s *Service) startWorkers() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopWorkers = cancel
+
+	s.runWorker(ctx, "session sweeper", s.config.Auth.SessionSweepInterval(), s.sweepSessions)
+	s.runWorker(ctx, "user purger", s.config.Auth.AccountDeletion.PurgeInterval(), s.purgeUsers)
+}
+
+func (s *Service) runWorker(ctx context.Context, name string, interval time.Duration, work func(ctx context.Context) error) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			workCtx, cancel := context.WithTimeout(ctx, common.TimeoutServerOp)
+			if err := work(workCtx); err != nil && ctx.Err() == nil {
+				s.logger.Warnf("%s failed: %s", name, err)
+			}
+			cancel()
+		}
+	}()
+}
+
+func (s *Service) sweepSessions(ctx context.Context) error {
+	count, err := s.AdminAPI.AuthService.SweepSessions(ctx)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		s.logger.Infof("removed %d stale user sessions", count)
+	}
+	return nil
+}
+
+func (s *Service) purgeUsers(ctx context.Context) error {
+	count, err := s.AdminAPI.AuthService.PurgeUsers(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		s.logger.Infof("purged %d deleted users", count)
+	}
+	return nil
+}
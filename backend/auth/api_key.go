@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// api keys look like app_<key id>_<secret> so they can be found by id
+// and recognized apart from jwts when sent as a bearer token
+const (
+	APIKeyPrefix       = "app_"
+	APIKeySecretLength = 32
+
+	// scopes are named for the resource they cover and whether it is only read or also written.
+	// keys are only ever created from a session so that a key cannot give itself more scopes
+	APIKeyScopeUserRead      = "user:read"
+	APIKeyScopeSessionsRead  = "sessions:read"
+	APIKeyScopeSessionsWrite = "sessions:write"
+	APIKeyScopeAPIKeysRead   = "api_keys:read"
+	APIKeyScopeAPIKeysWrite  = "api_keys:write"
+	APIKeyScopeUsersWrite    = "users:write"
+	APIKeyScopeAuditRead     = "audit:read"
+	APIKeyScopeInvitesRead   = "invites:read"
+	APIKeyScopeInvitesWrite  = "invites:write"
+)
+
+var (
+	APIKeyScopes = []string{
+		APIKeyScopeUserRead,
+		APIKeyScopeSessionsRead,
+		APIKeyScopeSessionsWrite,
+		APIKeyScopeAPIKeysRead,
+		APIKeyScopeAPIKeysWrite,
+		APIKeyScopeUsersWrite,
+		APIKeyScopeAuditRead,
+		APIKeyScopeInvitesRead,
+		APIKeyScopeInvitesWrite,
+	}
+
+	ErrInvalidAPIKey = common.NewErr("invalid api key", common.ErrCodeInvalidAuth)
+	ErrAPIKeyExpired = common.NewErr("api key has expired", common.ErrCodeInvalidAuth)
+)
+
+// APIKey is a long-lived credential for scripts acting as its user,
+// keys without scopes can be used on any route that accepts api keys
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"-"`
+	Name       string             `bson:"name" json:"name"`
+	Scopes     []string           `bson:"scopes" json:"scopes"`
+	HashedKey  string             `bson:"hashed_key" json:"-"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt  *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+}
+
+func (k *APIKey) Validate() error {
+	if k.ID == primitive.NilObjectID {
+		k.ID = primitive.NewObjectID()
+	}
+	if k.UserID == primitive.NilObjectID {
+		return errors.New("must have user")
+	}
+	if k.Name == "" {
+		return errors.New("must have name")
+	}
+	if k.HashedKey == "" {
+		return errors.New("must be hashed")
+	}
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(k.CreatedAt) {
+		return errors.New("must expire after it is created")
+	}
+	for _, scope := range k.Scopes {
+		if !validAPIKeyScope(scope) {
+			return errors.New("unknown scope: " + scope)
+		}
+	}
+	if k.Scopes == nil {
+		k.Scopes = []string{}
+	}
+	return nil
+}
+
+func (k APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && now.After(*k.ExpiresAt)
+}
+
+func (k APIKey) Allows(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type APIKeyCreate struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// NewAPIKey is only ever returned when the key is created,
+// afterwards only the hash of its secret is kept
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+func NewAPIKeySecret() (string, error) {
+	secret := make([]byte, APIKeySecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func FormatAPIKey(id primitive.ObjectID, secret string) string {
+	return APIKeyPrefix + id.Hex() + "_" + secret
+}
+
+// ParseAPIKey splits a key into its id and secret, the secret
+// may itself contain underscores so only the first is split on
+func ParseAPIKey(key string) (primitive.ObjectID, string, error) {
+	if !IsAPIKey(key) {
+		return primitive.NilObjectID, "", ErrInvalidAPIKey
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(key, APIKeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return primitive.NilObjectID, "", ErrInvalidAPIKey
+	}
+
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		return primitive.NilObjectID, "", ErrInvalidAPIKey
+	}
+	return id, parts[1], nil
+}
+
+func validAPIKeyScope(scope string) bool {
+	for _, s := range APIKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
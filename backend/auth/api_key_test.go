@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAPIKey(t *testing.T) {
+	t.Run("should parse a formatted key back into its id and secret", func(t *testing.T) {
+		id := primitive.NewObjectID()
+
+		key := FormatAPIKey(id, "se_cr_et")
+		assert.True(t, IsAPIKey(key))
+
+		parsedID, secret, err := ParseAPIKey(key)
+		assert.Nil(t, err)
+		assert.Equal(t, parsedID, id)
+		assert.Equal(t, secret, "se_cr_et")
+	})
+
+	t.Run("should fail to parse malformed keys", func(t *testing.T) {
+		for _, key := range []string{
+			"eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9",
+			"app_",
+			"app_notanid_secret",
+			"app_" + primitive.NewObjectID().Hex(),
+			"app_" + primitive.NewObjectID().Hex() + "_",
+		} {
+			_, _, err := ParseAPIKey(key)
+			assert.Equal(t, err, ErrInvalidAPIKey)
+		}
+	})
+
+	t.Run("should only allow the key's scopes", func(t *testing.T) {
+		assert.True(t, APIKey{}.Allows(APIKeyScopeUserRead))
+		assert.True(t, APIKey{Scopes: []string{APIKeyScopeUserRead}}.Allows(APIKeyScopeUserRead))
+		assert.False(t, APIKey{Scopes: []string{APIKeyScopeUserRead}}.Allows("user:write"))
+	})
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	AuditActionRegister             = "register"
+	AuditActionRequestVerification  = "request_verification"
+	AuditActionVerifyEmail          = "verify_email"
+	AuditActionLogin                = "login"
+	AuditActionLoginTOTP            = "login_totp"
+	AuditActionLoginOAuth           = "login_oauth"
+	AuditActionRefresh              = "refresh"
+	AuditActionLogout               = "logout"
+	AuditActionLogoutAll            = "logout_all"
+	AuditActionRevokeSession        = "revoke_session"
+	AuditActionChangePassword       = "change_password"
+	AuditActionRequestPasswordReset = "request_password_reset"
+	AuditActionResetPassword        = "reset_password"
+	AuditActionEnrollTOTP           = "enroll_totp"
+	AuditActionConfirmTOTP          = "confirm_totp"
+	AuditActionDisableTOTP          = "disable_totp"
+	AuditActionCreateAPIKey         = "create_api_key"
+	AuditActionRevokeAPIKey         = "revoke_api_key"
+	AuditActionUnlockUser           = "unlock_user"
+	AuditActionDeleteUser           = "delete_user"
+	AuditActionPurgeUser            = "purge_user"
+	AuditActionExportUser           = "export_user"
+	AuditActionCreateInvite         = "create_invite"
+	AuditActionRevokeInvite         = "revoke_invite"
+	AuditActionImpersonate          = "impersonate"
+	AuditActionEndImpersonation     = "end_impersonation"
+	AuditActionRevokeToken          = "revoke_token"
+
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeDenied  = "denied"
+	AuditOutcomeFailed  = "failed"
+
+	AuditTargetAPIKey  = "api_key"
+	AuditTargetInvite  = "invite"
+	AuditTargetSession = "session"
+	AuditTargetUser    = "user"
+
+	AuditQueryMaxLimit     = 200
+	AuditQueryDefaultLimit = 50
+)
+
+// AuditEvent records an account operation, who made it, what it acted on and how it went.
+// The actor is unknown for anonymous requests, failed logins keep the username tried instead.
+// Operations made while impersonating a user also name the admin behind them
+type AuditEvent struct {
+	ID             primitive.ObjectID `bson:"_id" json:"id"`
+	Action         string             `bson:"action" json:"action"`
+	ActorID        primitive.ObjectID `bson:"actor_id,omitempty" json:"actor_id,omitempty"`
+	ImpersonatorID primitive.ObjectID `bson:"impersonator_id,omitempty" json:"impersonator_id,omitempty"`
+	Username       string             `bson:"username,omitempty" json:"username,omitempty"`
+	TargetType     string             `bson:"target_type,omitempty" json:"target_type,omitempty"`
+	TargetID       primitive.ObjectID `bson:"target_id,omitempty" json:"target_id,omitempty"`
+	IPAddress      string             `bson:"ip_address,omitempty" json:"ip_address,omitempty"`
+	RequestID      string             `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	Outcome        string             `bson:"outcome" json:"outcome"`
+	Error          string             `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt      time.Time          `bson:"expires_at" json:"-"`
+}
+
+// AuditOutcome tells requests the client got wrong or was not allowed to make
+// apart from operations that failed on our end
+func AuditOutcome(err error) string {
+	if err == nil {
+		return AuditOutcomeSuccess
+	}
+	if e, ok := err.(common.ErrCodeProvider); ok {
+		switch e.Code() {
+		case common.ErrCodeBadRequest,
+			common.ErrCodeNotFound,
+			common.ErrCodeConflict,
+			common.ErrCodeInvalidAuth,
+			common.ErrCodeInsufficientAuth,
+			common.ErrCodeTooManyRequests:
+			return AuditOutcomeDenied
+		}
+	}
+	return AuditOutcomeFailed
+}
+
+// AuditQuery filters audit events, newest first. A user matches the events they made,
+// made while impersonating someone and the ones made about them, before continues from the last event of the previous page
+type AuditQuery struct {
+	UserID primitive.ObjectID
+	Action string
+	From   time.Time
+	To     time.Time
+	Before primitive.ObjectID
+	Limit  int
+}
+
+type AuditPage struct {
+	Events []AuditEvent `json:"events"`
+	Next   string       `json:"next,omitempty"`
+}
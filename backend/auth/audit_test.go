@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestAuditOutcome(t *testing.T) {
+	for _, tc := range []struct {
+		description string
+		err         error
+		outcome     string
+	}{
+		{"no error", nil, AuditOutcomeSuccess},
+		{"a wrong password", common.NewErr("invalid password", common.ErrCodeBadRequest), AuditOutcomeDenied},
+		{"an invalid session", ErrInvalidSession, AuditOutcomeDenied},
+		{"too many attempts", ErrTooManyLoginAttempts(0), AuditOutcomeDenied},
+		{"a server error", common.NewErr("oops", common.ErrCodeServer), AuditOutcomeFailed},
+		{"an unknown error", errors.New("oops"), AuditOutcomeFailed},
+	} {
+		t.Run("should be "+tc.outcome+" after "+tc.description, func(t *testing.T) {
+			assert.Equal(t, AuditOutcome(tc.err), tc.outcome)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+const (
+	CSRFTokenLength = 32
+)
+
+// NewCSRFToken makes the token sent both as a cookie the client can read and
+// back in a header, other sites can send the cookie but cannot read it to set the header
+func NewCSRFToken() (string, error) {
+	token := make([]byte, CSRFTokenLength)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func CheckCSRFToken(cookieToken, headerToken string) bool {
+	if cookieToken == "" || headerToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookieToken), []byte(headerToken)) == 1
+}
@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestCSRFToken(t *testing.T) {
+	token, err := NewCSRFToken()
+	assert.Nil(t, err)
+
+	otherToken, err := NewCSRFToken()
+	assert.Nil(t, err)
+	assert.NotEqual(t, token, otherToken)
+
+	t.Run("should match the same token", func(t *testing.T) {
+		assert.True(t, CheckCSRFToken(token, token))
+	})
+
+	t.Run("should not match another token", func(t *testing.T) {
+		assert.False(t, CheckCSRFToken(token, otherToken))
+	})
+
+	t.Run("should not match missing tokens", func(t *testing.T) {
+		assert.False(t, CheckCSRFToken(token, ""))
+		assert.False(t, CheckCSRFToken("", ""))
+	})
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+)
+
+// the token types of rfc 7662 and 7009, callers may hint which one they are
+// sending so it is tried first. api keys are told apart by their prefix
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+	TokenTypeHintAPIKey       = "api_key"
+)
+
+var (
+	ErrInvalidClient = common.NewErr("invalid client", common.ErrCodeInvalidAuth)
+)
+
+// Introspection describes one of our tokens to the services that receive it,
+// shaped like the response of rfc 7662. Inactive tokens say nothing else about themselves
+type Introspection struct {
+	Active    bool        `json:"active"`
+	TokenType string      `json:"token_type,omitempty"`
+	Subject   string      `json:"sub,omitempty"`
+	Username  string      `json:"username,omitempty"`
+	Scope     string      `json:"scope,omitempty"`
+	Issuer    string      `json:"iss,omitempty"`
+	IssuedAt  int64       `json:"iat,omitempty"`
+	ExpiresAt int64       `json:"exp,omitempty"`
+	SessionID string      `json:"sid,omitempty"`
+	Actor     *actorClaim `json:"act,omitempty"`
+}
+
+// NewSessionIntrospection describes an active access or refresh token of the user's session
+func NewSessionIntrospection(tokenType string, token AccessToken, user User) Introspection {
+	var actor *actorClaim
+	if token.Impersonating() {
+		actor = &actorClaim{token.Actor.Hex()}
+	}
+	return Introspection{
+		Active:    true,
+		TokenType: tokenType,
+		Subject:   token.UserID.Hex(),
+		Username:  user.Name,
+		Issuer:    token.Issuer,
+		IssuedAt:  token.IssuedAt.Unix(),
+		ExpiresAt: token.ExpiresAt.Unix(),
+		SessionID: token.SessionID.Hex(),
+		Actor:     actor,
+	}
+}
+
+// NewAPIKeyIntrospection describes an active api key, keys without
+// an expiry or scopes leave them out of their introspection
+func NewAPIKeyIntrospection(apiKey APIKey, user User) Introspection {
+	introspection := Introspection{
+		Active:    true,
+		TokenType: TokenTypeHintAPIKey,
+		Subject:   apiKey.UserID.Hex(),
+		Username:  user.Name,
+		Scope:     strings.Join(apiKey.Scopes, " "),
+		IssuedAt:  apiKey.CreatedAt.Unix(),
+	}
+	if apiKey.ExpiresAt != nil {
+		introspection.ExpiresAt = apiKey.ExpiresAt.Unix()
+	}
+	return introspection
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIntrospection(t *testing.T) {
+	now := time.Now()
+	user := User{ID: primitive.NewObjectID(), Name: "name"}
+
+	t.Run("should describe a session token", func(t *testing.T) {
+		token := AccessToken{
+			SessionID: primitive.NewObjectID(),
+			UserID:    user.ID,
+			Issuer:    "http://localhost",
+			IssuedAt:  now,
+			ExpiresAt: now.Add(time.Minute),
+		}
+
+		introspection := NewSessionIntrospection(TokenTypeHintAccessToken, token, user)
+		assert.Equal(t, introspection, Introspection{
+			Active:    true,
+			TokenType: TokenTypeHintAccessToken,
+			Subject:   user.ID.Hex(),
+			Username:  user.Name,
+			Issuer:    "http://localhost",
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(time.Minute).Unix(),
+			SessionID: token.SessionID.Hex(),
+		})
+
+		token.Actor = primitive.NewObjectID()
+		introspection = NewSessionIntrospection(TokenTypeHintAccessToken, token, user)
+		assert.Equal(t, introspection.Actor, &actorClaim{token.Actor.Hex()})
+	})
+
+	t.Run("should describe an api key", func(t *testing.T) {
+		apiKey := APIKey{ID: primitive.NewObjectID(), UserID: user.ID, Scopes: []string{APIKeyScopeUserRead}, CreatedAt: now}
+
+		introspection := NewAPIKeyIntrospection(apiKey, user)
+		assert.Equal(t, introspection.Scope, APIKeyScopeUserRead)
+		assert.Equal(t, introspection.ExpiresAt, int64(0))
+
+		expiresAt := now.Add(time.Hour)
+		apiKey.ExpiresAt = &expiresAt
+		assert.Equal(t, NewAPIKeyIntrospection(apiKey, user).ExpiresAt, expiresAt.Unix())
+	})
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	InviteCodeLength = 24
+)
+
+var (
+	// invites can make admins but never another "me" user
+	InviteUserTypes = []string{UserTypeGuest, UserTypeNormal, UserTypeAdmin}
+
+	ErrInvalidInvite = common.NewErr("invalid invite code", common.ErrCodeInsufficientAuth)
+)
+
+// Invite lets one person register while registration is invite only,
+// the user it makes gets the invite's type and remembers who invited them
+type Invite struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	HashedCode string             `bson:"hashed_code" json:"-"`
+	UserType   string             `bson:"user_type" json:"user_type,omitempty"`
+	CreatedBy  primitive.ObjectID `bson:"created_by" json:"created_by"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt  time.Time          `bson:"expires_at" json:"expires_at"`
+	UsedBy     primitive.ObjectID `bson:"used_by,omitempty" json:"used_by,omitempty"`
+	UsedAt     *time.Time         `bson:"used_at,omitempty" json:"used_at,omitempty"`
+}
+
+func (i *Invite) Validate() error {
+	if i.ID == primitive.NilObjectID {
+		i.ID = primitive.NewObjectID()
+	}
+	if i.CreatedBy == primitive.NilObjectID {
+		return errors.New("must have creator")
+	}
+	if i.HashedCode == "" {
+		return errors.New("must be hashed")
+	}
+	if !i.ExpiresAt.After(i.CreatedAt) {
+		return errors.New("must expire after it is created")
+	}
+	if !validInviteUserType(i.UserType) {
+		return errors.New("unknown user type: " + i.UserType)
+	}
+	return nil
+}
+
+func (i Invite) Used() bool {
+	return i.UsedAt != nil
+}
+
+type InviteCreate struct {
+	UserType string `json:"user_type"`
+}
+
+// NewInvite is only ever returned when the invite is created,
+// afterwards only the hash of its code is kept
+type NewInvite struct {
+	Invite
+	Code string `json:"code"`
+}
+
+func NewInviteCode() (string, error) {
+	code := make([]byte, InviteCodeLength)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(code), nil
+}
+
+func validInviteUserType(userType string) bool {
+	for _, t := range InviteUserTypes {
+		if t == userType {
+			return true
+		}
+	}
+	return false
+}
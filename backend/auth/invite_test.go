@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestInvite(t *testing.T) {
+	t.Run("should make distinct invite codes", func(t *testing.T) {
+		code1, err := NewInviteCode()
+		assert.Nil(t, err)
+		code2, err := NewInviteCode()
+		assert.Nil(t, err)
+
+		assert.True(t, code1 != code2)
+	})
+
+	t.Run("should not allow invites for me users", func(t *testing.T) {
+		now := time.Now()
+		for _, tc := range []struct {
+			userType string
+			valid    bool
+		}{
+			{UserTypeGuest, true},
+			{UserTypeNormal, true},
+			{UserTypeAdmin, true},
+			{UserTypeMe, false},
+			{"unknown", false},
+		} {
+			invite := Invite{
+				HashedCode: "hashed",
+				UserType:   tc.userType,
+				CreatedBy:  primitive.NewObjectID(),
+				CreatedAt:  now,
+				ExpiresAt:  now.Add(time.Hour),
+			}
+			assert.Equal(t, invite.Validate() == nil, tc.valid)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	headerKeyID = "kid"
+)
+
+// SigningKey is a key in the keyring, hmac keys use
+// the same secret to sign and verify so they are never published
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+func NewHMACKey(id string, secret []byte) SigningKey {
+	return SigningKey{id, jwt.SigningMethodHS256, secret, secret}
+}
+
+// ParseSigningKey reads a pem encoded private key, or the raw secret for HS256
+func ParseSigningKey(id, algorithm string, data []byte) (SigningKey, error) {
+	switch algorithm {
+	case common.SigningAlgorithmHS256:
+		return NewHMACKey(id, data), nil
+	case common.SigningAlgorithmRS256:
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		return SigningKey{id, jwt.SigningMethodRS256, privateKey, &privateKey.PublicKey}, nil
+	case common.SigningAlgorithmEdDSA:
+		privateKey, err := jwt.ParseEdPrivateKeyFromPEM(data)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		edPrivateKey, ok := privateKey.(ed25519.PrivateKey)
+		if !ok {
+			return SigningKey{}, errors.New("key is not an ed25519 private key")
+		}
+		return SigningKey{id, jwt.SigningMethodEdDSA, edPrivateKey, edPrivateKey.Public()}, nil
+	}
+	return SigningKey{}, fmt.Errorf("%s is an unsupported signing algorithm", algorithm)
+}
+
+// Keyring signs tokens with a single key and verifies them with any of its keys,
+// tokens name their key in the kid header and those without one use the unnamed key
+type Keyring struct {
+	signingKey SigningKey
+	keys       []SigningKey
+}
+
+func NewKeyring(signingKeyID string, keys ...SigningKey) (*Keyring, error) {
+	keyring := Keyring{keys: keys}
+
+	var found bool
+	for i, key := range keys {
+		for _, other := range keys[:i] {
+			if other.ID == key.ID {
+				return nil, fmt.Errorf("signing key %q is in the keyring more than once", key.ID)
+			}
+		}
+		if key.ID == signingKeyID {
+			keyring.signingKey = key
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("signing key %q is not in the keyring", signingKeyID)
+	}
+	return &keyring, nil
+}
+
+// NewHMACKeyring makes a keyring that signs and verifies every token with the one secret
+func NewHMACKeyring(secret []byte) *Keyring {
+	key := NewHMACKey("", secret)
+	return &Keyring{key, []SigningKey{key}}
+}
+
+// LoadKeyring reads the configured signing keys, the jwt secret stays in the
+// keyring as the unnamed key so tokens issued before the keys were added still verify
+func LoadKeyring(config common.AuthConfig) (*Keyring, error) {
+	var keys []SigningKey
+	if config.JWTSecret != "" || len(config.SigningKeys) == 0 {
+		keys = append(keys, NewHMACKey("", []byte(config.JWTSecret)))
+	}
+
+	for _, keyConfig := range config.SigningKeys {
+		data, err := ioutil.ReadFile(keyConfig.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key %q: %s", keyConfig.ID, err)
+		}
+
+		key, err := ParseSigningKey(keyConfig.ID, keyConfig.Algorithm, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signing key %q: %s", keyConfig.ID, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return NewKeyring(config.SigningKeyID, keys...)
+}
+
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.signingKey.Method, claims)
+	if k.signingKey.ID != "" {
+		token.Header[headerKeyID] = k.signingKey.ID
+	}
+	return token.SignedString(k.signingKey.signKey)
+}
+
+func (k *Keyring) KeyFunc(token *jwt.Token) (interface{}, error) {
+	keyID, _ := token.Header[headerKeyID].(string)
+	for _, key := range k.keys {
+		if key.ID != keyID {
+			continue
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("%v is an unsupported signing method", token.Header["alg"])
+		}
+		return key.verifyKey, nil
+	}
+	return nil, fmt.Errorf("%q is an unknown signing key", keyID)
+}
+
+// JWKS lists the public keys so other services can verify our tokens
+func (k *Keyring) JWKS() JWKS {
+	jwks := JWKS{[]JWK{}}
+	for _, key := range k.keys {
+		switch verifyKey := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				KeyID:     key.ID,
+				KeyType:   "RSA",
+				Algorithm: key.Method.Alg(),
+				Use:       "sig",
+				N:         base64.RawURLEncoding.EncodeToString(verifyKey.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(verifyKey.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				KeyID:     key.ID,
+				KeyType:   "OKP",
+				Algorithm: key.Method.Alg(),
+				Use:       "sig",
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(verifyKey),
+			})
+		}
+	}
+	return jwks
+}
+
+// JWKS is a json web key set (RFC 7517)
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type JWK struct {
+	KeyID     string `json:"kid"`
+	KeyType   string `json:"kty"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+
+	// rsa keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func TestKeyring(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	assert.Nil(t, err)
+	edPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER})
+
+	rsaSigningKey, err := ParseSigningKey("rsa-1", common.SigningAlgorithmRS256, rsaPEM)
+	assert.Nil(t, err)
+	edSigningKey, err := ParseSigningKey("ed-1", common.SigningAlgorithmEdDSA, edPEM)
+	assert.Nil(t, err)
+	hmacSigningKey := NewHMACKey("", []byte("secret"))
+
+	parse := func(keyring *Keyring, token string) (*jwt.Token, error) {
+		return jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, keyring.KeyFunc)
+	}
+
+	t.Run("should fail to make a keyring without its signing key", func(t *testing.T) {
+		_, err := NewKeyring("rsa-2", rsaSigningKey, edSigningKey)
+		assert.NotNil(t, err)
+
+		_, err = NewKeyring("rsa-1", rsaSigningKey, rsaSigningKey)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("should fail to parse a key for the wrong algorithm", func(t *testing.T) {
+		_, err := ParseSigningKey("rsa-1", common.SigningAlgorithmEdDSA, rsaPEM)
+		assert.NotNil(t, err)
+	})
+
+	for _, tc := range []struct {
+		description string
+		signingKey  SigningKey
+	}{
+		{"rsa", rsaSigningKey},
+		{"ed25519", edSigningKey},
+	} {
+		t.Run("should sign and verify tokens with an "+tc.description+" key", func(t *testing.T) {
+			keyring, err := NewKeyring(tc.signingKey.ID, hmacSigningKey, rsaSigningKey, edSigningKey)
+			assert.Nil(t, err)
+
+			signed, err := keyring.Sign(jwt.RegisteredClaims{Subject: "user"})
+			assert.Nil(t, err)
+
+			token, err := parse(keyring, signed)
+			assert.Nil(t, err)
+			assert.Equal(t, token.Header["kid"], tc.signingKey.ID)
+			assert.Equal(t, token.Method.Alg(), tc.signingKey.Method.Alg())
+		})
+	}
+
+	t.Run("should verify tokens signed by a previous signing key after rotating", func(t *testing.T) {
+		oldKeyring, err := NewKeyring("", hmacSigningKey)
+		assert.Nil(t, err)
+
+		signed, err := oldKeyring.Sign(jwt.RegisteredClaims{Subject: "user"})
+		assert.Nil(t, err)
+
+		newKeyring, err := NewKeyring("rsa-1", hmacSigningKey, rsaSigningKey)
+		assert.Nil(t, err)
+
+		_, err = parse(newKeyring, signed)
+		assert.Nil(t, err)
+
+		t.Run("but not once the key is dropped", func(t *testing.T) {
+			droppedKeyring, err := NewKeyring("rsa-1", rsaSigningKey)
+			assert.Nil(t, err)
+
+			_, err = parse(droppedKeyring, signed)
+			assert.NotNil(t, err)
+		})
+	})
+
+	t.Run("should not verify a token signed with another algorithm than its key", func(t *testing.T) {
+		keyring, err := NewKeyring("rsa-1", rsaSigningKey)
+		assert.Nil(t, err)
+
+		// an hmac token keyed with the public key must not pass as the rsa key's token
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "user"})
+		token.Header["kid"] = "rsa-1"
+		signed, err := token.SignedString(x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey))
+		assert.Nil(t, err)
+
+		_, err = parse(keyring, signed)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("should only publish public keys", func(t *testing.T) {
+		keyring, err := NewKeyring("", hmacSigningKey, rsaSigningKey, edSigningKey)
+		assert.Nil(t, err)
+
+		jwks := keyring.JWKS()
+		assert.Equal(t, len(jwks.Keys), 2)
+
+		assert.Equal(t, jwks.Keys[0].KeyID, "rsa-1")
+		assert.Equal(t, jwks.Keys[0].KeyType, "RSA")
+		assert.Equal(t, jwks.Keys[0].Algorithm, "RS256")
+		assert.Equal(t, jwks.Keys[0].E, "AQAB")
+
+		assert.Equal(t, jwks.Keys[1].KeyID, "ed-1")
+		assert.Equal(t, jwks.Keys[1].KeyType, "OKP")
+		assert.Equal(t, jwks.Keys[1].Algorithm, "EdDSA")
+		assert.Equal(t, jwks.Keys[1].Curve, "Ed25519")
+	})
+}
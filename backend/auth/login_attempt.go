@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"math"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+)
+
+// LoginAttempts counts the failed logins for a username or client ip,
+// they are forgotten once enough time passes without another failure
+type LoginAttempts struct {
+	Key           string    `bson:"_id"`
+	Failures      int       `bson:"failures"`
+	LastFailureAt time.Time `bson:"last_failure_at"`
+	ExpiresAt     time.Time `bson:"expires_at"`
+}
+
+// LoginThrottle decides when another login may be attempted, each failure doubles
+// the wait after the last until the failures reach the lockout threshold
+type LoginThrottle struct {
+	Backoff     time.Duration
+	MaxAttempts int
+	Lockout     time.Duration
+}
+
+func (t LoginThrottle) RetryAt(attempts LoginAttempts) time.Time {
+	if attempts.Failures == 0 {
+		return time.Time{}
+	}
+	if t.MaxAttempts > 0 && attempts.Failures >= t.MaxAttempts {
+		return attempts.LastFailureAt.Add(t.Lockout)
+	}
+	if t.Backoff == 0 {
+		return time.Time{}
+	}
+
+	delay := time.Duration(math.Min(
+		float64(t.Backoff)*math.Pow(2, float64(attempts.Failures-1)),
+		float64(t.Lockout),
+	))
+	return attempts.LastFailureAt.Add(delay)
+}
+
+// ErrTooManyLoginAttempts tells the client how long to wait before trying again
+func ErrTooManyLoginAttempts(retryAfter time.Duration) error {
+	return common.NewErr(
+		"too many failed login attempts",
+		common.ErrCodeTooManyRequests,
+		common.ErrDatum{common.ErrDataRetryAfterSecs, int(math.Ceil(retryAfter.Seconds()))},
+	)
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	lastFailureAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	throttle := LoginThrottle{Backoff: time.Second, MaxAttempts: 5, Lockout: 15 * time.Minute}
+
+	for _, tc := range []struct {
+		failures int
+		wait     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 15 * time.Minute},
+		{10, 15 * time.Minute},
+	} {
+		t.Run("should wait "+tc.wait.String()+" after "+strconv.Itoa(tc.failures)+" failures", func(t *testing.T) {
+			retryAt := throttle.RetryAt(LoginAttempts{Failures: tc.failures, LastFailureAt: lastFailureAt})
+			if tc.wait == 0 {
+				assert.True(t, retryAt.IsZero())
+				return
+			}
+			assert.Equal(t, retryAt, lastFailureAt.Add(tc.wait))
+		})
+	}
+
+	t.Run("should never back off for longer than the lockout", func(t *testing.T) {
+		throttle := LoginThrottle{Backoff: time.Minute, MaxAttempts: 100, Lockout: 15 * time.Minute}
+
+		retryAt := throttle.RetryAt(LoginAttempts{Failures: 50, LastFailureAt: lastFailureAt})
+		assert.Equal(t, retryAt, lastFailureAt.Add(15*time.Minute))
+	})
+
+	t.Run("should only lock out without a backoff", func(t *testing.T) {
+		throttle := LoginThrottle{MaxAttempts: 3, Lockout: time.Minute}
+
+		assert.True(t, throttle.RetryAt(LoginAttempts{Failures: 2, LastFailureAt: lastFailureAt}).IsZero())
+		assert.Equal(t, throttle.RetryAt(LoginAttempts{Failures: 3, LastFailureAt: lastFailureAt}), lastFailureAt.Add(time.Minute))
+	})
+}
@@ -0,0 +1,411 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+	// oauthRandomLength is the number of random bytes in each state, nonce and code verifier
+	oauthRandomLength = 32
+)
+
+var (
+	oidcSigningMethods = []string{
+		jwt.SigningMethodRS256.Alg(),
+		jwt.SigningMethodEdDSA.Alg(),
+	}
+)
+
+// OIDCClaims are the id token claims used to find or create the provider's user
+type OIDCClaims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// OIDCProvider runs the authorization code flow with PKCE against an openid connect
+// provider, its configuration is discovered on first use and its keys are cached
+// until a token names one that is not known
+type OIDCProvider struct {
+	config      common.OIDCProviderConfig
+	redirectURL string
+	leeway      time.Duration
+	client      *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]interface{}
+}
+
+func NewOIDCProvider(config common.OIDCProviderConfig, redirectURL string, leeway time.Duration, client *http.Client) *OIDCProvider {
+	if client == nil {
+		client = &http.Client{Timeout: common.TimeoutServerOp}
+	}
+	return &OIDCProvider{
+		config:      config,
+		redirectURL: redirectURL,
+		leeway:      leeway,
+		client:      client,
+	}
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.config.Name
+}
+
+// AuthCodeURL is where the user is sent to login with the provider
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state OAuthState) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("provider has an invalid authorization endpoint: %s", err)
+	}
+
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.redirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state.State)
+	query.Set("nonce", state.Nonce)
+	query.Set("code_challenge", PKCEChallenge(state.Verifier))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	return authURL.String(), nil
+}
+
+// Exchange redeems the authorization code and verifies the id token that comes back
+func (p *OIDCProvider) Exchange(ctx context.Context, state OAuthState, code string) (OIDCClaims, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return OIDCClaims{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("client_id", p.config.ClientID)
+	form.Set("code_verifier", state.Verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return OIDCClaims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return OIDCClaims{}, fmt.Errorf("failed to exchange code: %s", err)
+	}
+	defer res.Body.Close()
+
+	var tokenRes oidcTokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&tokenRes); err != nil {
+		return OIDCClaims{}, fmt.Errorf("failed to read token response (%s): %s", res.Status, err)
+	}
+	if tokenRes.Error != "" {
+		return OIDCClaims{}, fmt.Errorf("failed to exchange code: %s %s", tokenRes.Error, tokenRes.ErrorDescription)
+	}
+	if res.StatusCode != http.StatusOK {
+		return OIDCClaims{}, fmt.Errorf("failed to exchange code: %s", res.Status)
+	}
+	if tokenRes.IDToken == "" {
+		return OIDCClaims{}, errors.New("provider did not return an id token")
+	}
+
+	return p.verifyIDToken(ctx, discovery.Issuer, tokenRes.IDToken, state.Nonce)
+}
+
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, issuer, idToken, nonce string) (OIDCClaims, error) {
+	var claims idTokenClaims
+	parser := jwt.NewParser(jwt.WithValidMethods(oidcSigningMethods), jwt.WithoutClaimsValidation())
+	if _, err := parser.ParseWithClaims(idToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header[headerKeyID].(string)
+		return p.key(ctx, keyID)
+	}); err != nil {
+		return OIDCClaims{}, fmt.Errorf("id token is invalid: %s", err)
+	}
+
+	now := time.Now()
+	switch {
+	case claims.ExpiresAt == nil || now.After(claims.ExpiresAt.Add(p.leeway)):
+		return OIDCClaims{}, errors.New("id token is expired")
+	case claims.IssuedAt != nil && now.Add(p.leeway).Before(claims.IssuedAt.Time):
+		return OIDCClaims{}, errors.New("id token is issued in the future")
+	case claims.Issuer != issuer:
+		return OIDCClaims{}, errors.New("id token has wrong issuer")
+	case !claims.VerifyAudience(p.config.ClientID, true):
+		return OIDCClaims{}, errors.New("id token has wrong audience")
+	case claims.Nonce == "" || claims.Nonce != nonce:
+		return OIDCClaims{}, errors.New("id token has wrong nonce")
+	case claims.Subject == "":
+		return OIDCClaims{}, errors.New("id token has no subject")
+	}
+
+	return OIDCClaims{
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return *p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.config.IssuerURL, "/")+oidcDiscoveryPath, &discovery); err != nil {
+		return oidcDiscovery{}, fmt.Errorf("failed to discover provider: %s", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(p.config.IssuerURL, "/") {
+		return oidcDiscovery{}, fmt.Errorf("provider issuer %q does not match %q", discovery.Issuer, p.config.IssuerURL)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return oidcDiscovery{}, errors.New("provider is missing endpoints")
+	}
+
+	p.discovery = &discovery
+	return discovery, nil
+}
+
+// key finds the provider's verification key, the keys are fetched again
+// when the id is not known in case the provider has rotated them
+func (p *OIDCProvider) key(ctx context.Context, keyID string) (interface{}, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+
+	var jwks JWKS
+	if err := p.getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch provider keys: %s", err)
+	}
+
+	keys := make(map[string]interface{}, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	p.keys = keys
+
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%q is an unknown signing key", keyID)
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// PublicKey reads the rsa or ed25519 key the jwk describes
+func (k JWK) PublicKey() (interface{}, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("%s is an unsupported curve", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("ed25519 key has wrong size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("%s is an unsupported key type", k.KeyType)
+}
+
+// PKCEChallenge derives the S256 code challenge sent ahead of the code verifier (RFC 7636)
+func PKCEChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// OAuthState is kept by the client while the user logs in with the provider,
+// its state is handed back with the callback and its nonce comes back in the id token
+type OAuthState struct {
+	Provider  string
+	State     string
+	Nonce     string
+	Verifier  string
+	Issuer    string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+type oauthStateClaims struct {
+	TokenClaims
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"code_verifier"`
+}
+
+func NewOAuthState(provider, issuer string, issuedAt time.Time, ttl time.Duration) (OAuthState, error) {
+	values := make([]string, 3)
+	for i := range values {
+		value := make([]byte, oauthRandomLength)
+		if _, err := rand.Read(value); err != nil {
+			return OAuthState{}, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(value)
+	}
+
+	return OAuthState{
+		Provider:  provider,
+		State:     values[0],
+		Nonce:     values[1],
+		Verifier:  values[2],
+		Issuer:    issuer,
+		IssuedAt:  issuedAt,
+		ExpiresAt: issuedAt.Add(ttl),
+	}, nil
+}
+
+func (t *OAuthState) Valid() error {
+	return nil
+}
+
+func (t *OAuthState) Validate() error {
+	if t.Provider == "" {
+		return errors.New("token needs provider")
+	}
+	if t.State == "" || t.Nonce == "" || t.Verifier == "" {
+		return errors.New("token needs state")
+	}
+	return nil
+}
+
+func (t OAuthState) ClaimType() string {
+	return ClaimTypeOAuthState
+}
+
+func (t OAuthState) ClaimAudience() string {
+	return AudienceOAuthState
+}
+
+func (t OAuthState) MarshalJSON() ([]byte, error) {
+	claims := newTokenClaims(ClaimTypeOAuthState, t.Issuer, []string{AudienceOAuthState}, t.IssuedAt, t.ExpiresAt)
+	return json.Marshal(oauthStateClaims{claims, t.Provider, t.State, t.Nonce, t.Verifier})
+}
+
+func (t *OAuthState) UnmarshalJSON(data []byte) error {
+	var claims oauthStateClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+
+	t.Provider = claims.Provider
+	t.State = claims.State
+	t.Nonce = claims.Nonce
+	t.Verifier = claims.Verifier
+	t.Issuer = claims.Issuer
+	if claims.IssuedAt != nil {
+		t.IssuedAt = claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		t.ExpiresAt = claims.ExpiresAt.Time
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+	u "github.com/shake-on-it/app-tmpl/backend/common/test/utils"
+)
+
+func TestPKCEChallenge(t *testing.T) {
+	// from RFC 7636 appendix B
+	assert.Equal(t, PKCEChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"), "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM")
+}
+
+func TestOIDCProvider(t *testing.T) {
+	fakeProvider := u.NewOIDCProvider(t)
+	defer fakeProvider.Close()
+
+	fakeProvider.SetUser(u.OIDCUser{
+		Subject:           "12345",
+		Email:             "oidc@domain.com",
+		EmailVerified:     true,
+		Name:              "Oidc User",
+		PreferredUsername: "oidc",
+	})
+
+	provider := NewOIDCProvider(common.OIDCProviderConfig{
+		Name:         "fake",
+		IssuerURL:    fakeProvider.URL,
+		ClientID:     u.OIDCClientID,
+		ClientSecret: u.OIDCClientSecret,
+		Scopes:       []string{"openid", "email", "profile"},
+	}, "http://localhost/callback", 0, nil)
+
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	authorize := func(t *testing.T, state OAuthState) url.Values {
+		t.Helper()
+
+		authURL, err := provider.AuthCodeURL(context.Background(), state)
+		assert.Nil(t, err)
+
+		res, err := client.Get(authURL)
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusFound)
+
+		callbackURL, err := url.Parse(res.Header.Get("Location"))
+		assert.Nil(t, err)
+		return callbackURL.Query()
+	}
+
+	newState := func(t *testing.T) OAuthState {
+		t.Helper()
+
+		state, err := NewOAuthState("fake", "issuer", time.Now(), time.Minute)
+		assert.Nil(t, err)
+		return state
+	}
+
+	t.Run("should login with the provider", func(t *testing.T) {
+		state := newState(t)
+
+		callback := authorize(t, state)
+		assert.Equal(t, callback.Get("state"), state.State)
+
+		claims, err := provider.Exchange(context.Background(), state, callback.Get("code"))
+		assert.Nil(t, err)
+		assert.Equal(t, claims, OIDCClaims{"12345", "oidc@domain.com", true, "Oidc User", "oidc"})
+
+		t.Run("but not redeem the code twice", func(t *testing.T) {
+			_, err := provider.Exchange(context.Background(), state, callback.Get("code"))
+			assert.NotNil(t, err)
+		})
+	})
+
+	t.Run("should fail to exchange a code without its verifier", func(t *testing.T) {
+		state := newState(t)
+		callback := authorize(t, state)
+
+		state.Verifier = newState(t).Verifier
+
+		_, err := provider.Exchange(context.Background(), state, callback.Get("code"))
+		assert.NotNil(t, err)
+	})
+
+	t.Run("should fail to accept an id token for another nonce", func(t *testing.T) {
+		state := newState(t)
+		callback := authorize(t, state)
+
+		state.Nonce = newState(t).Nonce
+
+		_, err := provider.Exchange(context.Background(), state, callback.Get("code"))
+		assert.Equal(t, err.Error(), "id token has wrong nonce")
+	})
+}
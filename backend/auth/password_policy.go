@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+)
+
+const (
+	PasswordRuleMinLength        = "min_length"
+	PasswordRuleCharacterClasses = "character_classes"
+	PasswordRuleUserInfo         = "user_info"
+	PasswordRuleBreached         = "breached"
+
+	// ErrDataPasswordViolations lists each rule a password failed
+	ErrDataPasswordViolations = "password_violations"
+
+	// breached passwords are bucketed by the first characters of their hash,
+	// the same split the k-anonymity range api of pwned passwords uses
+	breachedPrefixLength = 5
+
+	// parts of the user's name and email shorter than this are too common to rule out
+	minUserInfoLength = 3
+)
+
+// PasswordViolation is a rule the password failed, min is what the rule asks for when it counts something
+type PasswordViolation struct {
+	Rule string `json:"rule"`
+	Min  int    `json:"min,omitempty"`
+}
+
+// PasswordPolicy checks new passwords, the breached list is optional
+type PasswordPolicy struct {
+	MinLength           int
+	MinCharacterClasses int
+	AllowUserInfo       bool
+	Breached            *BreachedPasswords
+}
+
+func NewPasswordPolicy(config common.PasswordPolicyConfig, breached *BreachedPasswords) PasswordPolicy {
+	return PasswordPolicy{config.MinLength, config.MinCharacterClasses, config.AllowUserInfo, breached}
+}
+
+// Check fails with every rule the password breaks so they can all be fixed at once
+func (p PasswordPolicy) Check(password, username, email string) error {
+	var violations []PasswordViolation
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordViolation{PasswordRuleMinLength, p.MinLength})
+	}
+	if passwordCharacterClasses(password) < p.MinCharacterClasses {
+		violations = append(violations, PasswordViolation{PasswordRuleCharacterClasses, p.MinCharacterClasses})
+	}
+	if !p.AllowUserInfo && containsUserInfo(password, username, email) {
+		violations = append(violations, PasswordViolation{PasswordRuleUserInfo, 0})
+	}
+	if p.Breached != nil && p.Breached.Contains(password) {
+		violations = append(violations, PasswordViolation{PasswordRuleBreached, 0})
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return common.NewErr(
+		"password does not meet the password policy",
+		common.ErrCodeBadRequest,
+		common.ErrDatum{ErrDataPasswordViolations, violations},
+	)
+}
+
+func passwordCharacterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// containsUserInfo tells whether the password contains the user's name,
+// their email or the part of their email before the @, regardless of case
+func containsUserInfo(password, username, email string) bool {
+	password = strings.ToLower(password)
+
+	userInfo := []string{username, email}
+	if i := strings.LastIndex(email, "@"); i > 0 {
+		userInfo = append(userInfo, email[:i])
+	}
+
+	for _, info := range userInfo {
+		info = strings.ToLower(strings.TrimSpace(info))
+		if len(info) >= minUserInfoLength && strings.Contains(password, info) {
+			return true
+		}
+	}
+	return false
+}
+
+// BreachedPasswords is a list of known breached passwords kept only as their sha-1 hashes,
+// bucketed by hash prefix with each bucket's suffixes sorted for searching
+type BreachedPasswords struct {
+	buckets map[string][]string
+	size    int
+}
+
+// LoadBreachedPasswords reads the configured breached list, there is no list when no path is set
+func LoadBreachedPasswords(config common.PasswordPolicyConfig) (*BreachedPasswords, error) {
+	if config.BreachedListPath == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(config.BreachedListPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password list: %s", err)
+	}
+	defer file.Close()
+
+	breached, err := ReadBreachedPasswords(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read breached password list: %s", err)
+	}
+	return breached, nil
+}
+
+// ReadBreachedPasswords reads a hash on each line, anything after a colon is ignored
+func ReadBreachedPasswords(r io.Reader) (*BreachedPasswords, error) {
+	breached := BreachedPasswords{buckets: map[string][]string{}}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		hash := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(hash, ':'); i >= 0 {
+			hash = hash[:i]
+		}
+		if hash == "" {
+			continue
+		}
+
+		hash = strings.ToUpper(hash)
+		if len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("line %d is not a sha-1 hash", line)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("line %d is not a sha-1 hash", line)
+		}
+
+		prefix := hash[:breachedPrefixLength]
+		breached.buckets[prefix] = append(breached.buckets[prefix], hash[breachedPrefixLength:])
+		breached.size++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, suffixes := range breached.buckets {
+		sort.Strings(suffixes)
+	}
+	return &breached, nil
+}
+
+func (b *BreachedPasswords) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes := b.buckets[hash[:breachedPrefixLength]]
+	suffix := hash[breachedPrefixLength:]
+	i := sort.SearchStrings(suffixes, suffix)
+	return i < len(suffixes) && suffixes[i] == suffix
+}
+
+// Len is how many breached passwords are in the list
+func (b *BreachedPasswords) Len() int {
+	return b.size
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	breachedHash := sha1.Sum([]byte("Tr0ub4dor&3"))
+	breached, err := ReadBreachedPasswords(strings.NewReader(strings.Join([]string{
+		strings.ToUpper(hex.EncodeToString(breachedHash[:])) + ":42",
+		"",
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3",
+	}, "\n")))
+	assert.Nil(t, err)
+	assert.Equal(t, breached.Len(), 2)
+
+	policy := PasswordPolicy{MinLength: 8, MinCharacterClasses: 3, Breached: breached}
+
+	for _, tc := range []struct {
+		password   string
+		violations []PasswordViolation
+	}{
+		{"c0rrect-Horse", nil},
+		{"sh0rT!", []PasswordViolation{{PasswordRuleMinLength, 8}}},
+		{"lowercaseonly", []PasswordViolation{{PasswordRuleCharacterClasses, 3}}},
+		{"my-Username-1", []PasswordViolation{{PasswordRuleUserInfo, 0}}},
+		{"Mail.Person9", []PasswordViolation{{PasswordRuleUserInfo, 0}}},
+		{"Tr0ub4dor&3", []PasswordViolation{{PasswordRuleBreached, 0}}},
+		{"user", []PasswordViolation{
+			{PasswordRuleMinLength, 8},
+			{PasswordRuleCharacterClasses, 3},
+			{PasswordRuleUserInfo, 0},
+		}},
+	} {
+		t.Run("should check password "+tc.password, func(t *testing.T) {
+			err := policy.Check(tc.password, "user", "mail.person@domain.com")
+			if tc.violations == nil {
+				assert.Nil(t, err)
+				return
+			}
+			assert.Equal(t, err, common.NewErr("password does not meet the password policy", common.ErrCodeBadRequest))
+			assert.Equal(t, err.(common.ErrCodeProvider).Code(), common.ErrCodeBadRequest)
+			assert.Equal(t, err.(common.ErrDataProvider).Data()[ErrDataPasswordViolations], tc.violations)
+		})
+	}
+
+	t.Run("should allow user info when configured to", func(t *testing.T) {
+		policy := PasswordPolicy{AllowUserInfo: true}
+		assert.Nil(t, policy.Check("username", "username", "username@domain.com"))
+	})
+
+	t.Run("should count each character class", func(t *testing.T) {
+		assert.Equal(t, passwordCharacterClasses(""), 0)
+		assert.Equal(t, passwordCharacterClasses("aaa"), 1)
+		assert.Equal(t, passwordCharacterClasses("aA1"), 3)
+		assert.Equal(t, passwordCharacterClasses("aA1 "), 4)
+		assert.Equal(t, passwordCharacterClasses("ßÄ٣"), 3)
+	})
+
+	t.Run("should find breached passwords by their hash", func(t *testing.T) {
+		assert.True(t, breached.Contains("password"))
+		assert.True(t, breached.Contains("Tr0ub4dor&3"))
+		assert.False(t, breached.Contains("Password"))
+	})
+
+	t.Run("should not read lines that are not hashes", func(t *testing.T) {
+		_, err := ReadBreachedPasswords(strings.NewReader("5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8\nnot a hash\n"))
+		assert.Equal(t, err.Error(), "line 2 is not a sha-1 hash")
+	})
+
+	t.Run("should not load a list without a path", func(t *testing.T) {
+		breached, err := LoadBreachedPasswords(common.PasswordPolicyConfig{})
+		assert.Nil(t, err)
+		assert.True(t, breached == nil)
+	})
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"net"
+)
+
+const (
+	// MaxKnownClients is how many ip ranges and user agents are remembered for each user
+	MaxKnownClients = 20
+
+	// user agents are cut short so clients cannot make us store whatever they like
+	maxUserAgentLength = 512
+)
+
+// SessionClient is the client a session was started or last refreshed from
+type SessionClient struct {
+	UserAgent string
+	IPAddress string
+}
+
+func NewSessionClient(userAgent, ipAddress string) SessionClient {
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return SessionClient{userAgent, ipAddress}
+}
+
+// IPRange groups the addresses a client is likely to move between,
+// the /24 of an ipv4 address or the /48 of an ipv6 address
+func IPRange(ipAddress string) string {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return ipAddress
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestSessionClient(t *testing.T) {
+	t.Run("should group addresses into ranges", func(t *testing.T) {
+		assert.Equal(t, IPRange("203.0.113.42"), "203.0.113.0/24")
+		assert.Equal(t, IPRange("::ffff:203.0.113.42"), "203.0.113.0/24")
+		assert.Equal(t, IPRange("2001:db8:abcd:12::1"), "2001:db8:abcd::/48")
+		assert.Equal(t, IPRange("not an ip"), "not an ip")
+		assert.Equal(t, IPRange(""), "")
+	})
+
+	t.Run("should cut long user agents short", func(t *testing.T) {
+		client := NewSessionClient(strings.Repeat("a", 1000), "203.0.113.42")
+		assert.Equal(t, len(client.UserAgent), 512)
+		assert.Equal(t, client.IPAddress, "203.0.113.42")
+	})
+
+	t.Run("should find the parts of a client the user does not know", func(t *testing.T) {
+		user := User{KnownIPRanges: []string{"203.0.113.0/24"}, KnownUserAgents: []string{"browser"}}
+
+		ipRange, userAgent := user.UnknownClient(SessionClient{"browser", "203.0.113.7"})
+		assert.Equal(t, ipRange, "")
+		assert.Equal(t, userAgent, "")
+
+		ipRange, userAgent = user.UnknownClient(SessionClient{"other browser", "198.51.100.7"})
+		assert.Equal(t, ipRange, "198.51.100.0/24")
+		assert.Equal(t, userAgent, "other browser")
+
+		ipRange, userAgent = user.UnknownClient(SessionClient{})
+		assert.Equal(t, ipRange, "")
+		assert.Equal(t, userAgent, "")
+	})
+}
@@ -16,23 +16,132 @@ const (
 	CookieAccessToken  = "access-token"
 	CookieRefreshToken = "refresh-token"
 	CookieUserToken    = "user-token"
+	CookieOAuthState   = "oauth-state"
+	CookieCSRFToken    = "csrf-token"
+
+	// CookieTOTPChallenge carries the challenge of an oauth login, which cannot be sent back in a body
+	CookieTOTPChallenge = "totp-challenge"
+
+	TokenTypeBearer = "Bearer"
+
+	AudienceAdminAPI      = "api/admin/v1"
+	AudienceOAuthState    = "oauth_state"
+	AudienceTOTPChallenge = "totp_challenge"
+	AudienceVerifyEmail   = "verify_email"
+
+	// the typ claim keeps one kind of token from being used as another
+	ClaimTypeAccess        = "access"
+	ClaimTypeRefresh       = "refresh"
+	ClaimTypeUser          = "user"
+	ClaimTypeVerifyEmail   = "verify_email"
+	ClaimTypeTOTPChallenge = "totp_challenge"
+	ClaimTypeOAuthState    = "oauth_state"
 )
 
 var (
-	ErrInvalidSession   = common.NewErr("invalid session", common.ErrCodeInvalidAuth)
-	ErrInvalidSignature = common.NewErr("invalid signature", common.ErrCodeInvalidAuth)
-	ErrMalformedCookie  = common.NewErr("cookie is malformed", common.ErrCodeBadRequest)
-	ErrMalformedToken   = common.NewErr("token is malformed", common.ErrCodeInvalidAuth)
-	ErrMustAuthenticate = common.NewErr("must authenticate", common.ErrCodeInvalidAuth)
+	ErrInvalidSession     = common.NewErr("invalid session", common.ErrCodeInvalidAuth)
+	ErrInvalidSignature   = common.NewErr("invalid signature", common.ErrCodeInvalidAuth)
+	ErrMalformedCookie    = common.NewErr("cookie is malformed", common.ErrCodeBadRequest)
+	ErrMalformedToken     = common.NewErr("token is malformed", common.ErrCodeInvalidAuth)
+	ErrMustAuthenticate   = common.NewErr("must authenticate", common.ErrCodeInvalidAuth)
+	ErrMustReauthenticate = common.NewErr("must login again to confirm", common.ErrCodeInsufficientAuth)
+	ErrSessionExpired     = common.NewErr("session has expired", common.ErrCodeInvalidAuth)
+	ErrSessionRevoked     = common.NewErr("session has been revoked", common.ErrCodeInvalidAuth)
+	ErrEmailNotVerified   = common.NewErr("must verify email", common.ErrCodeInsufficientAuth)
+	ErrInsufficientAccess = common.NewErr("insufficient access", common.ErrCodeInsufficientAuth)
+	ErrInvalidTOTPCode    = common.NewErr("invalid two-factor code", common.ErrCodeInvalidAuth)
+	ErrInvalidOAuthState  = common.NewErr("invalid oauth state", common.ErrCodeInvalidAuth)
+	ErrInvalidCSRFToken   = common.NewErr("invalid csrf token", common.ErrCodeInsufficientAuth)
+	ErrImpersonating      = common.NewErr("cannot do this while impersonating", common.ErrCodeInsufficientAuth)
+	ErrNotImpersonating   = common.NewErr("not impersonating", common.ErrCodeBadRequest)
+	ErrCannotImpersonate  = common.NewErr("cannot impersonate this user", common.ErrCodeInsufficientAuth)
 )
 
 func ErrInvalidToken(err error) error {
 	return common.WrapErr(fmt.Errorf("invalid token: %s", err), common.ErrCodeInvalidAuth)
 }
 
+// Token is implemented by each kind of token we issue so the
+// claims they share can be checked against what each kind expects
+type Token interface {
+	jwt.Claims
+	ClaimType() string
+	ClaimAudience() string
+}
+
+// TokenClaims are the claims shared by every token
+type TokenClaims struct {
+	jwt.RegisteredClaims
+	Type string `json:"typ"`
+}
+
+func newTokenClaims(typ, issuer string, audience []string, issuedAt, expiresAt time.Time) TokenClaims {
+	return TokenClaims{
+		jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Audience:  audience,
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			NotBefore: jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		typ,
+	}
+}
+
+// Verify checks the claims were issued by us for the token's kind,
+// leeway allows for clocks drifting between the servers checking the times
+func (c TokenClaims) Verify(token Token, issuer string, now time.Time, leeway time.Duration) error {
+	if c.ExpiresAt != nil && now.After(c.ExpiresAt.Add(leeway)) {
+		return errors.New("token is expired")
+	}
+	if c.NotBefore != nil && now.Add(leeway).Before(c.NotBefore.Time) {
+		return errors.New("token is not valid yet")
+	}
+	if c.IssuedAt != nil && now.Add(leeway).Before(c.IssuedAt.Time) {
+		return errors.New("token is issued in the future")
+	}
+	if c.Issuer != issuer {
+		return errors.New("token has wrong issuer")
+	}
+	if !c.VerifyAudience(token.ClaimAudience(), true) {
+		return errors.New("token has wrong audience")
+	}
+	if c.Type != token.ClaimType() {
+		return errors.New("token has wrong type")
+	}
+	return nil
+}
+
 type Tokens struct {
 	AccessToken  AccessToken
 	RefreshToken RefreshToken
+
+	// Challenge is set instead of the other tokens when the login needs a second factor
+	Challenge *TOTPChallenge
+}
+
+// TokenResponse carries a session's tokens to clients that cannot use cookies
+type TokenResponse struct {
+	AccessToken           string    `json:"access_token"`
+	AccessTokenExpiresAt  time.Time `json:"access_token_expires_at"`
+	RefreshToken          string    `json:"refresh_token"`
+	RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+	TokenType             string    `json:"token_type"`
+	User                  User      `json:"user"`
+}
+
+// Session describes one of the user's sessions so they can tell them apart,
+// the client is where the session was last refreshed from
+type Session struct {
+	ID             primitive.ObjectID  `json:"id"`
+	UserAgent      string              `json:"user_agent,omitempty"`
+	IPAddress      string              `json:"ip_address,omitempty"`
+	CreatedAt      time.Time           `json:"created_at"`
+	LastSeenAt     time.Time           `json:"last_seen_at"`
+	IssuedAt       time.Time           `json:"issued_at"`
+	ExpiresAt      time.Time           `json:"expires_at"`
+	Current        bool                `json:"current"`
+	ImpersonatedBy *primitive.ObjectID `json:"impersonated_by,omitempty"`
 }
 
 type AccessToken struct {
@@ -42,11 +151,32 @@ type AccessToken struct {
 	Audience  []string           `bson:"aud"`
 	IssuedAt  time.Time          `bson:"iat"`
 	ExpiresAt time.Time          `bson:"exp"`
+
+	// Actor is the admin impersonating the user, sessions they
+	// start keep it as the act claim for as long as they are refreshed
+	Actor primitive.ObjectID `bson:"act,omitempty"`
+}
+
+// accessClaims add the actor to the shared claims, shaped like the act claim of rfc 8693
+type accessClaims struct {
+	TokenClaims
+	Actor *actorClaim `json:"act,omitempty"`
+}
+
+type actorClaim struct {
+	Subject string `json:"sub"`
 }
 
 type RefreshToken struct {
 	AccessToken `bson:",inline"`
-	Consumed    bool `bson:"consumed"`
+	FamilyID    primitive.ObjectID `bson:"family_id"`
+	Consumed    bool               `bson:"consumed"`
+
+	// the session's metadata is only stored, it is never part of the token itself
+	UserAgent  string    `bson:"user_agent,omitempty"`
+	IPAddress  string    `bson:"ip_address,omitempty"`
+	CreatedAt  time.Time `bson:"created_at"`
+	LastSeenAt time.Time `bson:"last_seen_at"`
 }
 
 func (t *AccessToken) Valid() error {
@@ -60,25 +190,47 @@ func (t *AccessToken) Validate() error {
 	if t.UserID.IsZero() {
 		return errors.New("token needs user")
 	}
-	if time.Now().After(t.ExpiresAt) {
-		return errors.New("token is expired")
-	}
 	return nil
 }
 
+func (t AccessToken) Impersonating() bool {
+	return !t.Actor.IsZero()
+}
+
+func (t AccessToken) ClaimType() string {
+	return ClaimTypeAccess
+}
+
+func (t AccessToken) ClaimAudience() string {
+	return AudienceAdminAPI
+}
+
+func (t RefreshToken) ClaimType() string {
+	return ClaimTypeRefresh
+}
+
 func (t AccessToken) MarshalJSON() ([]byte, error) {
-	return json.Marshal(jwt.RegisteredClaims{
-		ID:        t.SessionID.Hex(),
-		Subject:   t.UserID.Hex(),
-		Issuer:    t.Issuer,
-		Audience:  t.Audience,
-		IssuedAt:  jwt.NewNumericDate(t.IssuedAt),
-		ExpiresAt: jwt.NewNumericDate(t.ExpiresAt),
-	})
+	return json.Marshal(t.claims(ClaimTypeAccess))
+}
+
+func (t RefreshToken) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.claims(ClaimTypeRefresh))
+}
+
+func (t AccessToken) claims(typ string) accessClaims {
+	claims := newTokenClaims(typ, t.Issuer, t.Audience, t.IssuedAt, t.ExpiresAt)
+	claims.ID = t.SessionID.Hex()
+	claims.Subject = t.UserID.Hex()
+
+	var actor *actorClaim
+	if t.Impersonating() {
+		actor = &actorClaim{t.Actor.Hex()}
+	}
+	return accessClaims{claims, actor}
 }
 
 func (t *AccessToken) UnmarshalJSON(data []byte) error {
-	var claims jwt.RegisteredClaims
+	var claims accessClaims
 	if err := json.Unmarshal(data, &claims); err != nil {
 		return err
 	}
@@ -93,12 +245,160 @@ func (t *AccessToken) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
+	var actorID primitive.ObjectID
+	if claims.Actor != nil {
+		actorID, err = primitive.ObjectIDFromHex(claims.Actor.Subject)
+		if err != nil {
+			return err
+		}
+	}
+
 	t.SessionID = sessionID
 	t.UserID = userID
+	t.Actor = actorID
 	t.Issuer = claims.Issuer
 	t.Audience = claims.Audience
-	t.IssuedAt = claims.IssuedAt.Time
-	t.ExpiresAt = claims.ExpiresAt.Time
+	if claims.IssuedAt != nil {
+		t.IssuedAt = claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		t.ExpiresAt = claims.ExpiresAt.Time
+	}
+
+	return nil
+}
+
+// VerificationToken proves ownership of an email address, it is only
+// valid for as long as the user's email remains unchanged
+type VerificationToken struct {
+	UserID    primitive.ObjectID
+	Email     string
+	Issuer    string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+type verificationClaims struct {
+	TokenClaims
+	Email string `json:"email"`
+}
+
+func (t *VerificationToken) Valid() error {
+	return nil
+}
+
+func (t *VerificationToken) Validate() error {
+	if t.UserID.IsZero() {
+		return errors.New("token needs user")
+	}
+	if t.Email == "" {
+		return errors.New("token needs email")
+	}
+	return nil
+}
+
+func (t VerificationToken) ClaimType() string {
+	return ClaimTypeVerifyEmail
+}
+
+func (t VerificationToken) ClaimAudience() string {
+	return AudienceVerifyEmail
+}
+
+func (t VerificationToken) MarshalJSON() ([]byte, error) {
+	claims := newTokenClaims(ClaimTypeVerifyEmail, t.Issuer, []string{AudienceVerifyEmail}, t.IssuedAt, t.ExpiresAt)
+	claims.Subject = t.UserID.Hex()
+	return json.Marshal(verificationClaims{claims, t.Email})
+}
+
+func (t *VerificationToken) UnmarshalJSON(data []byte) error {
+	var claims verificationClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return err
+	}
+
+	t.UserID = userID
+	t.Email = claims.Email
+	t.Issuer = claims.Issuer
+	if claims.IssuedAt != nil {
+		t.IssuedAt = claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		t.ExpiresAt = claims.ExpiresAt.Time
+	}
+
+	return nil
+}
+
+// TOTPChallenge is issued once a user's password is verified
+// and is exchanged along with a totp code for a session, only once
+type TOTPChallenge struct {
+	ID        primitive.ObjectID
+	UserID    primitive.ObjectID
+	Issuer    string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+func (t *TOTPChallenge) Valid() error {
+	return nil
+}
+
+func (t *TOTPChallenge) Validate() error {
+	if t.ID.IsZero() {
+		return errors.New("token needs id")
+	}
+	if t.UserID.IsZero() {
+		return errors.New("token needs user")
+	}
+	return nil
+}
+
+func (t TOTPChallenge) ClaimType() string {
+	return ClaimTypeTOTPChallenge
+}
+
+func (t TOTPChallenge) ClaimAudience() string {
+	return AudienceTOTPChallenge
+}
+
+func (t TOTPChallenge) MarshalJSON() ([]byte, error) {
+	claims := newTokenClaims(ClaimTypeTOTPChallenge, t.Issuer, []string{AudienceTOTPChallenge}, t.IssuedAt, t.ExpiresAt)
+	claims.ID = t.ID.Hex()
+	claims.Subject = t.UserID.Hex()
+	return json.Marshal(claims)
+}
+
+func (t *TOTPChallenge) UnmarshalJSON(data []byte) error {
+	var claims TokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+
+	challengeID, err := primitive.ObjectIDFromHex(claims.ID)
+	if err != nil {
+		return err
+	}
+
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return err
+	}
+
+	t.ID = challengeID
+	t.UserID = userID
+	t.Issuer = claims.Issuer
+	if claims.IssuedAt != nil {
+		t.IssuedAt = claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		t.ExpiresAt = claims.ExpiresAt.Time
+	}
 
 	return nil
 }
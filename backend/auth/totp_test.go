@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestTOTP(t *testing.T) {
+	// the sha1 test vectors from RFC 6238, truncated to six digits
+	secret := []byte("12345678901234567890")
+
+	for _, tc := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		t.Run("should generate the code at "+time.Unix(tc.unix, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			now := time.Unix(tc.unix, 0)
+			assert.Equal(t, TOTPCode(secret, TOTPStep(now)), tc.code)
+
+			step, ok := ValidateTOTP(secret, tc.code, now)
+			assert.True(t, ok)
+			assert.Equal(t, step, TOTPStep(now))
+		})
+	}
+
+	t.Run("should accept codes from adjacent periods only", func(t *testing.T) {
+		now := time.Unix(1111111109, 0)
+
+		_, ok := ValidateTOTP(secret, "081804", now.Add(TOTPPeriod))
+		assert.True(t, ok)
+
+		_, ok = ValidateTOTP(secret, "081804", now.Add(-TOTPPeriod))
+		assert.True(t, ok)
+
+		_, ok = ValidateTOTP(secret, "081804", now.Add(2*TOTPPeriod))
+		assert.False(t, ok)
+
+		_, ok = ValidateTOTP(secret, "81804", now)
+		assert.False(t, ok)
+	})
+
+	t.Run("should build an otpauth uri", func(t *testing.T) {
+		uri := TOTPURI("app.com", "user name", secret)
+		assert.True(t, strings.HasPrefix(uri, "otpauth://totp/app.com:user%20name?"))
+		assert.True(t, strings.Contains(uri, "secret="+TOTPEncodeSecret(secret)))
+		assert.True(t, strings.Contains(uri, "issuer=app.com"))
+	})
+}
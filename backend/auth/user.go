@@ -3,9 +3,15 @@ package auth
 import (
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/json"
 	"errors"
 	"hash"
+	"strings"
+	"time"
 
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -18,6 +24,15 @@ const (
 	UserStatusUnverified = ""
 	UserStatusVerified   = "verified"
 	UserStatusPrivileged = "privileged"
+
+	// UserStatusDeleted hides the user from logins until its data is purged
+	UserStatusDeleted = "deleted"
+)
+
+var (
+	ErrRegistrationClosed    = common.NewErr("registration is closed", common.ErrCodeInsufficientAuth)
+	ErrInviteRequired        = common.NewErr("must have an invite to register", common.ErrCodeInsufficientAuth)
+	ErrEmailDomainNotAllowed = common.NewErr("email domain is not allowed to register", common.ErrCodeInsufficientAuth)
 )
 
 type User struct {
@@ -27,6 +42,21 @@ type User struct {
 	Type     string               `bson:"type" json:"type,omitempty"`
 	Status   string               `bson:"status" json:"status,omitempty"`
 	Sessions []primitive.ObjectID `bson:"sessions" json:"-"`
+
+	Identities []Identity `bson:"identities,omitempty" json:"identities,omitempty"`
+
+	// InvitedBy is the user whose invite this user registered with
+	InvitedBy primitive.ObjectID `bson:"invited_by,omitempty" json:"invited_by,omitempty"`
+
+	// the ip ranges and user agents the user has recently logged in from
+	KnownIPRanges   []string `bson:"known_ip_ranges,omitempty" json:"-"`
+	KnownUserAgents []string `bson:"known_user_agents,omitempty" json:"-"`
+}
+
+// Identity links the user to their account with an oidc provider
+type Identity struct {
+	Provider string `bson:"provider" json:"provider"`
+	Subject  string `bson:"subject" json:"-"`
 }
 
 func (u *User) Validate() error {
@@ -49,6 +79,91 @@ func (u *User) Valid() error {
 	return nil
 }
 
+func (u User) Deleted() bool {
+	return u.Status == UserStatusDeleted
+}
+
+func (u User) Admin() bool {
+	return u.Type == UserTypeMe || u.Type == UserTypeAdmin
+}
+
+// UnknownClient finds the client's ip range and user agent the user
+// has not logged in from before, those already known are left empty
+func (u User) UnknownClient(client SessionClient) (ipRange, userAgent string) {
+	if r := IPRange(client.IPAddress); r != "" && !containsString(u.KnownIPRanges, r) {
+		ipRange = r
+	}
+	if client.UserAgent != "" && !containsString(u.KnownUserAgents, client.UserAgent) {
+		userAgent = client.UserAgent
+	}
+	return ipRange, userAgent
+}
+
+// Whoami is the session's user, along with the admin behind the session when it is an impersonation
+type Whoami struct {
+	User
+	ImpersonatedBy *primitive.ObjectID `json:"impersonated_by,omitempty"`
+}
+
+// UserToken keeps the logged in user on the client between requests,
+// it never expires since the user is reloaded along with the session
+type UserToken struct {
+	User
+	Issuer   string
+	IssuedAt time.Time
+}
+
+type userTokenClaims struct {
+	TokenClaims
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	UserType string `json:"type,omitempty"`
+	Status   string `json:"status,omitempty"`
+}
+
+func (t UserToken) ClaimType() string {
+	return ClaimTypeUser
+}
+
+func (t UserToken) ClaimAudience() string {
+	return AudienceAdminAPI
+}
+
+func (t UserToken) MarshalJSON() ([]byte, error) {
+	claims := newTokenClaims(ClaimTypeUser, t.Issuer, []string{AudienceAdminAPI}, t.IssuedAt, time.Time{})
+	claims.Subject = t.ID.Hex()
+	claims.ExpiresAt = nil
+	return json.Marshal(userTokenClaims{claims, t.Name, t.Email, t.Type, t.Status})
+}
+
+func (t *UserToken) UnmarshalJSON(data []byte) error {
+	var claims userTokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+
+	// tokens without a subject are caught by the user's validation
+	if claims.Subject != "" {
+		userID, err := primitive.ObjectIDFromHex(claims.Subject)
+		if err != nil {
+			return err
+		}
+		t.ID = userID
+	}
+
+	t.Name = claims.Name
+	t.Email = claims.Email
+	t.Type = claims.UserType
+	t.Status = claims.Status
+	t.Issuer = claims.Issuer
+	if claims.IssuedAt != nil {
+		t.IssuedAt = claims.IssuedAt.Time
+	}
+
+	return nil
+}
+
+// Credentials log a user in, the username may be the user's name or email
 type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -66,9 +181,75 @@ func (c Credentials) Validate() error {
 
 type Registration struct {
 	Credentials
+	Email      string `json:"email"`
+	InviteCode string `json:"invite_code,omitempty"`
+}
+
+func (r *Registration) Normalize() {
+	r.Username = NormalizeUsername(r.Username)
+	r.Email = NormalizeEmail(r.Email)
+}
+
+// Validate checks the names new users may register with, names with
+// an @ are only still allowed for users who registered before emails could log in
+func (r Registration) Validate() error {
+	if IsEmail(r.Username) {
+		return errors.New("name must not contain @")
+	}
+	return nil
+}
+
+// IsEmail reports whether a login looks like the user's email rather than their name,
+// new names cannot contain an @ but older ones may, so logins fall back to the name
+func IsEmail(login string) bool {
+	return strings.Contains(login, "@")
+}
+
+func NormalizeUsername(name string) string {
+	return strings.TrimSpace(name)
+}
+
+// NormalizeEmail lowercases the email, emails are compared regardless of case
+// but are stored lowercased so they read the same everywhere
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+type VerificationRequest struct {
+	Email string `json:"email"`
+}
+
+type Verification struct {
+	Token string `json:"token"`
+}
+
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type AccountDeletion struct {
+	// Password is left out by users without one, they must have just logged in instead
+	Password string `json:"password"`
+}
+
+// UserExport is everything stored about a user, the documents are
+// keyed by the namespace they are stored in with their secrets left out
+type UserExport struct {
+	User       User                `json:"user"`
+	ExportedAt time.Time           `json:"exported_at"`
+	Data       map[string][]bson.M `json:"data"`
+}
+
+type PasswordResetRequest struct {
 	Email string `json:"email"`
 }
 
+type PasswordReset struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
 const (
 	DigestTypeEmpty  = ""
 	DigestTypeSHA256 = "sha256"
@@ -83,6 +264,31 @@ type Password struct {
 	Iterations     int                `bson:"iterations"`
 	KeyLength      int                `bson:"key_length"`
 	DigestType     string             `bson:"digest_type"`
+	Algorithm      string             `bson:"algorithm,omitempty"`
+	Memory         int                `bson:"memory,omitempty"`
+	Parallelism    int                `bson:"parallelism,omitempty"`
+
+	// the totp secrets are encrypted and recovery codes are hashed
+	TOTPSecret        primitive.Binary `bson:"totp_secret,omitempty"`
+	TOTPPendingSecret primitive.Binary `bson:"totp_pending_secret,omitempty"`
+	TOTPLastStep      int64            `bson:"totp_last_step,omitempty"`
+	RecoveryCodes     []string         `bson:"recovery_codes,omitempty"`
+
+	// TOTPChallengeID is the one challenge that may still be exchanged for a session
+	TOTPChallengeID primitive.ObjectID `bson:"totp_challenge_id,omitempty"`
+}
+
+func (p Password) TOTPEnabled() bool {
+	return len(p.TOTPSecret.Data) > 0
+}
+
+// HashAlgorithm reports the algorithm the password was hashed with,
+// passwords stored before it was recorded are always pbkdf2
+func (p Password) HashAlgorithm() string {
+	if p.Algorithm == "" {
+		return common.PasswordHashPBKDF2
+	}
+	return p.Algorithm
 }
 
 func (p *Password) Validate() error {
@@ -101,12 +307,24 @@ func (p *Password) Validate() error {
 	if p.Iterations == 0 {
 		return errors.New("must have iterations")
 	}
+	switch p.HashAlgorithm() {
+	case common.PasswordHashBcrypt:
+		return nil
+	case common.PasswordHashArgon2id:
+		if p.Memory == 0 {
+			return errors.New("must have memory")
+		}
+		if p.Parallelism == 0 {
+			return errors.New("must have parallelism")
+		}
+	default:
+		if p.DigestType == DigestTypeEmpty {
+			return errors.New("must have digest type")
+		}
+	}
 	if p.KeyLength == 0 {
 		return errors.New("must have key length")
 	}
-	if p.DigestType == DigestTypeEmpty {
-		return errors.New("must have digest type")
-	}
 	return nil
 }
 
@@ -9,6 +9,7 @@ import (
 	"github.com/shake-on-it/app-tmpl/backend/auth"
 	"github.com/shake-on-it/app-tmpl/backend/common"
 	"github.com/shake-on-it/app-tmpl/backend/core"
+	"github.com/shake-on-it/app-tmpl/backend/core/mail"
 	"github.com/shake-on-it/app-tmpl/backend/core/mongodb"
 
 	"github.com/joho/godotenv"
@@ -32,6 +33,12 @@ func main() {
 						Flags:  addUserFlags,
 						Action: addUser,
 					},
+					{
+						Name:   "reset-password",
+						Usage:  "issue a password reset token for an application user",
+						Flags:  resetPasswordFlags,
+						Action: resetPassword,
+					},
 				},
 			},
 		},
@@ -76,19 +83,90 @@ var (
 			Usage: "the salt to use with new password",
 		},
 	}
+
+	resetPasswordFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:     "email",
+			Usage:    "the user's email",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "mongo_uri",
+			Usage: "the mongodb uri to connect to",
+		},
+		&cli.StringFlag{
+			Name:  "salt",
+			Usage: "the salt to use with new password",
+		},
+	}
 )
 
 func addUser(cliCtx *cli.Context) error {
-	if err := godotenv.Load(); err != nil {
+	logger, err := common.NewLogger("auth", common.LoggerOptionsDev)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), common.TimeoutServerOp)
+	defer cancel()
+
+	authService, err := newAuthService(ctx, cliCtx, logger)
+	if err != nil {
+		return err
+	}
+
+	user, err := authService.CreateUser(ctx, auth.Registration{
+		auth.Credentials{
+			Username: cliCtx.String("username"),
+			Password: cliCtx.String("password"),
+		},
+		cliCtx.String("email"),
+		"",
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("successfully created user:\n%# v\n", pretty.Formatter(user))
+
+	return nil
+}
+
+func resetPassword(cliCtx *cli.Context) error {
+	logger, err := common.NewLogger("auth", common.LoggerOptionsDev)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), common.TimeoutServerOp)
+	defer cancel()
+
+	authService, err := newAuthService(ctx, cliCtx, logger)
+	if err != nil {
+		return err
+	}
+
+	user, resetToken, err := authService.RequestPasswordReset(ctx, cliCtx.String("email"))
+	if err != nil {
 		return err
 	}
 
+	logger.Infof("successfully issued password reset for user %s: %s", user.Name, resetToken)
+
+	return nil
+}
+
+func newAuthService(ctx context.Context, cliCtx *cli.Context, logger common.Logger) (*core.AuthService, error) {
+	if err := godotenv.Load(); err != nil {
+		return nil, err
+	}
+
 	mongoURI := cliCtx.String("mongo_uri")
 	if mongoURI == "" {
 		mongoURI = os.Getenv("app_mongodb_url")
 	}
 	if mongoURI == "" {
-		return errors.New("must specify mongo uri")
+		return nil, errors.New("must specify mongo uri")
 	}
 
 	salt := cliCtx.String("salt")
@@ -96,56 +174,90 @@ func addUser(cliCtx *cli.Context) error {
 		salt = os.Getenv("auth_password_salt")
 	}
 	if salt == "" {
-		return errors.New("must specify salt")
+		return nil, errors.New("must specify salt")
 	}
 
-	logger, err := common.NewLogger("auth", common.LoggerOptionsDev)
-	if err != nil {
-		return err
+	config := common.Config{Auth: common.AuthConfig{PasswordSalt: salt}}
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), common.TimeoutServerOp)
-	defer cancel()
-
 	mongoProvider := mongodb.NewProvider(mongoURI, logger)
 	if err := mongoProvider.Setup(ctx); err != nil {
-		return err
+		return nil, err
 	}
 
 	userStore, err := core.NewUserStore(mongoProvider.Client())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	passwordStore, err := core.NewPasswordStore(mongoProvider.Client())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	refreshTokenStore, err := core.NewRefreshTokenStore(mongoProvider.Client())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	authService := core.NewAuthService(
-		common.Config{Auth: common.AuthConfig{PasswordSalt: salt}},
-		userStore,
-		passwordStore,
-		refreshTokenStore,
-	)
+	apiKeyStore, err := core.NewAPIKeyStore(mongoProvider.Client())
+	if err != nil {
+		return nil, err
+	}
 
-	user, err := authService.CreateUser(ctx, auth.Registration{
-		auth.Credentials{
-			Username: cliCtx.String("username"),
-			Password: cliCtx.String("password"),
-		},
-		cliCtx.String("email"),
-	})
+	loginAttemptStore, err := core.NewLoginAttemptStore(mongoProvider.Client())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	logger.Infof("successfully created user:\n%# v\n", pretty.Formatter(user))
+	auditStore, err := core.NewAuditStore(mongoProvider.Client())
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	inviteStore, err := core.NewInviteStore(mongoProvider.Client())
+	if err != nil {
+		return nil, err
+	}
+
+	userDataStore, err := core.NewUserDataStore(mongoProvider.Client())
+	if err != nil {
+		return nil, err
+	}
+
+	mailer, err := mail.NewMailer(config.Mail, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := auth.LoadKeyring(config.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	breachedPasswords, err := auth.LoadBreachedPasswords(config.Auth.PasswordPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	authService := core.NewAuthService(
+		config,
+		nil,
+		keyring,
+		breachedPasswords,
+		logger,
+		mailer,
+		mongodb.NewTransactor(mongoProvider.Client()),
+		userStore,
+		passwordStore,
+		refreshTokenStore,
+		apiKeyStore,
+		loginAttemptStore,
+		auditStore,
+		userDataStore,
+		inviteStore,
+	)
+	return &authService, nil
 }
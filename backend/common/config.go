@@ -27,6 +27,7 @@ type Config struct {
 	API    APIConfig    `json:"api"`
 	Auth   AuthConfig   `json:"auth"`
 	DB     DBConfig     `json:"db"`
+	Mail   MailConfig   `json:"mail"`
 	Server ServerConfig `json:"server"`
 }
 
@@ -40,18 +41,36 @@ func (c *Config) Validate() error {
 	if err := c.Server.validate(); err != nil {
 		return err
 	}
+	if err := c.Mail.validate(c.Server); err != nil {
+		return err
+	}
+	if c.Auth.TOTPIssuer == "" {
+		c.Auth.TOTPIssuer = c.Server.host()
+	}
+	if c.Auth.OAuthReturnURL == "" {
+		c.Auth.OAuthReturnURL = c.Mail.LinkBaseURL
+	}
 	return nil
 }
 
 const (
 	defaultAPIRequestLimit = 60_000
+
+	defaultRateLimitBurst      = 300
+	defaultRateLimitPeriodSecs = 60
 )
 
 type APIConfig struct {
 	CORSOrigins []string `json:"cors_origins"`
 
+	// TrustedProxies are the addresses or cidr ranges of the proxies in front of the server,
+	// the client's address is only read from x-forwarded-for entries they appended
+	TrustedProxies []string `json:"trusted_proxies"`
+
 	RequestLimit       int `json:"request_limit"`
 	RequestTimeoutSecs int `json:"request_timeout_secs"`
+
+	RateLimit RateLimitConfig `json:"rate_limit"`
 }
 
 func (c APIConfig) RequestTimeout() time.Duration {
@@ -62,19 +81,92 @@ func (c *APIConfig) validate() error {
 	if c.RequestLimit == 0 {
 		c.RequestLimit = defaultAPIRequestLimit
 	}
+	return c.RateLimit.validate()
+}
+
+const (
+	RateLimitBackendMemory  = "memory"
+	RateLimitBackendMongoDB = "mongodb"
+)
+
+// RateLimitConfig limits how often each user, or client ip when anonymous, may call a route.
+// Each caller gets burst requests that refill over the period, routes may set their own limit.
+// The memory backend keeps limits per instance, use mongodb to share them between instances
+type RateLimitConfig struct {
+	Backend    string `json:"backend"`
+	Burst      int    `json:"burst"`
+	PeriodSecs int    `json:"period_secs"`
+}
+
+func (c RateLimitConfig) Period() time.Duration {
+	return time.Duration(c.PeriodSecs) * time.Second
+}
+
+func (c *RateLimitConfig) validate() error {
+	switch c.Backend {
+	case "":
+		c.Backend = RateLimitBackendMemory
+	case RateLimitBackendMemory, RateLimitBackendMongoDB:
+	default:
+		return fmt.Errorf("unknown rate limit backend %q", c.Backend)
+	}
+	if c.Burst < 0 || c.PeriodSecs < 0 {
+		return fmt.Errorf("rate limit parameters must not be negative")
+	}
+	if c.Burst == 0 {
+		c.Burst = defaultRateLimitBurst
+	}
+	if c.PeriodSecs == 0 {
+		c.PeriodSecs = defaultRateLimitPeriodSecs
+	}
 	return nil
 }
 
 const (
-	defaultAccessTokenExpirySecs  = 5 * 60
-	defaultRefreshTokenExpiryDays = 30
+	defaultAccessTokenExpirySecs    = 5 * 60
+	defaultRefreshTokenExpiryDays   = 30
+	defaultSessionSweepIntervalSecs = 60 * 60
+	defaultPasswordResetExpiryMins  = 30
+	defaultVerificationExpiryHours  = 48
+	defaultTOTPChallengeExpirySecs  = 5 * 60
+	defaultAuditRetentionDays       = 90
 )
 
 type AuthConfig struct {
-	JWTSecret              string `json:"jwt_secret"`
-	PasswordSalt           string `json:"password_salt"`
-	AccessTokenExpirySecs  int    `json:"access_token_expiry_secs"`
-	RefreshTokenExpiryDays int    `json:"refresh_token_expiry_days"`
+	JWTSecret                string `json:"jwt_secret"`
+	PasswordSalt             string `json:"password_salt"`
+	AccessTokenExpirySecs    int    `json:"access_token_expiry_secs"`
+	RefreshTokenExpiryDays   int    `json:"refresh_token_expiry_days"`
+	SessionSweepIntervalSecs int    `json:"session_sweep_interval_secs"`
+	PasswordResetExpiryMins  int    `json:"password_reset_expiry_mins"`
+	VerificationExpiryHours  int    `json:"verification_expiry_hours"`
+	RequireVerifiedEmail     bool   `json:"require_verified_email"`
+	NewDeviceNotice          bool   `json:"new_device_notice"`
+	TOTPIssuer               string `json:"totp_issuer"`
+	TOTPChallengeExpirySecs  int    `json:"totp_challenge_expiry_secs"`
+	AuditRetentionDays       int    `json:"audit_retention_days"`
+
+	// ClockSkewSecs is how far token times may be off to allow for clock drift between servers
+	ClockSkewSecs int `json:"clock_skew_secs"`
+
+	// SigningKeyID names the key in SigningKeys that signs new tokens,
+	// the rest only verify tokens so keys can be rotated without logging out every user
+	SigningKeyID string             `json:"signing_key_id"`
+	SigningKeys  []SigningKeyConfig `json:"signing_keys"`
+
+	// OAuthReturnURL is where users land after logging in with an oidc provider,
+	// defaults to the mail link base url
+	OAuthReturnURL string               `json:"oauth_return_url"`
+	OIDCProviders  []OIDCProviderConfig `json:"oidc_providers"`
+
+	// ServiceClients are the services allowed to introspect and revoke tokens on the private api
+	ServiceClients []ServiceClientConfig `json:"service_clients"`
+
+	PasswordHash    PasswordHashConfig    `json:"password_hash"`
+	PasswordPolicy  PasswordPolicyConfig  `json:"password_policy"`
+	LoginThrottle   LoginThrottleConfig   `json:"login_throttle"`
+	AccountDeletion AccountDeletionConfig `json:"account_deletion"`
+	Registration    RegistrationConfig    `json:"registration"`
 }
 
 func (c *AuthConfig) validate() error {
@@ -84,6 +176,93 @@ func (c *AuthConfig) validate() error {
 	if c.RefreshTokenExpiryDays == 0 {
 		c.RefreshTokenExpiryDays = defaultRefreshTokenExpiryDays
 	}
+	if c.SessionSweepIntervalSecs == 0 {
+		c.SessionSweepIntervalSecs = defaultSessionSweepIntervalSecs
+	}
+	if c.PasswordResetExpiryMins == 0 {
+		c.PasswordResetExpiryMins = defaultPasswordResetExpiryMins
+	}
+	if c.VerificationExpiryHours == 0 {
+		c.VerificationExpiryHours = defaultVerificationExpiryHours
+	}
+	if c.TOTPChallengeExpirySecs == 0 {
+		c.TOTPChallengeExpirySecs = defaultTOTPChallengeExpirySecs
+	}
+	if c.AuditRetentionDays < 0 {
+		return fmt.Errorf("audit retention must not be negative")
+	}
+	if c.AuditRetentionDays == 0 {
+		c.AuditRetentionDays = defaultAuditRetentionDays
+	}
+	if c.ClockSkewSecs < 0 {
+		return fmt.Errorf("clock skew must not be negative")
+	}
+	if err := c.PasswordHash.validate(); err != nil {
+		return err
+	}
+	if err := c.PasswordPolicy.validate(); err != nil {
+		return err
+	}
+	if err := c.LoginThrottle.validate(); err != nil {
+		return err
+	}
+	if err := c.AccountDeletion.validate(); err != nil {
+		return err
+	}
+	if err := c.Registration.validate(); err != nil {
+		return err
+	}
+	if err := c.validateSigningKeys(); err != nil {
+		return err
+	}
+	providerNames := map[string]bool{}
+	for i := range c.OIDCProviders {
+		if err := c.OIDCProviders[i].validate(); err != nil {
+			return err
+		}
+		if providerNames[c.OIDCProviders[i].Name] {
+			return fmt.Errorf("oidc provider %q is configured more than once", c.OIDCProviders[i].Name)
+		}
+		providerNames[c.OIDCProviders[i].Name] = true
+	}
+	clientIDs := map[string]bool{}
+	for _, client := range c.ServiceClients {
+		if err := client.validate(); err != nil {
+			return err
+		}
+		if clientIDs[client.ID] {
+			return fmt.Errorf("service client %q is configured more than once", client.ID)
+		}
+		clientIDs[client.ID] = true
+	}
+	return nil
+}
+
+func (c *AuthConfig) validateSigningKeys() error {
+	if len(c.SigningKeys) == 0 {
+		if c.SigningKeyID != "" {
+			return fmt.Errorf("signing key %q is not configured", c.SigningKeyID)
+		}
+		return nil
+	}
+
+	if c.SigningKeyID == "" {
+		c.SigningKeyID = c.SigningKeys[0].ID
+	}
+
+	keyIDs := map[string]bool{}
+	for _, key := range c.SigningKeys {
+		if err := key.validate(); err != nil {
+			return err
+		}
+		if keyIDs[key.ID] {
+			return fmt.Errorf("signing key %q is configured more than once", key.ID)
+		}
+		keyIDs[key.ID] = true
+	}
+	if !keyIDs[c.SigningKeyID] {
+		return fmt.Errorf("signing key %q is not configured", c.SigningKeyID)
+	}
 	return nil
 }
 
@@ -95,8 +274,344 @@ func (c AuthConfig) RefreshTokenExpiry() time.Duration {
 	return time.Duration(c.RefreshTokenExpiryDays) * 24 * time.Hour
 }
 
+func (c AuthConfig) PasswordResetExpiry() time.Duration {
+	return time.Duration(c.PasswordResetExpiryMins) * time.Minute
+}
+
+func (c AuthConfig) VerificationExpiry() time.Duration {
+	return time.Duration(c.VerificationExpiryHours) * time.Hour
+}
+
+func (c AuthConfig) TOTPChallengeExpiry() time.Duration {
+	return time.Duration(c.TOTPChallengeExpirySecs) * time.Second
+}
+
+func (c AuthConfig) AuditRetention() time.Duration {
+	return time.Duration(c.AuditRetentionDays) * 24 * time.Hour
+}
+
+func (c AuthConfig) ClockSkew() time.Duration {
+	return time.Duration(c.ClockSkewSecs) * time.Second
+}
+
+func (c AuthConfig) SessionSweepInterval() time.Duration {
+	return time.Duration(c.SessionSweepIntervalSecs) * time.Second
+}
+
+const (
+	SigningAlgorithmHS256 = "HS256"
+	SigningAlgorithmRS256 = "RS256"
+	SigningAlgorithmEdDSA = "EdDSA"
+)
+
+// SigningKeyConfig points to a key for signing tokens, the file holds
+// a pem encoded private key or the raw secret for HS256
+type SigningKeyConfig struct {
+	ID        string `json:"id"`
+	Algorithm string `json:"algorithm"`
+	Path      string `json:"path"`
+}
+
+func (c SigningKeyConfig) validate() error {
+	if c.ID == "" {
+		return fmt.Errorf("signing key must have an id")
+	}
+	switch c.Algorithm {
+	case SigningAlgorithmHS256, SigningAlgorithmRS256, SigningAlgorithmEdDSA:
+	default:
+		return fmt.Errorf("signing key %q has an unsupported algorithm: %s", c.ID, c.Algorithm)
+	}
+	if c.Path == "" {
+		return fmt.Errorf("signing key %q must have a path", c.ID)
+	}
+	return nil
+}
+
+// OIDCProviderConfig is an openid connect provider users can login with, its
+// redirect uri is the server's base url followed by /api/admin/v1/oauth/<name>/callback
+type OIDCProviderConfig struct {
+	Name         string   `json:"name"`
+	IssuerURL    string   `json:"issuer_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+}
+
+func (c *OIDCProviderConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("oidc provider must have a name")
+	}
+	if c.IssuerURL == "" {
+		return fmt.Errorf("oidc provider %q must have an issuer url", c.Name)
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("oidc provider %q must have a client id", c.Name)
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "email", "profile"}
+	}
+	return nil
+}
+
+// ServiceClientConfig is a service that authenticates to the private api with http basic auth
+type ServiceClientConfig struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+func (c ServiceClientConfig) validate() error {
+	if c.ID == "" {
+		return fmt.Errorf("service client must have an id")
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("service client %q must have a secret", c.ID)
+	}
+	return nil
+}
+
+const (
+	defaultLoginBackoffSecs   = 1
+	defaultLoginMaxAttempts   = 5
+	defaultLoginMaxIPAttempts = 50
+	defaultLoginLockoutMins   = 15
+)
+
+// LoginThrottleConfig slows down failed logins, each failure for a username doubles
+// the wait before its next attempt until it is locked out after max attempts.
+// Client ips are only locked out, after max ip attempts
+type LoginThrottleConfig struct {
+	BackoffSecs   int `json:"backoff_secs"`
+	MaxAttempts   int `json:"max_attempts"`
+	MaxIPAttempts int `json:"max_ip_attempts"`
+	LockoutMins   int `json:"lockout_mins"`
+}
+
+func (c *LoginThrottleConfig) validate() error {
+	if c.BackoffSecs < 0 || c.MaxAttempts < 0 || c.MaxIPAttempts < 0 || c.LockoutMins < 0 {
+		return fmt.Errorf("login throttle parameters must not be negative")
+	}
+	if c.BackoffSecs == 0 {
+		c.BackoffSecs = defaultLoginBackoffSecs
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = defaultLoginMaxAttempts
+	}
+	if c.MaxIPAttempts == 0 {
+		c.MaxIPAttempts = defaultLoginMaxIPAttempts
+	}
+	if c.LockoutMins == 0 {
+		c.LockoutMins = defaultLoginLockoutMins
+	}
+	return nil
+}
+
+func (c LoginThrottleConfig) Backoff() time.Duration {
+	return time.Duration(c.BackoffSecs) * time.Second
+}
+
+func (c LoginThrottleConfig) Lockout() time.Duration {
+	return time.Duration(c.LockoutMins) * time.Minute
+}
+
+const (
+	defaultAccountGraceDays         = 30
+	defaultAccountPurgeIntervalSecs = 60 * 60
+)
+
+// AccountDeletionConfig sets how deleted accounts are removed, they are soft deleted
+// and purged once the grace period passes unless they are set to be purged right away
+type AccountDeletionConfig struct {
+	GraceDays         int  `json:"grace_days"`
+	PurgeImmediately  bool `json:"purge_immediately"`
+	PurgeIntervalSecs int  `json:"purge_interval_secs"`
+}
+
+func (c *AccountDeletionConfig) validate() error {
+	if c.GraceDays < 0 || c.PurgeIntervalSecs < 0 {
+		return fmt.Errorf("account deletion parameters must not be negative")
+	}
+	if c.GraceDays == 0 {
+		c.GraceDays = defaultAccountGraceDays
+	}
+	if c.PurgeIntervalSecs == 0 {
+		c.PurgeIntervalSecs = defaultAccountPurgeIntervalSecs
+	}
+	return nil
+}
+
+func (c AccountDeletionConfig) Grace() time.Duration {
+	return time.Duration(c.GraceDays) * 24 * time.Hour
+}
+
+func (c AccountDeletionConfig) PurgeInterval() time.Duration {
+	return time.Duration(c.PurgeIntervalSecs) * time.Second
+}
+
+const (
+	RegistrationModeOpen            = "open"
+	RegistrationModeClosed          = "closed"
+	RegistrationModeInvite          = "invite"
+	RegistrationModeDomainAllowlist = "domain_allowlist"
+
+	defaultInviteExpiryHours = 7 * 24
+)
+
+// RegistrationConfig sets who may register, anyone by default. Users can also be made
+// by logging in with an oidc provider, these are held to the same mode but cannot
+// bring an invite so they are only let in when the mode is open or their domain is allowed
+type RegistrationConfig struct {
+	Mode              string   `json:"mode"`
+	AllowedDomains    []string `json:"allowed_domains"`
+	InviteExpiryHours int      `json:"invite_expiry_hours"`
+}
+
+func (c *RegistrationConfig) validate() error {
+	switch c.Mode {
+	case "":
+		c.Mode = RegistrationModeOpen
+	case RegistrationModeOpen, RegistrationModeClosed, RegistrationModeInvite:
+	case RegistrationModeDomainAllowlist:
+		if len(c.AllowedDomains) == 0 {
+			return fmt.Errorf("registration must allow at least one domain")
+		}
+	default:
+		return fmt.Errorf("unknown registration mode %q", c.Mode)
+	}
+	if c.InviteExpiryHours < 0 {
+		return fmt.Errorf("invite expiry must not be negative")
+	}
+	if c.InviteExpiryHours == 0 {
+		c.InviteExpiryHours = defaultInviteExpiryHours
+	}
+	return nil
+}
+
+func (c RegistrationConfig) InviteExpiry() time.Duration {
+	return time.Duration(c.InviteExpiryHours) * time.Hour
+}
+
+const (
+	PasswordHashPBKDF2   = "pbkdf2"
+	PasswordHashBcrypt   = "bcrypt"
+	PasswordHashArgon2id = "argon2id"
+)
+
+// PasswordHashConfig selects the algorithm used to hash new passwords.
+// Any zero valued parameter falls back to the algorithm's default
+type PasswordHashConfig struct {
+	Algorithm   string `json:"algorithm"`
+	Iterations  int    `json:"iterations"`
+	KeyLength   int    `json:"key_length"`
+	DigestType  string `json:"digest_type"`
+	MemoryKiB   int    `json:"memory_kib"`
+	Parallelism int    `json:"parallelism"`
+}
+
+func (c *PasswordHashConfig) validate() error {
+	switch c.Algorithm {
+	case "":
+		c.Algorithm = PasswordHashPBKDF2
+	case PasswordHashPBKDF2, PasswordHashBcrypt, PasswordHashArgon2id:
+	default:
+		return fmt.Errorf("unsupported password hash algorithm: %s", c.Algorithm)
+	}
+	if c.Iterations < 0 || c.KeyLength < 0 || c.MemoryKiB < 0 || c.Parallelism < 0 {
+		return fmt.Errorf("password hash parameters must not be negative")
+	}
+	if c.Parallelism > 255 {
+		return fmt.Errorf("password hash parallelism is out of range: %d", c.Parallelism)
+	}
+	return nil
+}
+
+const (
+	defaultPasswordMinLength = 8
+
+	// lower case, upper case, digits and everything else
+	passwordCharacterClasses = 4
+)
+
+// PasswordPolicyConfig is what new passwords must meet, passwords set before keep working.
+// The breached list file holds the sha-1 hash of a breached password in hex on each line,
+// optionally followed by :count like the downloadable pwned passwords lists
+type PasswordPolicyConfig struct {
+	MinLength           int    `json:"min_length"`
+	MinCharacterClasses int    `json:"min_character_classes"`
+	AllowUserInfo       bool   `json:"allow_user_info"`
+	BreachedListPath    string `json:"breached_list_path"`
+}
+
+func (c *PasswordPolicyConfig) validate() error {
+	if c.MinLength < 0 || c.MinCharacterClasses < 0 {
+		return fmt.Errorf("password policy parameters must not be negative")
+	}
+	if c.MinCharacterClasses > passwordCharacterClasses {
+		return fmt.Errorf("password policy cannot require more than %d character classes", passwordCharacterClasses)
+	}
+	if c.MinLength == 0 {
+		c.MinLength = defaultPasswordMinLength
+	}
+	return nil
+}
+
 type DBConfig struct {
-	URI    string `json:"uri"`
+	URI string `json:"uri"`
+}
+
+const (
+	MailBackendLog  = "log"
+	MailBackendFile = "file"
+	MailBackendSMTP = "smtp"
+
+	defaultMailFrom     = "no-reply@localhost"
+	defaultMailSMTPPort = 587
+)
+
+type MailConfig struct {
+	Backend string `json:"backend"`
+	From    string `json:"from"`
+
+	// LinkBaseURL prefixes the links sent in emails, defaults to the server's base url
+	LinkBaseURL string `json:"link_base_url"`
+
+	// Dir is where the file backend writes messages
+	Dir string `json:"dir"`
+
+	SMTPHost     string `json:"smtp_host"`
+	SMTPPort     int    `json:"smtp_port"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"smtp_password"`
+}
+
+func (c *MailConfig) validate(server ServerConfig) error {
+	if c.Backend == "" {
+		c.Backend = MailBackendLog
+	}
+	if c.From == "" {
+		c.From = defaultMailFrom
+	}
+	if c.LinkBaseURL == "" {
+		c.LinkBaseURL = server.BaseURL
+	}
+	c.LinkBaseURL = strings.TrimSuffix(c.LinkBaseURL, "/")
+
+	switch c.Backend {
+	case MailBackendLog:
+	case MailBackendFile:
+		if c.Dir == "" {
+			return fmt.Errorf("mail dir must be set to use the %s backend", c.Backend)
+		}
+	case MailBackendSMTP:
+		if c.SMTPHost == "" {
+			return fmt.Errorf("mail smtp host must be set to use the %s backend", c.Backend)
+		}
+		if c.SMTPPort == 0 {
+			c.SMTPPort = defaultMailSMTPPort
+		}
+	default:
+		return fmt.Errorf("unsupported mail backend: %s", c.Backend)
+	}
+	return nil
 }
 
 type ServerConfig struct {
@@ -114,6 +629,13 @@ func (c *ServerConfig) validate() error {
 	return nil
 }
 
+func (c ServerConfig) host() string {
+	if c.Host == "" {
+		return "localhost"
+	}
+	return c.Host
+}
+
 func (c ServerConfig) baseURL() string {
 	var sb strings.Builder
 
@@ -123,11 +645,7 @@ func (c ServerConfig) baseURL() string {
 	}
 	sb.WriteString("://")
 
-	host := c.Host
-	if host == "" {
-		host = "localhost"
-	}
-	sb.WriteString(host)
+	sb.WriteString(c.host())
 
 	if c.Port != 0 {
 		sb.WriteString(fmt.Sprintf(":%d", c.Port))
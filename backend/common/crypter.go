@@ -3,12 +3,15 @@ package common
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
+	"errors"
 	"io/ioutil"
 )
 
+// Crypter encrypts values at rest, the ciphertext carries its own nonce
 type Crypter interface {
-	Decrypt(val interface{}) (interface{}, error)
-	Encrypt(val interface{}) (interface{}, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+	Encrypt(plaintext []byte) ([]byte, error)
 }
 
 func LoadCrypter(path string) (Crypter, error) {
@@ -19,22 +22,35 @@ func LoadCrypter(path string) (Crypter, error) {
 	return NewCrypter(key)
 }
 
+// NewCrypter makes an AES-GCM crypter, the key must be 16, 24 or 32 bytes long
 func NewCrypter(key []byte) (Crypter, error) {
 	blockCipher, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	return &crypter{blockCipher}, nil
+	aead, err := cipher.NewGCM(blockCipher)
+	if err != nil {
+		return nil, err
+	}
+	return &crypter{aead}, nil
 }
 
 type crypter struct {
-	blockCipher cipher.Block
+	aead cipher.AEAD
 }
 
-func (c *crypter) Decrypt(val interface{}) (interface{}, error) {
-	return val, nil
+func (c *crypter) Decrypt(ciphertext []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return c.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
 }
 
-func (c *crypter) Encrypt(val interface{}) (interface{}, error) {
-	return val, nil
+func (c *crypter) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
 }
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestCrypter(t *testing.T) {
+	crypter, err := NewCrypter([]byte("0123456789abcdef0123456789abcdef"))
+	assert.Nil(t, err)
+
+	t.Run("should decrypt what it encrypts", func(t *testing.T) {
+		ciphertext, err := crypter.Encrypt([]byte("secret"))
+		assert.Nil(t, err)
+		assert.NotEqual(t, ciphertext, []byte("secret"))
+
+		plaintext, err := crypter.Decrypt(ciphertext)
+		assert.Nil(t, err)
+		assert.Equal(t, plaintext, []byte("secret"))
+	})
+
+	t.Run("should fail to decrypt tampered values", func(t *testing.T) {
+		ciphertext, err := crypter.Encrypt([]byte("secret"))
+		assert.Nil(t, err)
+
+		ciphertext[len(ciphertext)-1] ^= 1
+		_, err = crypter.Decrypt(ciphertext)
+		assert.NotNil(t, err)
+
+		_, err = crypter.Decrypt([]byte("short"))
+		assert.NotNil(t, err)
+	})
+}
@@ -10,14 +10,22 @@ const (
 
 	ErrCodeBadRequest ErrCode = "bad_request"
 	ErrCodeNotFound   ErrCode = "not_found"
+	ErrCodeConflict   ErrCode = "conflict"
 
 	ErrCodeInvalidAuth      ErrCode = "invalid_auth"
 	ErrCodeInsufficientAuth ErrCode = "insufficient_auth"
 
+	ErrCodeTooManyRequests ErrCode = "too_many_requests"
+
 	ErrCodeServer            ErrCode = "server"
 	ErrCodeServerUnavailable ErrCode = "server_unavailable"
 )
 
+const (
+	// ErrDataRetryAfterSecs is sent back as the retry-after header
+	ErrDataRetryAfterSecs = "retry_after_secs"
+)
+
 type err struct {
 	cause error
 	code  ErrCode
@@ -7,11 +7,14 @@ import (
 
 const (
 	LoggerFieldDuration   = "duration"
+	LoggerFieldFamilyID   = "family_id"
 	LoggerFieldHTTPMethod = "http_method"
 	LoggerFieldIPAddress  = "ip_address"
 	LoggerFieldPath       = "path"
 	LoggerFieldProto      = "proto"
 	LoggerFieldRequestID  = "request_id"
+	LoggerFieldSessionID  = "session_id"
+	LoggerFieldUserID     = "user_id"
 	LoggerFieldHTTPStatus = "http_status"
 )
 
@@ -59,7 +59,12 @@ func NewHarnessWithOptions(t *testing.T, opts HarnessOptions) Harness {
 
 	logger := u.NewLogger(t)
 
-	apiServer := server.NewService(config, opts.Crypter, logger)
+	crypter := opts.Crypter
+	if crypter == nil {
+		crypter = u.NewCrypter(t)
+	}
+
+	apiServer := server.NewService(config, crypter, logger)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	assert.Nil(t, apiServer.Setup(ctx))
@@ -118,7 +123,7 @@ func (th *Harness) CreateUser(username string) error {
 
 func (th *Harness) Login() error {
 	_, err := th.APIServer.AdminAPI.UserStore.FindByName(context.Background(), testUsername)
-	if err, ok := err.(common.ErrCoder); ok && err.Code() == common.ErrCodeNotFound {
+	if err, ok := err.(common.ErrCodeProvider); ok && err.Code() == common.ErrCodeNotFound {
 		if err := th.CreateUser(testUsername); err != nil {
 			return err
 		}
@@ -170,6 +175,14 @@ type Request struct {
 	Anon    bool
 	Auth    bool
 	Refresh bool
+
+	// SkipCSRF leaves out the csrf header that cookie authenticated requests send
+	SkipCSRF bool
+
+	// Legacy sends the auth cookies alone, as clients logged in before the csrf cookie was issued do
+	Legacy bool
+	// APIKey is sent as the bearer token, leave out the session with Anon
+	APIKey string
 }
 
 func (th *Harness) Do(opts Request) (Response, error) {
@@ -199,6 +212,9 @@ func (th *Harness) Do(opts Request) (Response, error) {
 		return Response{}, err
 	}
 
+	if opts.APIKey != "" {
+		req.Header.Set(api.HeaderAuthorization, api.AuthorizationBearer+opts.APIKey)
+	}
 	if !opts.Anon {
 		if cookie, ok := th.authCookies[th.authUser][auth.CookieUserToken]; ok {
 			req.AddCookie(cookie)
@@ -214,6 +230,14 @@ func (th *Harness) Do(opts Request) (Response, error) {
 			req.AddCookie(cookie)
 		}
 	}
+	if (opts.Auth || opts.Refresh) && !opts.Legacy {
+		if cookie, ok := th.authCookies[th.authUser][auth.CookieCSRFToken]; ok {
+			req.AddCookie(cookie)
+			if !opts.SkipCSRF {
+				req.Header.Set(api.HeaderXAPP+api.HeaderCSRFToken, cookie.Value)
+			}
+		}
+	}
 
 	res, err := th.client.Do(req)
 	if err != nil {
@@ -247,6 +271,10 @@ func (res *Response) Is(statusCode int) error {
 	return res.Err()
 }
 
+func (res *Response) Header() http.Header {
+	return res.data.Header
+}
+
 func (res *Response) Decode(out interface{}) error {
 	if !res.checked {
 		return errors.New("must check response status code first")
@@ -293,6 +321,9 @@ func buildConfig(opts HarnessOptions) (common.Config, error) {
 		config.Auth.AccessTokenExpirySecs = opts.Auth.AccessTokenExpirySecs
 	}
 
+	config.Auth.OAuthReturnURL = opts.Auth.OAuthReturnURL
+	config.Auth.OIDCProviders = opts.Auth.OIDCProviders
+
 	if err := config.Validate(); err != nil {
 		return common.Config{}, err
 	}
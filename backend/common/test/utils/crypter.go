@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+)
+
+// NewCrypter makes a crypter with a random key that lasts for the test
+func NewCrypter(t *testing.T) common.Crypter {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("failed to create test crypter key: %s", err)
+	}
+
+	crypter, err := common.NewCrypter(key)
+	if err != nil {
+		t.Fatalf("failed to create test crypter: %s", err)
+	}
+	return crypter
+}
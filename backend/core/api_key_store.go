@@ -0,0 +1,119 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/core/mongodb"
+	"github.com/shake-on-it/app-tmpl/backend/core/namespaces"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type APIKeyStore interface {
+	FindByID(ctx context.Context, id primitive.ObjectID) (auth.APIKey, error)
+	FindByUserID(ctx context.Context, userID primitive.ObjectID) ([]auth.APIKey, error)
+
+	Insert(ctx context.Context, apiKey auth.APIKey) error
+
+	MarkUsed(ctx context.Context, id primitive.ObjectID, usedAt time.Time) error
+
+	Delete(ctx context.Context, userID, id primitive.ObjectID) error
+	DeleteByUserID(ctx context.Context, userID primitive.ObjectID) error
+}
+
+func NewAPIKeyStore(client *mongo.Client) (APIKeyStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), common.TimeoutServerOp)
+	defer cancel()
+
+	coll, err := mongodb.NewColl(ctx, client, namespaces.DBAuth, namespaces.CollAPIKeys, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldUserID, 1}),
+	}, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldExpiresAt, 1}),
+		ExpireAfterSeconds: mongodb.ExpireAfter(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiKeyStore{coll}, nil
+}
+
+type apiKeyStore struct {
+	coll *mongo.Collection
+}
+
+func (s *apiKeyStore) FindByID(ctx context.Context, id primitive.ObjectID) (auth.APIKey, error) {
+	var apiKey auth.APIKey
+	if err := s.coll.FindOne(ctx, bson.D{{namespaces.FieldID, id}}).Decode(&apiKey); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.APIKey{}, common.NewErr("cannot find api key", common.ErrCodeNotFound)
+		}
+		return auth.APIKey{}, common.WrapErr(fmt.Errorf("failed to find api key: %s", err), common.ErrCodeServer)
+	}
+	return apiKey, nil
+}
+
+func (s *apiKeyStore) FindByUserID(ctx context.Context, userID primitive.ObjectID) ([]auth.APIKey, error) {
+	cursor, err := s.coll.Find(
+		ctx,
+		bson.D{{namespaces.FieldUserID, userID}},
+		options.Find().SetSort(bson.D{{namespaces.FieldID, 1}}),
+	)
+	if err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to find api keys: %s", err), common.ErrCodeServer)
+	}
+
+	apiKeys := []auth.APIKey{}
+	if err := cursor.All(ctx, &apiKeys); err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to read api keys: %s", err), common.ErrCodeServer)
+	}
+	return apiKeys, nil
+}
+
+func (s *apiKeyStore) Insert(ctx context.Context, apiKey auth.APIKey) error {
+	if _, err := s.coll.InsertOne(ctx, apiKey); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to create api key: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
+
+func (s *apiKeyStore) MarkUsed(ctx context.Context, id primitive.ObjectID, usedAt time.Time) error {
+	if _, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldID, id}},
+		bson.D{{"$set", bson.D{{namespaces.FieldLastUsedAt, usedAt}}}},
+	); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to update api key: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
+
+func (s *apiKeyStore) Delete(ctx context.Context, userID, id primitive.ObjectID) error {
+	res, err := s.coll.DeleteOne(ctx, bson.D{
+		{namespaces.FieldID, id},
+		{namespaces.FieldUserID, userID},
+	})
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to delete api key: %s", err), common.ErrCodeServer)
+	}
+	if res.DeletedCount == 0 {
+		return common.NewErr("cannot find api key", common.ErrCodeNotFound)
+	}
+	return nil
+}
+
+func (s *apiKeyStore) DeleteByUserID(ctx context.Context, userID primitive.ObjectID) error {
+	if _, err := s.coll.DeleteMany(ctx, bson.D{{namespaces.FieldUserID, userID}}); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to delete api keys: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
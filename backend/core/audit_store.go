@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/core/mongodb"
+	"github.com/shake-on-it/app-tmpl/backend/core/namespaces"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditStore only ever adds events, they are removed once they expire
+type AuditStore interface {
+	Find(ctx context.Context, query auth.AuditQuery) ([]auth.AuditEvent, error)
+
+	Insert(ctx context.Context, event auth.AuditEvent) error
+}
+
+func NewAuditStore(client *mongo.Client) (AuditStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), common.TimeoutServerOp)
+	defer cancel()
+
+	coll, err := mongodb.NewColl(ctx, client, namespaces.DBAudit, namespaces.CollAuditEvents, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldActorID, 1},
+			mongodb.IndexField{namespaces.FieldID, -1}),
+	}, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldImpersonatorID, 1},
+			mongodb.IndexField{namespaces.FieldID, -1}),
+	}, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldTargetID, 1},
+			mongodb.IndexField{namespaces.FieldID, -1}),
+	}, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldAction, 1},
+			mongodb.IndexField{namespaces.FieldID, -1}),
+	}, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldExpiresAt, 1}),
+		ExpireAfterSeconds: mongodb.ExpireAfter(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditStore{coll}, nil
+}
+
+type auditStore struct {
+	coll *mongo.Collection
+}
+
+func (s *auditStore) Find(ctx context.Context, query auth.AuditQuery) ([]auth.AuditEvent, error) {
+	filter := bson.D{}
+	if !query.UserID.IsZero() {
+		filter = append(filter, bson.E{"$or", bson.A{
+			bson.D{{namespaces.FieldActorID, query.UserID}},
+			bson.D{{namespaces.FieldImpersonatorID, query.UserID}},
+			bson.D{
+				{namespaces.FieldTargetType, auth.AuditTargetUser},
+				{namespaces.FieldTargetID, query.UserID},
+			},
+		}})
+	}
+	if query.Action != "" {
+		filter = append(filter, bson.E{namespaces.FieldAction, query.Action})
+	}
+
+	createdAt := bson.D{}
+	if !query.From.IsZero() {
+		createdAt = append(createdAt, bson.E{"$gte", query.From})
+	}
+	if !query.To.IsZero() {
+		createdAt = append(createdAt, bson.E{"$lt", query.To})
+	}
+	if len(createdAt) > 0 {
+		filter = append(filter, bson.E{namespaces.FieldCreatedAt, createdAt})
+	}
+
+	if !query.Before.IsZero() {
+		filter = append(filter, bson.E{namespaces.FieldID, bson.D{{"$lt", query.Before}}})
+	}
+
+	cursor, err := s.coll.Find(
+		ctx,
+		filter,
+		options.Find().
+			SetSort(bson.D{{namespaces.FieldID, -1}}).
+			SetLimit(int64(query.Limit)),
+	)
+	if err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to find audit events: %s", err), common.ErrCodeServer)
+	}
+
+	events := []auth.AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to read audit events: %s", err), common.ErrCodeServer)
+	}
+	return events, nil
+}
+
+func (s *auditStore) Insert(ctx context.Context, event auth.AuditEvent) error {
+	if _, err := s.coll.InsertOne(ctx, event); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to insert audit event: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
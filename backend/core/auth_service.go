@@ -1,28 +1,34 @@
 package core
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/shake-on-it/app-tmpl/backend/auth"
 	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/core/mail"
+	"github.com/shake-on-it/app-tmpl/backend/core/mongodb"
 
 	jwt "github.com/golang-jwt/jwt/v4"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
 	passwordSaltLength = 12
+	resetTokenLength   = 32
 
-	defaultHashKeyLength = 12
-	defaultHashRounds    = 4096
+	linkPathResetPassword = "/reset_password"
+	linkPathVerifyEmail   = "/verify_email"
 
-	audAPIAdminV1 = "api/admin/v1"
+	// oauthCallbackPath is where providers send users back to, relative to the server's base url
+	oauthCallbackPath = "/api/admin/v1/oauth/%s/callback"
 )
 
 var (
@@ -31,34 +37,145 @@ var (
 
 type AuthService struct {
 	jwtIssuer          string
-	jwtSecret          []byte
+	jwtLeeway          time.Duration
 	jwtDurationAccess  time.Duration
 	jwtDurationRefresh time.Duration
 	passwordSalt       []byte
-
+	passwordHasher     PasswordHasher
+	passwordPolicy     auth.PasswordPolicy
+	passwordResetTTL   time.Duration
+	verificationTTL    time.Duration
+	totpChallengeTTL   time.Duration
+	totpIssuer         string
+	auditRetention     time.Duration
+	accountGrace       time.Duration
+	inviteTTL          time.Duration
+
+	registrationMode    string
+	registrationDomains map[string]bool
+
+	requireVerifiedEmail bool
+	purgeImmediately     bool
+	newDeviceNotice      bool
+	linkBaseURL          string
+
+	oidcProviders  map[string]*auth.OIDCProvider
+	serviceClients map[string]string
+
+	userLoginThrottle auth.LoginThrottle
+	ipLoginThrottle   auth.LoginThrottle
+
+	crypter common.Crypter
+	keyring *auth.Keyring
+	logger  common.Logger
+	mailer  mail.Mailer
+
+	transactor mongodb.Transactor
+
+	apiKeyStore       APIKeyStore
+	auditStore        AuditStore
+	inviteStore       InviteStore
+	loginAttemptStore LoginAttemptStore
 	refreshTokenStore RefreshTokenStore
 	passwordStore     PasswordStore
+	userDataStore     UserDataStore
 	userStore         UserStore
-
-	emailClient interface{}
 }
 
-func NewAuthService(config common.Config, userStore UserStore, passwordStore PasswordStore, refreshTokenStore RefreshTokenStore) AuthService {
+func NewAuthService(config common.Config, crypter common.Crypter, keyring *auth.Keyring, breachedPasswords *auth.BreachedPasswords, logger common.Logger, mailer mail.Mailer, transactor mongodb.Transactor, userStore UserStore, passwordStore PasswordStore, refreshTokenStore RefreshTokenStore, apiKeyStore APIKeyStore, loginAttemptStore LoginAttemptStore, auditStore AuditStore, userDataStore UserDataStore, inviteStore InviteStore) AuthService {
+	if keyring == nil {
+		keyring = auth.NewHMACKeyring([]byte(config.Auth.JWTSecret))
+	}
+
+	oidcProviders := make(map[string]*auth.OIDCProvider, len(config.Auth.OIDCProviders))
+	for _, providerConfig := range config.Auth.OIDCProviders {
+		redirectURL := config.Server.BaseURL + fmt.Sprintf(oauthCallbackPath, providerConfig.Name)
+		oidcProviders[providerConfig.Name] = auth.NewOIDCProvider(providerConfig, redirectURL, config.Auth.ClockSkew(), nil)
+	}
+
+	serviceClients := make(map[string]string, len(config.Auth.ServiceClients))
+	for _, client := range config.Auth.ServiceClients {
+		serviceClients[client.ID] = client.Secret
+	}
+
+	registrationDomains := make(map[string]bool, len(config.Auth.Registration.AllowedDomains))
+	for _, domain := range config.Auth.Registration.AllowedDomains {
+		registrationDomains[auth.NormalizeEmail(domain)] = true
+	}
+
 	return AuthService{
 		jwtIssuer:          config.Server.BaseURL,
-		jwtSecret:          []byte(config.Auth.JWTSecret),
+		jwtLeeway:          config.Auth.ClockSkew(),
 		jwtDurationAccess:  config.Auth.AccessTokenExpiry(),
 		jwtDurationRefresh: config.Auth.RefreshTokenExpiry(),
 		passwordSalt:       []byte(config.Auth.PasswordSalt),
+		passwordHasher:     NewPasswordHasher(config.Auth.PasswordHash, []byte(config.Auth.PasswordSalt)),
+		passwordPolicy:     auth.NewPasswordPolicy(config.Auth.PasswordPolicy, breachedPasswords),
+		passwordResetTTL:   config.Auth.PasswordResetExpiry(),
+		verificationTTL:    config.Auth.VerificationExpiry(),
+		totpChallengeTTL:   config.Auth.TOTPChallengeExpiry(),
+		totpIssuer:         config.Auth.TOTPIssuer,
+		auditRetention:     config.Auth.AuditRetention(),
+		accountGrace:       config.Auth.AccountDeletion.Grace(),
+		inviteTTL:          config.Auth.Registration.InviteExpiry(),
+
+		registrationMode:    config.Auth.Registration.Mode,
+		registrationDomains: registrationDomains,
+
+		requireVerifiedEmail: config.Auth.RequireVerifiedEmail,
+		purgeImmediately:     config.Auth.AccountDeletion.PurgeImmediately,
+		newDeviceNotice:      config.Auth.NewDeviceNotice,
+		linkBaseURL:          config.Mail.LinkBaseURL,
+
+		oidcProviders:  oidcProviders,
+		serviceClients: serviceClients,
+
+		userLoginThrottle: auth.LoginThrottle{
+			Backoff:     config.Auth.LoginThrottle.Backoff(),
+			MaxAttempts: config.Auth.LoginThrottle.MaxAttempts,
+			Lockout:     config.Auth.LoginThrottle.Lockout(),
+		},
+		ipLoginThrottle: auth.LoginThrottle{
+			MaxAttempts: config.Auth.LoginThrottle.MaxIPAttempts,
+			Lockout:     config.Auth.LoginThrottle.Lockout(),
+		},
+
+		crypter: crypter,
+		keyring: keyring,
+		logger:  logger,
+		mailer:  mailer,
 
+		transactor: transactor,
+
+		apiKeyStore:       apiKeyStore,
+		auditStore:        auditStore,
+		inviteStore:       inviteStore,
+		loginAttemptStore: loginAttemptStore,
 		refreshTokenStore: refreshTokenStore,
 		passwordStore:     passwordStore,
+		userDataStore:     userDataStore,
 		userStore:         userStore,
 	}
 }
 
-func (s *AuthService) CreateUser(ctx context.Context, reg auth.Registration) (auth.User, error) {
-	user := auth.User{
+func (s *AuthService) CreateUser(ctx context.Context, reg auth.Registration) (user auth.User, err error) {
+	defer func() {
+		event := auditUser(auth.AuditActionRegister, user.ID)
+		event.Username = reg.Username
+		s.audit(ctx, event, err)
+	}()
+
+	reg.Normalize()
+
+	if err := s.checkRegistration(reg.Email, reg.InviteCode); err != nil {
+		return auth.User{}, err
+	}
+
+	if err := reg.Validate(); err != nil {
+		return auth.User{}, common.WrapErr(fmt.Errorf("failed to make user: %s", err), common.ErrCodeBadRequest)
+	}
+
+	user = auth.User{
 		Name:  reg.Username,
 		Email: reg.Email,
 	}
@@ -66,56 +183,164 @@ func (s *AuthService) CreateUser(ctx context.Context, reg auth.Registration) (au
 		return auth.User{}, common.WrapErr(fmt.Errorf("failed to make user: %s", err), common.ErrCodeBadRequest)
 	}
 
-	randomSalt := make([]byte, passwordSaltLength)
-	if _, err := rand.Read(randomSalt); err != nil {
-		return auth.User{}, common.WrapErr(fmt.Errorf("cannot make password: %s", err), common.ErrCodeServer)
+	if err := s.passwordPolicy.Check(reg.Password, user.Name, user.Email); err != nil {
+		return auth.User{}, err
 	}
 
-	password, err := s.makePassword(randomSalt, reg.Credentials, passwordOptions{})
+	password, err := s.makeSaltedPassword(reg.Credentials)
 	if err != nil {
 		return auth.User{}, err
 	}
 
-	// TODO: make this a transaction
-	if err := s.userStore.Insert(ctx, user); err != nil {
+	if err := s.transactor.WithTransaction(ctx, func(ctx context.Context, tx *mongodb.Tx) error {
+		if s.registrationMode == common.RegistrationModeInvite {
+			invite, err := s.inviteStore.Consume(ctx, hashToken(reg.InviteCode), user.ID, time.Now())
+			if err != nil {
+				return err
+			}
+			tx.OnAbort(func(ctx context.Context) error { return s.inviteStore.Release(ctx, invite.ID) })
+
+			user.Type = invite.UserType
+			user.InvitedBy = invite.CreatedBy
+		}
+
+		if err := s.userStore.Insert(ctx, user); err != nil {
+			return err
+		}
+		tx.OnAbort(func(ctx context.Context) error { return s.userStore.Delete(ctx, user.ID) })
+
+		return s.passwordStore.Insert(ctx, password)
+	}); err != nil {
 		return auth.User{}, err
 	}
-	if err := s.passwordStore.Insert(ctx, password); err != nil {
+
+	if err := s.sendVerification(ctx, user); err != nil {
+		s.logger.With(common.LoggerFieldUserID, user.ID.Hex()).Warnf("failed to send user verification: %s", err)
+	}
+
+	return user, nil
+}
+
+// checkRegistration fails when the registration mode does not let the email register,
+// invites are only checked for now and used up once the user is made
+func (s *AuthService) checkRegistration(email, inviteCode string) error {
+	switch s.registrationMode {
+	case common.RegistrationModeClosed:
+		return auth.ErrRegistrationClosed
+	case common.RegistrationModeInvite:
+		if inviteCode == "" {
+			return auth.ErrInviteRequired
+		}
+	case common.RegistrationModeDomainAllowlist:
+		domain := email[strings.LastIndex(email, "@")+1:]
+		if !s.registrationDomains[auth.NormalizeEmail(domain)] {
+			return auth.ErrEmailDomainNotAllowed
+		}
+	}
+	return nil
+}
+
+// RequestVerification resends the verification email to a user that has not yet verified
+func (s *AuthService) RequestVerification(ctx context.Context, email string) (err error) {
+	var user auth.User
+	defer func() {
+		s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionRequestVerification, TargetType: auth.AuditTargetUser, TargetID: user.ID}, err)
+	}()
+
+	user, err = s.userStore.FindByEmail(ctx, auth.NormalizeEmail(email))
+	if err != nil {
+		return err
+	}
+	if user.Status != auth.UserStatusUnverified {
+		return nil
+	}
+	return s.sendVerification(ctx, user)
+}
+
+func (s *AuthService) VerifyEmail(ctx context.Context, token string) (user auth.User, err error) {
+	var verificationToken auth.VerificationToken
+	defer func() { s.audit(ctx, auditUser(auth.AuditActionVerifyEmail, verificationToken.UserID), err) }()
+
+	if err := s.ParseToken(token, &verificationToken); err != nil {
 		return auth.User{}, err
 	}
 
-	// TODO: send user verification
+	user, err = s.userStore.FindByID(ctx, verificationToken.UserID)
+	if err != nil {
+		return auth.User{}, err
+	}
+	if user.Email != verificationToken.Email {
+		return auth.User{}, common.NewErr("verification is no longer valid", common.ErrCodeBadRequest)
+	}
 
-	return user, nil
+	return s.userStore.MarkVerified(ctx, user.ID)
 }
 
-func (s *AuthService) Login(ctx context.Context, creds auth.Credentials) (auth.User, auth.Tokens, error) {
+// Login checks the user's password, failed logins are tracked for the username
+// and the client's ip address so that guessing passwords is slowed down
+func (s *AuthService) Login(ctx context.Context, creds auth.Credentials, ipAddress string) (user auth.User, tokens auth.Tokens, err error) {
 	now := time.Now()
 
-	user, err := s.userStore.FindByName(ctx, creds.Username)
-	if err != nil {
+	event := auth.AuditEvent{Action: auth.AuditActionLogin, Username: creds.Username}
+	defer func() { s.audit(ctx, event, err) }()
+
+	login := auth.NormalizeUsername(creds.Username)
+	if auth.IsEmail(login) {
+		login = auth.NormalizeEmail(login)
+	}
+
+	attemptKeys := s.loginAttemptKeys(login, ipAddress)
+	if err := s.checkLoginAttempts(ctx, attemptKeys, now); err != nil {
 		return auth.User{}, auth.Tokens{}, err
 	}
 
-	password, err := s.passwordStore.FindByUsername(ctx, creds.Username)
+	if auth.IsEmail(login) {
+		user, err = s.userStore.FindByEmail(ctx, login)
+		// users who registered before emails could log in may have an @ in their name
+		if findErr, ok := err.(common.ErrCodeProvider); ok && findErr.Code() == common.ErrCodeNotFound {
+			user, err = s.userStore.FindByName(ctx, auth.NormalizeUsername(creds.Username))
+		}
+	} else {
+		user, err = s.userStore.FindByName(ctx, login)
+	}
 	if err != nil {
+		s.recordLoginFailure(ctx, attemptKeys, err, now)
 		return auth.User{}, auth.Tokens{}, err
 	}
+	event = auditUser(auth.AuditActionLogin, user.ID)
 
-	passwordAttempt, err := s.makePassword(password.Salt.Data, creds, passwordOptions{
-		digestType:    password.DigestType,
-		hashKeyLength: password.KeyLength,
-		hashRounds:    password.Iterations,
-	})
+	// once the user is known their name and email share one count of failures
+	attemptKeys = s.userLoginAttemptKeys(user, ipAddress)
+	if err := s.checkLoginAttempts(ctx, attemptKeys, now); err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+
+	// the password is stored under the user's name however they logged in
+	creds.Username = user.Name
+
+	password, err := s.verifyPassword(ctx, creds)
 	if err != nil {
+		s.recordLoginFailure(ctx, attemptKeys, err, now)
 		return auth.User{}, auth.Tokens{}, err
 	}
 
-	if !bytes.Equal(password.HashedPassword.Data, passwordAttempt.HashedPassword.Data) {
-		return auth.User{}, auth.Tokens{}, common.NewErr("invalid password", common.ErrCodeBadRequest)
+	if s.passwordHasher.NeedsRehash(password) {
+		s.rehashPassword(ctx, user.ID, creds)
+	}
+
+	if s.requireVerifiedEmail && user.Status == auth.UserStatusUnverified {
+		return auth.User{}, auth.Tokens{}, auth.ErrEmailNotVerified
 	}
 
-	user, tokens, err := s.makeSession(ctx, user.ID, primitive.NilObjectID, now)
+	if password.TOTPEnabled() {
+		tokens, err = s.makeTOTPChallenge(ctx, user, now)
+		if err != nil {
+			return auth.User{}, auth.Tokens{}, err
+		}
+		return user, tokens, nil
+	}
+
+	user, tokens, err = s.makeLoginSession(ctx, user.ID, now)
 	if err != nil {
 		return auth.User{}, auth.Tokens{}, err
 	}
@@ -123,7 +348,144 @@ func (s *AuthService) Login(ctx context.Context, creds auth.Credentials) (auth.U
 	return user, tokens, nil
 }
 
-func (s *AuthService) Logout(ctx context.Context, userID primitive.ObjectID) error {
+func (s *AuthService) ChangePassword(ctx context.Context, userID, sessionID primitive.ObjectID, change auth.PasswordChange) (err error) {
+	defer func() { s.audit(ctx, auditUser(auth.AuditActionChangePassword, userID), err) }()
+
+	user, err := s.userStore.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.verifyPassword(ctx, auth.Credentials{user.Name, change.CurrentPassword}); err != nil {
+		return err
+	}
+
+	creds := auth.Credentials{user.Name, change.NewPassword}
+	if err := creds.Validate(); err != nil {
+		return common.WrapErr(err, common.ErrCodeBadRequest)
+	}
+	if err := s.passwordPolicy.Check(creds.Password, user.Name, user.Email); err != nil {
+		return err
+	}
+
+	password, err := s.makeSaltedPassword(creds)
+	if err != nil {
+		return err
+	}
+
+	if err := s.passwordStore.UpdatePassword(ctx, password); err != nil {
+		return err
+	}
+
+	if err := s.refreshTokenStore.DeleteByUserIDExcept(ctx, userID, sessionID); err != nil {
+		return err
+	}
+	return s.userStore.ClearSessionsExcept(ctx, userID, sessionID)
+}
+
+// RequestPasswordReset issues a single-use token that can be redeemed for a new password
+func (s *AuthService) RequestPasswordReset(ctx context.Context, email string) (user auth.User, resetToken string, err error) {
+	var userID primitive.ObjectID
+	defer func() {
+		s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionRequestPasswordReset, TargetType: auth.AuditTargetUser, TargetID: userID}, err)
+	}()
+
+	user, err = s.userStore.FindByEmail(ctx, auth.NormalizeEmail(email))
+	if err != nil {
+		return auth.User{}, "", err
+	}
+	userID = user.ID
+
+	token := make([]byte, resetTokenLength)
+	if _, err := rand.Read(token); err != nil {
+		return auth.User{}, "", common.WrapErr(fmt.Errorf("cannot make password reset: %s", err), common.ErrCodeServer)
+	}
+	resetToken = hex.EncodeToString(token)
+
+	if err := s.passwordStore.SetResetToken(ctx, user.Name, hashToken(resetToken), time.Now().Add(s.passwordResetTTL)); err != nil {
+		return auth.User{}, "", err
+	}
+
+	if err := s.sendMail(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse the link below to choose a new password:\n\n%s\n\nIf you did not ask to reset your password you can ignore this email.\n",
+			user.Name,
+			s.makeLink(linkPathResetPassword, resetToken),
+		),
+	}); err != nil {
+		return auth.User{}, "", err
+	}
+
+	return user, resetToken, nil
+}
+
+func (s *AuthService) ResetPassword(ctx context.Context, reset auth.PasswordReset) (err error) {
+	var userID primitive.ObjectID
+	defer func() { s.audit(ctx, auditUser(auth.AuditActionResetPassword, userID), err) }()
+
+	now := time.Now()
+	resetToken := hashToken(reset.Token)
+
+	// the reset is only looked up until the new password is known to be allowed,
+	// a rejected password leaves it to be tried again
+	prevPassword, err := s.passwordStore.FindByResetToken(ctx, resetToken, now)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.userStore.FindByName(ctx, prevPassword.Username)
+	if err != nil {
+		return err
+	}
+	userID = user.ID
+
+	creds := auth.Credentials{prevPassword.Username, reset.Password}
+	if err := creds.Validate(); err != nil {
+		return common.WrapErr(err, common.ErrCodeBadRequest)
+	}
+	if err := s.passwordPolicy.Check(creds.Password, user.Name, user.Email); err != nil {
+		return err
+	}
+
+	password, err := s.makeSaltedPassword(creds)
+	if err != nil {
+		return err
+	}
+
+	if err := s.passwordStore.ResetPassword(ctx, resetToken, password, now); err != nil {
+		return err
+	}
+
+	return s.logoutAll(ctx, user.ID)
+}
+
+func (s *AuthService) Logout(ctx context.Context, userID, sessionID primitive.ObjectID) error {
+	err := s.logout(ctx, userID, sessionID)
+	s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionLogout, ActorID: userID, TargetType: auth.AuditTargetSession, TargetID: sessionID}, err)
+	return err
+}
+
+func (s *AuthService) logout(ctx context.Context, userID, sessionID primitive.ObjectID) error {
+	if err := s.refreshTokenStore.Delete(ctx, userID, sessionID); err != nil {
+		return err
+	}
+
+	if _, err := s.userStore.RemoveSession(ctx, userID, sessionID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *AuthService) LogoutAll(ctx context.Context, userID primitive.ObjectID) error {
+	err := s.logoutAll(ctx, userID)
+	s.audit(ctx, auditUser(auth.AuditActionLogoutAll, userID), err)
+	return err
+}
+
+func (s *AuthService) logoutAll(ctx context.Context, userID primitive.ObjectID) error {
 	if err := s.userStore.ClearSessions(ctx, userID); err != nil {
 		return err
 	}
@@ -135,14 +497,104 @@ func (s *AuthService) Logout(ctx context.Context, userID primitive.ObjectID) err
 	return nil
 }
 
-func (s *AuthService) RefreshAccess(ctx context.Context, refreshToken auth.RefreshToken) (auth.User, auth.Tokens, error) {
+func (s *AuthService) Sessions(ctx context.Context, userID, currentSessionID primitive.ObjectID) ([]auth.Session, error) {
+	user, err := s.userStore.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshTokens, err := s.refreshTokenStore.FindByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshTokensByID := make(map[primitive.ObjectID]auth.RefreshToken, len(refreshTokens))
+	for _, refreshToken := range refreshTokens {
+		refreshTokensByID[refreshToken.SessionID] = refreshToken
+	}
+
+	sessions := make([]auth.Session, 0, len(user.Sessions))
+	for _, sessionID := range user.Sessions {
+		refreshToken, ok := refreshTokensByID[sessionID]
+		if !ok {
+			continue
+		}
+		session := auth.Session{
+			ID:         sessionID,
+			UserAgent:  refreshToken.UserAgent,
+			IPAddress:  refreshToken.IPAddress,
+			CreatedAt:  refreshToken.CreatedAt,
+			LastSeenAt: refreshToken.LastSeenAt,
+			IssuedAt:   refreshToken.IssuedAt,
+			ExpiresAt:  refreshToken.ExpiresAt,
+			Current:    sessionID == currentSessionID,
+		}
+		if refreshToken.Impersonating() {
+			session.ImpersonatedBy = &refreshToken.Actor
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (s *AuthService) RevokeSession(ctx context.Context, userID, sessionID primitive.ObjectID) (err error) {
+	defer func() {
+		s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionRevokeSession, ActorID: userID, TargetType: auth.AuditTargetSession, TargetID: sessionID}, err)
+	}()
+
+	user, err := s.userStore.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	var found bool
+	for _, id := range user.Sessions {
+		if id == sessionID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return common.NewErr("cannot find session", common.ErrCodeNotFound)
+	}
+
+	return s.logout(ctx, userID, sessionID)
+}
+
+func (s *AuthService) CheckRefreshToken(ctx context.Context, refreshToken auth.RefreshToken) error {
+	storedToken, err := s.refreshTokenStore.FindByID(ctx, refreshToken.SessionID)
+	if err != nil {
+		if err, ok := err.(common.ErrCodeProvider); ok && err.Code() == common.ErrCodeNotFound {
+			return auth.ErrInvalidSession
+		}
+		return err
+	}
+
+	if storedToken.Consumed {
+		return s.revokeSessionFamily(ctx, storedToken)
+	}
+	return nil
+}
+
+func (s *AuthService) RefreshAccess(ctx context.Context, refreshToken auth.RefreshToken) (user auth.User, tokens auth.Tokens, err error) {
 	now := time.Now()
 
-	if err := s.refreshTokenStore.Consume(ctx, refreshToken.SessionID); err != nil {
-		return auth.User{}, auth.Tokens{}, err
+	defer func() {
+		s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionRefresh, ActorID: refreshToken.UserID, TargetType: auth.AuditTargetSession, TargetID: refreshToken.SessionID}, err)
+	}()
+
+	consumedToken, err := s.refreshTokenStore.Consume(ctx, refreshToken.SessionID)
+	if err != nil {
+		if err != auth.ErrSessionExpired {
+			return auth.User{}, auth.Tokens{}, err
+		}
+		if err := s.CheckRefreshToken(ctx, refreshToken); err != nil {
+			return auth.User{}, auth.Tokens{}, err
+		}
+		return auth.User{}, auth.Tokens{}, auth.ErrSessionExpired
 	}
 
-	user, tokens, err := s.makeSession(ctx, refreshToken.UserID, refreshToken.SessionID, now)
+	user, tokens, err = s.makeSession(ctx, consumedToken.UserID, consumedToken.Actor, consumedToken, now)
 	if err != nil {
 		return auth.User{}, auth.Tokens{}, err
 	}
@@ -150,10 +602,56 @@ func (s *AuthService) RefreshAccess(ctx context.Context, refreshToken auth.Refre
 	return user, tokens, nil
 }
 
+// revokeSessionFamily is called when an already consumed refresh token is presented again,
+// which means it was most likely copied. every session descended from the same login is revoked
+func (s *AuthService) revokeSessionFamily(ctx context.Context, reusedToken auth.RefreshToken) error {
+	familyID := reusedToken.FamilyID
+	if familyID.IsZero() {
+		// a session from before families were tracked, its descendants are named after it
+		familyID = reusedToken.SessionID
+	}
+
+	logger := s.logger.With(
+		common.LoggerFieldUserID, reusedToken.UserID.Hex(),
+		common.LoggerFieldSessionID, reusedToken.SessionID.Hex(),
+		common.LoggerFieldFamilyID, familyID.Hex(),
+	)
+
+	sessionIDs, err := s.refreshTokenStore.DeleteByFamilyID(ctx, familyID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.userStore.RemoveSessions(ctx, reusedToken.UserID, sessionIDs); err != nil {
+		return err
+	}
+
+	logger.With("revoked_sessions", len(sessionIDs)).Warn("refresh token reuse detected, revoked session family")
+	return auth.ErrSessionRevoked
+}
+
+// SweepSessions removes the user sessions whose refresh token has expired or was deleted
+func (s *AuthService) SweepSessions(ctx context.Context) (int, error) {
+	staleSessions, err := s.userStore.FindStaleSessions(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for userID, sessionIDs := range staleSessions {
+		if err := s.userStore.RemoveSessions(ctx, userID, sessionIDs); err != nil {
+			return count, err
+		}
+		count += len(sessionIDs)
+	}
+	return count, nil
+}
+
 func (s *AuthService) ParseToken(payload string, claims jwt.Claims) error {
-	_, err := jwt.ParseWithClaims(payload, claims, s.tokenKeyFunc)
+	_, err := jwt.ParseWithClaims(payload, claims, s.keyring.KeyFunc)
 	if err != nil {
-		if err.Error() == "signature is invalid" {
+		var validationErr *jwt.ValidationError
+		if errors.As(err, &validationErr) && validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
 			return auth.ErrInvalidSignature
 		}
 		return auth.ErrMalformedToken
@@ -163,44 +661,90 @@ func (s *AuthService) ParseToken(payload string, claims jwt.Claims) error {
 			return auth.ErrInvalidToken(err)
 		}
 	}
+	if token, ok := claims.(auth.Token); ok {
+		return s.verifyTokenClaims(payload, token)
+	}
+	return nil
+}
+
+// verifyTokenClaims checks the claims every token shares, these are read
+// from the payload again as the token's own claims only keep what it uses
+func (s *AuthService) verifyTokenClaims(payload string, token auth.Token) error {
+	var claims auth.TokenClaims
+	if _, _, err := new(jwt.Parser).ParseUnverified(payload, &claims); err != nil {
+		return auth.ErrMalformedToken
+	}
+	if err := claims.Verify(token, s.jwtIssuer, time.Now(), s.jwtLeeway); err != nil {
+		return auth.ErrInvalidToken(err)
+	}
 	return nil
 }
 
 func (s *AuthService) SignToken(claims jwt.Claims) (string, error) {
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.jwtSecret)
+	return s.keyring.Sign(claims)
 }
 
-func (s *AuthService) tokenKeyFunc(token *jwt.Token) (interface{}, error) {
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-		return nil, fmt.Errorf("%v is an unsupported signing method", token.Header["alg"])
-	}
-	return []byte(s.jwtSecret), nil
+func (s *AuthService) SignUserToken(user auth.User) (string, error) {
+	return s.SignToken(&auth.UserToken{user, s.jwtIssuer, time.Now()})
 }
 
-func (s *AuthService) makeSession(ctx context.Context, userID primitive.ObjectID, prevSessionID primitive.ObjectID, now time.Time) (auth.User, auth.Tokens, error) {
+// JWKS lists the public keys tokens can be verified with
+func (s *AuthService) JWKS() auth.JWKS {
+	return s.keyring.JWKS()
+}
+
+// makeSession starts a session for the user, an actor makes it an impersonation.
+// A session being refreshed is replaced and passes on its family and creation time
+func (s *AuthService) makeSession(ctx context.Context, userID, actorID primitive.ObjectID, prev auth.RefreshToken, now time.Time) (auth.User, auth.Tokens, error) {
 	sessionID := primitive.NewObjectID()
+	prevSessionID := prev.SessionID
+
+	familyID := prev.FamilyID
+	if prevSessionID.IsZero() {
+		familyID = primitive.NewObjectID()
+	} else if familyID.IsZero() {
+		// sessions from before families were tracked start one named after
+		// themselves so their reuse can still be traced to their descendants
+		familyID = prevSessionID
+	}
 
 	accessToken := s.makeAccessToken(sessionID, userID, now)
-	refreshToken := s.makeRefreshToken(accessToken)
-
-	// TODO: make this a transaction
-	if err := s.refreshTokenStore.Insert(ctx, refreshToken); err != nil {
-		return auth.User{}, auth.Tokens{}, err
+	accessToken.Actor = actorID
+	refreshToken := s.makeRefreshToken(accessToken, familyID)
+
+	client := ctxSessionClient(ctx)
+	refreshToken.UserAgent = client.UserAgent
+	refreshToken.IPAddress = client.IPAddress
+	if !prev.CreatedAt.IsZero() {
+		refreshToken.CreatedAt = prev.CreatedAt
 	}
 
-	user, err := s.userStore.AddSession(ctx, userID, sessionID)
-	if err != nil {
-		return auth.User{}, auth.Tokens{}, err
-	}
+	var user auth.User
+	if err := s.transactor.WithTransaction(ctx, func(ctx context.Context, tx *mongodb.Tx) error {
+		if err := s.refreshTokenStore.Insert(ctx, refreshToken); err != nil {
+			return err
+		}
+		tx.OnAbort(func(ctx context.Context) error { return s.refreshTokenStore.Delete(ctx, userID, sessionID) })
 
-	if !prevSessionID.IsZero() {
-		user, err = s.userStore.RemoveSession(ctx, userID, prevSessionID)
+		var err error
+		user, err = s.userStore.AddSession(ctx, userID, sessionID)
 		if err != nil {
-			return auth.User{}, auth.Tokens{}, err
+			return err
+		}
+		tx.OnAbort(func(ctx context.Context) error {
+			_, err := s.userStore.RemoveSession(ctx, userID, sessionID)
+			return err
+		})
+
+		if !prevSessionID.IsZero() {
+			user, err = s.userStore.RemoveSession(ctx, userID, prevSessionID)
 		}
+		return err
+	}); err != nil {
+		return auth.User{}, auth.Tokens{}, err
 	}
 
-	return user, auth.Tokens{accessToken, refreshToken}, nil
+	return user, auth.Tokens{accessToken, refreshToken, nil}, nil
 }
 
 func (s *AuthService) makeAccessToken(sessionID, userID primitive.ObjectID, issuedAt time.Time) auth.AccessToken {
@@ -208,13 +752,13 @@ func (s *AuthService) makeAccessToken(sessionID, userID primitive.ObjectID, issu
 		SessionID: sessionID,
 		UserID:    userID,
 		Issuer:    s.jwtIssuer,
-		Audience:  []string{audAPIAdminV1},
+		Audience:  []string{auth.AudienceAdminAPI},
 		IssuedAt:  issuedAt,
 		ExpiresAt: issuedAt.Add(s.jwtDurationAccess),
 	}
 }
 
-func (s *AuthService) makeRefreshToken(accessToken auth.AccessToken) auth.RefreshToken {
+func (s *AuthService) makeRefreshToken(accessToken auth.AccessToken, familyID primitive.ObjectID) auth.RefreshToken {
 	return auth.RefreshToken{
 		AccessToken: auth.AccessToken{
 			SessionID: accessToken.SessionID,
@@ -223,45 +767,58 @@ func (s *AuthService) makeRefreshToken(accessToken auth.AccessToken) auth.Refres
 			Audience:  accessToken.Audience,
 			IssuedAt:  accessToken.IssuedAt,
 			ExpiresAt: accessToken.IssuedAt.Add(s.jwtDurationRefresh),
+			Actor:     accessToken.Actor,
 		},
+		FamilyID:   familyID,
+		CreatedAt:  accessToken.IssuedAt,
+		LastSeenAt: accessToken.IssuedAt,
 	}
 }
 
-type passwordOptions struct {
-	digestType    string
-	hashKeyLength int
-	hashRounds    int
-}
+func (s *AuthService) verifyPassword(ctx context.Context, creds auth.Credentials) (auth.Password, error) {
+	password, err := s.passwordStore.FindByUsername(ctx, creds.Username)
+	if err != nil {
+		return auth.Password{}, err
+	}
+
+	hasher := s.passwordHasher
+	if password.HashAlgorithm() != hasher.Algorithm() {
+		hasher = NewPasswordHasher(common.PasswordHashConfig{Algorithm: password.HashAlgorithm()}, s.passwordSalt)
+	}
 
-func (s *AuthService) makePassword(salt []byte, credentials auth.Credentials, opts passwordOptions) (auth.Password, error) {
-	digestType := opts.digestType
-	if digestType == auth.DigestTypeEmpty {
-		digestType = auth.DigestTypeSHA256
+	ok, err := hasher.Verify(password, creds.Password)
+	if err != nil {
+		return auth.Password{}, err
+	}
+	if !ok {
+		return auth.Password{}, common.NewErr("invalid password", common.ErrCodeBadRequest)
 	}
+	return password, nil
+}
 
-	hashKeyLength := opts.hashKeyLength
-	if hashKeyLength == 0 {
-		hashKeyLength = defaultHashKeyLength
+// rehashPassword upgrades a verified password to the current hash settings,
+// failing to do so is not fatal since the old hash remains valid
+func (s *AuthService) rehashPassword(ctx context.Context, userID primitive.ObjectID, creds auth.Credentials) {
+	password, err := s.makeSaltedPassword(creds)
+	if err == nil {
+		err = s.passwordStore.UpdatePassword(ctx, password)
 	}
+	if err != nil {
+		s.logger.With(common.LoggerFieldUserID, userID.Hex()).Warnf("failed to rehash password: %s", err)
+		return
+	}
+	s.logger.With(common.LoggerFieldUserID, userID.Hex()).Infof("rehashed password with %s", password.HashAlgorithm())
+}
 
-	hashRounds := opts.hashRounds
-	if hashRounds == 0 {
-		hashRounds = defaultHashRounds
+func (s *AuthService) makeSaltedPassword(creds auth.Credentials) (auth.Password, error) {
+	randomSalt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(randomSalt); err != nil {
+		return auth.Password{}, common.WrapErr(fmt.Errorf("cannot make password: %s", err), common.ErrCodeServer)
 	}
 
-	password := auth.Password{
-		Username: credentials.Username,
-		Salt:     primitive.Binary{Data: salt},
-		HashedPassword: primitive.Binary{Data: []byte(hex.EncodeToString(pbkdf2.Key(
-			[]byte(credentials.Password),
-			append(s.passwordSalt, salt...),
-			hashRounds,
-			hashKeyLength,
-			auth.DigestHash(digestType),
-		)))},
-		Iterations: hashRounds,
-		KeyLength:  hashKeyLength,
-		DigestType: digestType,
+	password, err := s.passwordHasher.Hash(creds, randomSalt)
+	if err != nil {
+		return auth.Password{}, err
 	}
 
 	if err := password.Validate(); err != nil {
@@ -269,3 +826,44 @@ func (s *AuthService) makePassword(salt []byte, credentials auth.Credentials, op
 	}
 	return password, nil
 }
+
+func (s *AuthService) sendVerification(ctx context.Context, user auth.User) error {
+	now := time.Now()
+
+	token, err := s.SignToken(&auth.VerificationToken{
+		UserID:    user.ID,
+		Email:     user.Email,
+		Issuer:    s.jwtIssuer,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.verificationTTL),
+	})
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to sign verification token: %s", err), common.ErrCodeServer)
+	}
+
+	return s.sendMail(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nPlease verify your email by visiting the link below:\n\n%s\n",
+			user.Name,
+			s.makeLink(linkPathVerifyEmail, token),
+		),
+	})
+}
+
+func (s *AuthService) sendMail(ctx context.Context, msg mail.Message) error {
+	if err := s.mailer.Send(ctx, msg); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to send mail: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
+
+func (s *AuthService) makeLink(path, token string) string {
+	return s.linkBaseURL + path + "?" + url.Values{"token": {token}}.Encode()
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CreateAPIKey makes a new key for the user, the key itself is only
+// returned here since just the hash of its secret is stored
+func (s *AuthService) CreateAPIKey(ctx context.Context, userID primitive.ObjectID, create auth.APIKeyCreate) (_ auth.NewAPIKey, err error) {
+	event := auth.AuditEvent{Action: auth.AuditActionCreateAPIKey, ActorID: userID, TargetType: auth.AuditTargetAPIKey}
+	defer func() { s.audit(ctx, event, err) }()
+
+	secret, err := auth.NewAPIKeySecret()
+	if err != nil {
+		return auth.NewAPIKey{}, common.WrapErr(fmt.Errorf("cannot make api key: %s", err), common.ErrCodeServer)
+	}
+
+	apiKey := auth.APIKey{
+		UserID:    userID,
+		Name:      create.Name,
+		Scopes:    create.Scopes,
+		HashedKey: hashToken(secret),
+		CreatedAt: time.Now(),
+		ExpiresAt: create.ExpiresAt,
+	}
+	if err := apiKey.Validate(); err != nil {
+		return auth.NewAPIKey{}, common.WrapErr(fmt.Errorf("failed to make api key: %s", err), common.ErrCodeBadRequest)
+	}
+	event.TargetID = apiKey.ID
+
+	if err := s.apiKeyStore.Insert(ctx, apiKey); err != nil {
+		return auth.NewAPIKey{}, err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, userID.Hex()).Infof("created api key %s", apiKey.ID.Hex())
+
+	return auth.NewAPIKey{apiKey, auth.FormatAPIKey(apiKey.ID, secret)}, nil
+}
+
+func (s *AuthService) APIKeys(ctx context.Context, userID primitive.ObjectID) ([]auth.APIKey, error) {
+	return s.apiKeyStore.FindByUserID(ctx, userID)
+}
+
+func (s *AuthService) RevokeAPIKey(ctx context.Context, userID, id primitive.ObjectID) (err error) {
+	defer func() {
+		s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionRevokeAPIKey, ActorID: userID, TargetType: auth.AuditTargetAPIKey, TargetID: id}, err)
+	}()
+
+	if err := s.apiKeyStore.Delete(ctx, userID, id); err != nil {
+		return err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, userID.Hex()).Infof("revoked api key %s", id.Hex())
+
+	return nil
+}
+
+// CheckAPIKey finds the key's owner, failing the same way for unknown
+// keys and wrong secrets so neither can be told apart
+func (s *AuthService) CheckAPIKey(ctx context.Context, key string) (auth.APIKey, auth.User, error) {
+	apiKey, err := s.findAPIKey(ctx, key)
+	if err != nil {
+		return auth.APIKey{}, auth.User{}, err
+	}
+
+	now := time.Now()
+	if apiKey.Expired(now) {
+		return auth.APIKey{}, auth.User{}, auth.ErrAPIKeyExpired
+	}
+
+	user, err := s.userStore.FindByID(ctx, apiKey.UserID)
+	if err != nil {
+		return auth.APIKey{}, auth.User{}, err
+	}
+	if user.Deleted() {
+		return auth.APIKey{}, auth.User{}, auth.ErrInvalidAPIKey
+	}
+
+	if err := s.apiKeyStore.MarkUsed(ctx, apiKey.ID, now); err != nil {
+		s.logger.With(common.LoggerFieldUserID, user.ID.Hex()).Warnf("failed to mark api key used: %s", err)
+	}
+
+	return apiKey, user, nil
+}
+
+func (s *AuthService) findAPIKey(ctx context.Context, key string) (auth.APIKey, error) {
+	id, secret, err := auth.ParseAPIKey(key)
+	if err != nil {
+		return auth.APIKey{}, err
+	}
+
+	apiKey, err := s.apiKeyStore.FindByID(ctx, id)
+	if err != nil {
+		if err, ok := err.(common.ErrCodeProvider); ok && err.Code() == common.ErrCodeNotFound {
+			return auth.APIKey{}, auth.ErrInvalidAPIKey
+		}
+		return auth.APIKey{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(apiKey.HashedKey), []byte(hashToken(secret))) != 1 {
+		return auth.APIKey{}, auth.ErrInvalidAPIKey
+	}
+	return apiKey, nil
+}
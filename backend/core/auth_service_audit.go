@@ -0,0 +1,95 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type auditSourceKey struct{}
+
+type auditImpersonatorKey struct{}
+
+type auditSource struct {
+	ipAddress string
+	requestID string
+}
+
+// AttachAuditSource keeps where a request came from so the
+// audit events recorded while serving it can tell
+func AttachAuditSource(ctx context.Context, ipAddress, requestID string) context.Context {
+	return context.WithValue(ctx, auditSourceKey{}, auditSource{ipAddress, requestID})
+}
+
+// AttachAuditImpersonator names the admin impersonating the request's
+// user on the audit events recorded while serving it
+func AttachAuditImpersonator(ctx context.Context, impersonatorID primitive.ObjectID) context.Context {
+	return context.WithValue(ctx, auditImpersonatorKey{}, impersonatorID)
+}
+
+// AuditEvents finds a page of audit events, fetching one more than the
+// limit tells whether there is another page after this one
+func (s *AuthService) AuditEvents(ctx context.Context, query auth.AuditQuery) (auth.AuditPage, error) {
+	if query.Limit <= 0 {
+		query.Limit = auth.AuditQueryDefaultLimit
+	}
+	if query.Limit > auth.AuditQueryMaxLimit {
+		query.Limit = auth.AuditQueryMaxLimit
+	}
+	limit := query.Limit
+	query.Limit++
+
+	events, err := s.auditStore.Find(ctx, query)
+	if err != nil {
+		return auth.AuditPage{}, err
+	}
+
+	page := auth.AuditPage{Events: events}
+	if len(events) > limit {
+		page.Events = events[:limit]
+		page.Next = page.Events[limit-1].ID.Hex()
+	}
+	return page, nil
+}
+
+// audit records the outcome of an operation, failing to record it never fails the operation
+func (s *AuthService) audit(ctx context.Context, event auth.AuditEvent, opErr error) {
+	if s.auditStore == nil {
+		return
+	}
+
+	now := time.Now()
+
+	event.ID = primitive.NewObjectID()
+	event.Outcome = auth.AuditOutcome(opErr)
+	if opErr != nil {
+		event.Error = opErr.Error()
+	}
+	if source, ok := ctx.Value(auditSourceKey{}).(auditSource); ok {
+		event.IPAddress = source.ipAddress
+		event.RequestID = source.requestID
+	}
+	if impersonatorID, ok := ctx.Value(auditImpersonatorKey{}).(primitive.ObjectID); ok {
+		event.ImpersonatorID = impersonatorID
+	}
+	event.CreatedAt = now
+	event.ExpiresAt = now.Add(s.auditRetention)
+
+	if err := s.auditStore.Insert(ctx, event); err != nil {
+		s.logger.With(common.LoggerFieldUserID, event.ActorID.Hex()).Warnf("failed to record %s audit event: %s", event.Action, err)
+	}
+}
+
+// auditUser is the event for a user acting on their own account
+func auditUser(action string, userID primitive.ObjectID) auth.AuditEvent {
+	return auth.AuditEvent{
+		Action:     action,
+		ActorID:    userID,
+		TargetType: auth.AuditTargetUser,
+		TargetID:   userID,
+	}
+}
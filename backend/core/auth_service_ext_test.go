@@ -7,9 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/cookiejar"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/shake-on-it/app-tmpl/backend/api"
 	"github.com/shake-on-it/app-tmpl/backend/auth"
 	"github.com/shake-on-it/app-tmpl/backend/common"
 	"github.com/shake-on-it/app-tmpl/backend/common/test"
@@ -118,6 +121,9 @@ func TestAuthServiceMultiSession(t *testing.T) {
 		for _, cookie := range authCookies[oldSession] {
 			req.AddCookie(cookie)
 		}
+		if cookie, ok := authCookies[oldSession][auth.CookieCSRFToken]; ok {
+			req.Header.Set(api.HeaderXAPP+api.HeaderCSRFToken, cookie.Value)
+		}
 
 		res, err := httpClient.Do(req)
 		if err != nil {
@@ -214,33 +220,107 @@ func TestAuthServiceMultiSession(t *testing.T) {
 		})
 	})
 
-	t.Run("should be able to logout from one session", func(t *testing.T) {
+	doDelete := func(session, path string) (int, error) {
 		req, err := http.NewRequest(
 			http.MethodDelete,
-			th.Config.Server.BaseURL+"/api/admin/v1/user/session",
+			th.Config.Server.BaseURL+path,
+			nil,
+		)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, cookie := range authCookies[session] {
+			req.AddCookie(cookie)
+		}
+		if cookie, ok := authCookies[session][auth.CookieCSRFToken]; ok {
+			req.Header.Set(api.HeaderXAPP+api.HeaderCSRFToken, cookie.Value)
+		}
+
+		res, err := httpClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, cookie := range res.Cookies() {
+			authCookies[session][cookie.Name] = cookie
+		}
+		return res.StatusCode, nil
+	}
+
+	t.Run("should be able to list sessions", func(t *testing.T) {
+		req, err := http.NewRequest(
+			http.MethodGet,
+			th.Config.Server.BaseURL+"/api/admin/v1/user/sessions",
 			nil,
 		)
 		assert.Nil(t, err)
 
-		for _, cookie := range authCookies["s3"] {
+		for _, cookie := range authCookies["s1"] {
 			req.AddCookie(cookie)
 		}
 
 		res, err := httpClient.Do(req)
 		assert.Nil(t, err)
 		assert.Equal(t, res.StatusCode, http.StatusOK)
+		defer res.Body.Close()
 
-		for _, cookie := range res.Cookies() {
-			authCookies["s3"][cookie.Name] = cookie
+		var sessions []auth.Session
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&sessions))
+		assert.Equal(t, len(sessions), 3)
+
+		var currentCount int
+		for _, session := range sessions {
+			if session.Current {
+				currentCount++
+			}
 		}
+		assert.Equal(t, currentCount, 1)
+	})
 
-		t.Run("and should invalidate all other sessions", func(t *testing.T) {
-			assert.Equal(t, getWhoami("s1"), errInvalidSession)
-			assert.Equal(t, getWhoami("s2_new"), errInvalidSession)
+	t.Run("should be able to logout from one session", func(t *testing.T) {
+		status, err := doDelete("s3", "/api/admin/v1/user/session")
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusOK)
+
+		t.Run("and should keep all other sessions", func(t *testing.T) {
+			assert.Nil(t, getWhoami("s1"))
+			assert.Nil(t, getWhoami("s2_new"))
 			assert.Equal(t, getWhoami("s3"), errMustAuthenticate)
 		})
 	})
 
+	t.Run("should be able to revoke another session", func(t *testing.T) {
+		var s2Session auth.AccessToken
+		assert.Nil(t, th.APIServer.AdminAPI.AuthService.ParseToken(authCookies["s2_new"][auth.CookieAccessToken].Value, &s2Session))
+
+		status, err := doDelete("s1", "/api/admin/v1/user/sessions/"+s2Session.SessionID.Hex())
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusNoContent)
+
+		assert.Nil(t, getWhoami("s1"))
+		assert.Equal(t, getWhoami("s2_new"), errInvalidSession)
+
+		t.Run("but not twice", func(t *testing.T) {
+			status, err := doDelete("s1", "/api/admin/v1/user/sessions/"+s2Session.SessionID.Hex())
+			assert.Nil(t, err)
+			assert.Equal(t, status, http.StatusNotFound)
+		})
+	})
+
+	t.Run("should be able to logout from all sessions", func(t *testing.T) {
+		assert.Nil(t, doLogin("s2"))
+
+		status, err := doDelete("s1", "/api/admin/v1/user/sessions")
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusOK)
+
+		t.Run("and should invalidate all other sessions", func(t *testing.T) {
+			assert.Equal(t, getWhoami("s1"), errMustAuthenticate)
+			assert.Equal(t, getWhoami("s2"), errInvalidSession)
+		})
+	})
+
 	t.Run("should fail if user token signature is invalid", func(t *testing.T) {
 		assert.Nil(t, doLogin("s1"))
 
@@ -459,3 +539,258 @@ func TestAuthServiceMultiSession(t *testing.T) {
 		}
 	})
 }
+
+func TestAuthServiceBearerTokens(t *testing.T) {
+	th := test.NewHarness(t)
+	defer th.Close()
+
+	var httpClient http.Client
+
+	doRequest := func(method, path, token string, body interface{}, out interface{}) (int, error) {
+		var reqBody bytes.Buffer
+		if body != nil {
+			if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+				return 0, err
+			}
+		}
+
+		req, err := http.NewRequest(method, th.Config.Server.BaseURL+path, &reqBody)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("X-APP-Auth-Mode", "token")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := httpClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer res.Body.Close()
+
+		if len(res.Cookies()) > 0 {
+			return 0, errors.New("should not set cookies for bearer clients")
+		}
+		if out != nil {
+			if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+				return 0, err
+			}
+		}
+		return res.StatusCode, nil
+	}
+
+	assert.Nil(t, th.CreateUser("bearer_user"))
+
+	var tokens auth.TokenResponse
+	t.Run("should return tokens in the response body when logging in", func(t *testing.T) {
+		status, err := doRequest(http.MethodPost, "/api/admin/v1/user/session", "", auth.Credentials{"bearer_user", "p@sSw0rd"}, &tokens)
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusCreated)
+		assert.Equal(t, tokens.TokenType, auth.TokenTypeBearer)
+		assert.Equal(t, tokens.User.Name, "bearer_user")
+		assert.True(t, tokens.AccessToken != "")
+		assert.True(t, tokens.RefreshToken != "")
+	})
+
+	t.Run("should be able to make requests with the access token", func(t *testing.T) {
+		var user auth.User
+		status, err := doRequest(http.MethodGet, "/api/admin/v1/user", tokens.AccessToken, nil, &user)
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusOK)
+		assert.Equal(t, user.Name, "bearer_user")
+	})
+
+	t.Run("should not accept the refresh token in place of the access token", func(t *testing.T) {
+		var errRes common.ErrResponse
+		status, err := doRequest(http.MethodGet, "/api/admin/v1/user", tokens.RefreshToken, nil, &errRes)
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusUnauthorized)
+		assert.Equal(t, errRes.Message, "invalid token: token has wrong type")
+	})
+
+	t.Run("should be able to refresh access with the refresh token", func(t *testing.T) {
+		var refreshed auth.TokenResponse
+		status, err := doRequest(http.MethodPut, "/api/admin/v1/user/session", tokens.RefreshToken, nil, &refreshed)
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusCreated)
+
+		var user auth.User
+		status, err = doRequest(http.MethodGet, "/api/admin/v1/user", refreshed.AccessToken, nil, &user)
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusOK)
+
+		t.Run("and the previous access token should no longer work", func(t *testing.T) {
+			var errRes common.ErrResponse
+			status, err := doRequest(http.MethodGet, "/api/admin/v1/user", tokens.AccessToken, nil, &errRes)
+			assert.Nil(t, err)
+			assert.Equal(t, status, http.StatusUnauthorized)
+			assert.Equal(t, errRes, errInvalidSession)
+		})
+	})
+
+	t.Run("should be able to use an api key on routes that accept one", func(t *testing.T) {
+		var session auth.TokenResponse
+		status, err := doRequest(http.MethodPost, "/api/admin/v1/user/session", "", auth.Credentials{"bearer_user", "p@sSw0rd"}, &session)
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusCreated)
+
+		var apiKey auth.NewAPIKey
+		status, err = doRequest(http.MethodPost, "/api/admin/v1/user/api_keys", session.AccessToken, auth.APIKeyCreate{Name: "script"}, &apiKey)
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusCreated)
+
+		var user auth.User
+		status, err = doRequest(http.MethodGet, "/api/admin/v1/user", apiKey.Key, nil, &user)
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusOK)
+		assert.Equal(t, user.Name, "bearer_user")
+
+		var errRes common.ErrResponse
+		status, err = doRequest(http.MethodDelete, "/api/admin/v1/user/api_keys/"+apiKey.ID.Hex(), apiKey.Key, nil, &errRes)
+		assert.Nil(t, err)
+		assert.Equal(t, status, http.StatusForbidden)
+	})
+}
+
+func TestAuthServiceOAuth(t *testing.T) {
+	fakeProvider := u.NewOIDCProvider(t)
+	defer fakeProvider.Close()
+
+	th := test.NewHarnessWithOptions(t, test.HarnessOptions{Config: common.Config{
+		Auth: common.AuthConfig{
+			OIDCProviders: []common.OIDCProviderConfig{
+				{"fake", fakeProvider.URL, u.OIDCClientID, u.OIDCClientSecret, nil},
+			},
+		},
+	}})
+	defer th.Close()
+
+	// doLogin follows the redirects through the provider and back until the user returns to the app
+	doLogin := func(user u.OIDCUser) (*http.Client, *http.Response, error) {
+		fakeProvider.SetUser(user)
+
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		client := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !strings.HasPrefix(req.URL.Path, "/api/") && !strings.HasPrefix(req.URL.String(), fakeProvider.URL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		}}
+
+		res, err := client.Get(th.Config.Server.BaseURL + "/api/admin/v1/oauth/fake")
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, res, nil
+	}
+
+	getWhoami := func(client *http.Client) (auth.User, error) {
+		res, err := client.Get(th.Config.Server.BaseURL + "/api/admin/v1/user")
+		if err != nil {
+			return auth.User{}, err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return auth.User{}, fmt.Errorf("unexpected status: %s", res.Status)
+		}
+
+		var user auth.User
+		err = json.NewDecoder(res.Body).Decode(&user)
+		return user, err
+	}
+
+	var createdUser auth.User
+	t.Run("should create a verified user on their first login", func(t *testing.T) {
+		client, res, err := doLogin(u.OIDCUser{"subject-1", "oidc_user@domain.com", true, "Oidc User", "oidc_user"})
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusFound)
+		assert.Equal(t, res.Header.Get("Location"), th.Config.Auth.OAuthReturnURL)
+
+		createdUser, err = getWhoami(client)
+		assert.Nil(t, err)
+		assert.Equal(t, createdUser.Name, "oidc_user")
+		assert.Equal(t, createdUser.Email, "oidc_user@domain.com")
+		assert.Equal(t, createdUser.Status, auth.UserStatusVerified)
+	})
+
+	t.Run("should login the same user again", func(t *testing.T) {
+		client, res, err := doLogin(u.OIDCUser{"subject-1", "changed@domain.com", true, "Oidc User", "changed"})
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusFound)
+
+		user, err := getWhoami(client)
+		assert.Nil(t, err)
+		assert.Equal(t, user.ID, createdUser.ID)
+	})
+
+	t.Run("should pick another name when the user's name is taken", func(t *testing.T) {
+		client, res, err := doLogin(u.OIDCUser{"subject-2", "other@domain.com", true, "Other User", "oidc_user"})
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusFound)
+
+		user, err := getWhoami(client)
+		assert.Nil(t, err)
+		assert.True(t, user.ID != createdUser.ID)
+		assert.True(t, strings.HasPrefix(user.Name, "oidc_user_"))
+	})
+
+	t.Run("should link an existing verified user by their email", func(t *testing.T) {
+		assert.Nil(t, th.CreateUser("linked_user"))
+		linkedUser, err := th.APIServer.AdminAPI.UserStore.FindByName(context.Background(), "linked_user")
+		assert.Nil(t, err)
+		_, err = th.APIServer.AdminAPI.UserStore.MarkVerified(context.Background(), linkedUser.ID)
+		assert.Nil(t, err)
+
+		client, res, err := doLogin(u.OIDCUser{"subject-3", "linked_user@domain.com", true, "Linked User", ""})
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusFound)
+
+		user, err := getWhoami(client)
+		assert.Nil(t, err)
+		assert.Equal(t, user.ID, linkedUser.ID)
+		assert.Equal(t, user.Identities, []auth.Identity{{Provider: "fake"}})
+	})
+
+	t.Run("should not link an unverified user", func(t *testing.T) {
+		assert.Nil(t, th.CreateUser("unverified_user"))
+
+		_, res, err := doLogin(u.OIDCUser{"subject-4", "unverified_user@domain.com", true, "Unverified User", ""})
+		assert.Nil(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusForbidden)
+	})
+
+	t.Run("should not create a user without a verified email", func(t *testing.T) {
+		_, res, err := doLogin(u.OIDCUser{"subject-5", "unknown@domain.com", false, "Unknown User", ""})
+		assert.Nil(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusBadRequest)
+	})
+
+	t.Run("should fail the callback without the oauth state", func(t *testing.T) {
+		res, err := http.Get(th.Config.Server.BaseURL + "/api/admin/v1/oauth/fake/callback?code=code&state=state")
+		assert.Nil(t, err)
+		defer res.Body.Close()
+
+		var errRes common.ErrResponse
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&errRes))
+		assert.Equal(t, res.StatusCode, http.StatusUnauthorized)
+		assert.Equal(t, errRes.Message, auth.ErrInvalidOAuthState.Error())
+	})
+
+	t.Run("should fail to login with an unknown provider", func(t *testing.T) {
+		res, err := http.Get(th.Config.Server.BaseURL + "/api/admin/v1/oauth/unknown")
+		assert.Nil(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusNotFound)
+	})
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Impersonate swaps the admin's session for one as the user so they see the app the way
+// the user does, the session's act claim keeps naming the admin until it is ended
+func (s *AuthService) Impersonate(ctx context.Context, actorToken auth.AccessToken, userID primitive.ObjectID) (user auth.User, tokens auth.Tokens, err error) {
+	defer func() {
+		s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionImpersonate, ActorID: actorToken.UserID, TargetType: auth.AuditTargetUser, TargetID: userID}, err)
+	}()
+
+	if actorToken.Impersonating() {
+		return auth.User{}, auth.Tokens{}, auth.ErrImpersonating
+	}
+	if userID == actorToken.UserID {
+		return auth.User{}, auth.Tokens{}, common.NewErr("cannot impersonate yourself", common.ErrCodeBadRequest)
+	}
+
+	target, err := s.userStore.FindByID(ctx, userID)
+	if err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+	// admins are never impersonated so impersonating cannot gain access the admin lacks
+	if target.Deleted() || target.Admin() {
+		return auth.User{}, auth.Tokens{}, auth.ErrCannotImpersonate
+	}
+
+	if err := s.logout(ctx, actorToken.UserID, actorToken.SessionID); err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+
+	user, tokens, err = s.makeSession(ctx, target.ID, actorToken.UserID, auth.RefreshToken{}, time.Now())
+	if err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, actorToken.UserID.Hex()).Infof("started impersonating user %s", target.ID.Hex())
+
+	return user, tokens, nil
+}
+
+// EndImpersonation ends the impersonated session and gives the admin behind it a session of their own again
+func (s *AuthService) EndImpersonation(ctx context.Context, accessToken auth.AccessToken) (user auth.User, tokens auth.Tokens, err error) {
+	defer func() {
+		s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionEndImpersonation, ActorID: accessToken.Actor, TargetType: auth.AuditTargetUser, TargetID: accessToken.UserID}, err)
+	}()
+
+	if !accessToken.Impersonating() {
+		return auth.User{}, auth.Tokens{}, auth.ErrNotImpersonating
+	}
+
+	if err := s.logout(ctx, accessToken.UserID, accessToken.SessionID); err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+
+	// the admin may have lost their access while impersonating
+	actor, err := s.userStore.FindByID(ctx, accessToken.Actor)
+	if err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+	if actor.Deleted() || !actor.Admin() {
+		return auth.User{}, auth.Tokens{}, auth.ErrInsufficientAccess
+	}
+
+	user, tokens, err = s.makeSession(ctx, actor.ID, primitive.NilObjectID, auth.RefreshToken{}, time.Now())
+	if err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, actor.ID.Hex()).Infof("stopped impersonating user %s", accessToken.UserID.Hex())
+
+	return user, tokens, nil
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+)
+
+// CheckServiceClient authenticates a service calling the private api,
+// unknown clients and wrong secrets fail the same way
+func (s *AuthService) CheckServiceClient(id, secret string) error {
+	expectedSecret, ok := s.serviceClients[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(expectedSecret), []byte(secret)) != 1 {
+		return auth.ErrInvalidClient
+	}
+	return nil
+}
+
+// IntrospectToken tells whether an access token, refresh token or api key can still be used,
+// services are never handed any other kind. Tokens that cannot be used for any reason are only
+// ever reported as inactive, as are user, verification and totp challenge tokens whatever
+// their expiry, and like every inactive token their type is not told either
+func (s *AuthService) IntrospectToken(ctx context.Context, token, tokenTypeHint string) (auth.Introspection, error) {
+	var introspection auth.Introspection
+	var err error
+	if auth.IsAPIKey(token) {
+		introspection, err = s.introspectAPIKey(ctx, token)
+	} else {
+		introspection, err = s.introspectSession(ctx, token, tokenTypeHint)
+	}
+	if err != nil {
+		if inactiveToken(err) {
+			return auth.Introspection{}, nil
+		}
+		return auth.Introspection{}, err
+	}
+	return introspection, nil
+}
+
+func (s *AuthService) introspectSession(ctx context.Context, token, tokenTypeHint string) (auth.Introspection, error) {
+	tokenType, sessionToken, err := s.parseSessionToken(token, tokenTypeHint)
+	if err != nil {
+		return auth.Introspection{}, err
+	}
+
+	if tokenType == auth.TokenTypeHintRefreshToken {
+		storedToken, err := s.refreshTokenStore.FindByID(ctx, sessionToken.SessionID)
+		if err != nil {
+			return auth.Introspection{}, err
+		}
+		// a consumed token was already exchanged for the next one of its session
+		if storedToken.Consumed {
+			return auth.Introspection{}, auth.ErrSessionRevoked
+		}
+	}
+
+	user, err := s.userStore.FindByID(ctx, sessionToken.UserID)
+	if err != nil {
+		return auth.Introspection{}, err
+	}
+
+	var activeSession bool
+	for _, sessionID := range user.Sessions {
+		if sessionID == sessionToken.SessionID {
+			activeSession = true
+		}
+	}
+	if !activeSession {
+		return auth.Introspection{}, auth.ErrInvalidSession
+	}
+
+	return auth.NewSessionIntrospection(tokenType, sessionToken, user), nil
+}
+
+func (s *AuthService) introspectAPIKey(ctx context.Context, token string) (auth.Introspection, error) {
+	apiKey, err := s.findAPIKey(ctx, token)
+	if err != nil {
+		return auth.Introspection{}, err
+	}
+	if apiKey.Expired(time.Now()) {
+		return auth.Introspection{}, auth.ErrAPIKeyExpired
+	}
+
+	user, err := s.userStore.FindByID(ctx, apiKey.UserID)
+	if err != nil {
+		return auth.Introspection{}, err
+	}
+
+	return auth.NewAPIKeyIntrospection(apiKey, user), nil
+}
+
+// RevokeToken ends the session behind an access or refresh token, or deletes an api key.
+// As rfc 7009 asks, tokens that are invalid or already revoked are not an error
+func (s *AuthService) RevokeToken(ctx context.Context, token, tokenTypeHint string) error {
+	if auth.IsAPIKey(token) {
+		return s.revokeAPIKeyToken(ctx, token)
+	}
+
+	_, sessionToken, err := s.parseSessionToken(token, tokenTypeHint)
+	if err != nil {
+		if inactiveToken(err) {
+			return nil
+		}
+		return err
+	}
+
+	err = s.logout(ctx, sessionToken.UserID, sessionToken.SessionID)
+	s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionRevokeToken, ActorID: sessionToken.UserID, TargetType: auth.AuditTargetSession, TargetID: sessionToken.SessionID}, err)
+	if err != nil {
+		return err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, sessionToken.UserID.Hex()).Infof("revoked session %s by its token", sessionToken.SessionID.Hex())
+
+	return nil
+}
+
+func (s *AuthService) revokeAPIKeyToken(ctx context.Context, token string) error {
+	apiKey, err := s.findAPIKey(ctx, token)
+	if err != nil {
+		if inactiveToken(err) {
+			return nil
+		}
+		return err
+	}
+
+	err = s.apiKeyStore.Delete(ctx, apiKey.UserID, apiKey.ID)
+	s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionRevokeToken, ActorID: apiKey.UserID, TargetType: auth.AuditTargetAPIKey, TargetID: apiKey.ID}, err)
+	if err != nil {
+		if inactiveToken(err) {
+			return nil
+		}
+		return err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, apiKey.UserID.Hex()).Infof("revoked api key %s by its token", apiKey.ID.Hex())
+
+	return nil
+}
+
+// parseSessionToken reads an access or refresh token, the hinted type is tried first
+func (s *AuthService) parseSessionToken(token, tokenTypeHint string) (string, auth.AccessToken, error) {
+	tokenTypes := []string{auth.TokenTypeHintAccessToken, auth.TokenTypeHintRefreshToken}
+	if tokenTypeHint == auth.TokenTypeHintRefreshToken {
+		tokenTypes = []string{auth.TokenTypeHintRefreshToken, auth.TokenTypeHintAccessToken}
+	}
+
+	var err error
+	for _, tokenType := range tokenTypes {
+		switch tokenType {
+		case auth.TokenTypeHintAccessToken:
+			var accessToken auth.AccessToken
+			if err = s.ParseToken(token, &accessToken); err == nil {
+				return tokenType, accessToken, nil
+			}
+		case auth.TokenTypeHintRefreshToken:
+			var refreshToken auth.RefreshToken
+			if err = s.ParseToken(token, &refreshToken); err == nil {
+				return tokenType, refreshToken.AccessToken, nil
+			}
+		}
+	}
+	return "", auth.AccessToken{}, err
+}
+
+// inactiveToken tells errors that only mean the token cannot be used
+// apart from those that keep us from knowing whether it can
+func inactiveToken(err error) bool {
+	if err, ok := err.(common.ErrCodeProvider); ok {
+		switch err.Code() {
+		case common.ErrCodeInvalidAuth, common.ErrCodeNotFound:
+			return true
+		}
+	}
+	return false
+}
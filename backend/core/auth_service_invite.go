@@ -0,0 +1,63 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CreateInvite makes a single-use invite to register with, the code itself
+// is only returned here since just its hash is stored
+func (s *AuthService) CreateInvite(ctx context.Context, actorID primitive.ObjectID, create auth.InviteCreate) (_ auth.NewInvite, err error) {
+	event := auth.AuditEvent{Action: auth.AuditActionCreateInvite, ActorID: actorID, TargetType: auth.AuditTargetInvite}
+	defer func() { s.audit(ctx, event, err) }()
+
+	code, err := auth.NewInviteCode()
+	if err != nil {
+		return auth.NewInvite{}, common.WrapErr(fmt.Errorf("cannot make invite: %s", err), common.ErrCodeServer)
+	}
+
+	now := time.Now()
+	invite := auth.Invite{
+		HashedCode: hashToken(code),
+		UserType:   create.UserType,
+		CreatedBy:  actorID,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(s.inviteTTL),
+	}
+	if err := invite.Validate(); err != nil {
+		return auth.NewInvite{}, common.WrapErr(fmt.Errorf("failed to make invite: %s", err), common.ErrCodeBadRequest)
+	}
+	event.TargetID = invite.ID
+
+	if err := s.inviteStore.Insert(ctx, invite); err != nil {
+		return auth.NewInvite{}, err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, actorID.Hex()).Infof("created invite %s", invite.ID.Hex())
+
+	return auth.NewInvite{invite, code}, nil
+}
+
+func (s *AuthService) Invites(ctx context.Context) ([]auth.Invite, error) {
+	return s.inviteStore.Find(ctx)
+}
+
+func (s *AuthService) RevokeInvite(ctx context.Context, actorID, id primitive.ObjectID) (err error) {
+	defer func() {
+		s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionRevokeInvite, ActorID: actorID, TargetType: auth.AuditTargetInvite, TargetID: id}, err)
+	}()
+
+	if err := s.inviteStore.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, actorID.Hex()).Infof("revoked invite %s", id.Hex())
+
+	return nil
+}
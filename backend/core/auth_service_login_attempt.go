@@ -0,0 +1,136 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	loginAttemptKeyUser = "user:"
+	loginAttemptKeyIP   = "ip:"
+)
+
+type loginAttemptKey struct {
+	key      string
+	throttle auth.LoginThrottle
+}
+
+// UnlockUser forgets the user's failed logins so they can login again right away
+func (s *AuthService) UnlockUser(ctx context.Context, actorID, userID primitive.ObjectID) (err error) {
+	defer func() {
+		s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionUnlockUser, ActorID: actorID, TargetType: auth.AuditTargetUser, TargetID: userID}, err)
+	}()
+
+	user, err := s.userStore.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.loginAttemptStore.DeleteByKeys(ctx, loginAttemptUserKeys(user)); err != nil {
+		return err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, user.ID.Hex()).Info("unlocked user logins")
+
+	return nil
+}
+
+// loginThrottled reports whether failed logins are tracked at all,
+// they are not unless the config sets how long a lockout lasts
+func (s *AuthService) loginThrottled() bool {
+	return s.loginAttemptStore != nil && s.userLoginThrottle.Lockout > 0
+}
+
+// loginAttemptKeys are the keys a login is throttled by, the user is keyed
+// by the name or email they logged in with as it is not yet known who they are
+func (s *AuthService) loginAttemptKeys(login, ipAddress string) []loginAttemptKey {
+	keys := []loginAttemptKey{{loginAttemptKeyUser + login, s.userLoginThrottle}}
+	if ipAddress != "" {
+		keys = append(keys, loginAttemptKey{loginAttemptKeyIP + ipAddress, s.ipLoginThrottle})
+	}
+	return keys
+}
+
+// userLoginAttemptKeys are the keys of a login by a user already known,
+// their failures count against however they log in next
+func (s *AuthService) userLoginAttemptKeys(user auth.User, ipAddress string) []loginAttemptKey {
+	keys := s.loginAttemptKeys(user.Name, ipAddress)
+	if user.Email != "" {
+		keys = append(keys, loginAttemptKey{loginAttemptKeyUser + user.Email, s.userLoginThrottle})
+	}
+	return keys
+}
+
+// checkLoginAttempts fails when the username or client ip must still wait before another login
+func (s *AuthService) checkLoginAttempts(ctx context.Context, keys []loginAttemptKey, now time.Time) error {
+	if !s.loginThrottled() {
+		return nil
+	}
+
+	throttles := make(map[string]auth.LoginThrottle, len(keys))
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		throttles[key.key] = key.throttle
+		ids = append(ids, key.key)
+	}
+
+	attempts, err := s.loginAttemptStore.FindByKeys(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	var retryAt time.Time
+	for _, attempt := range attempts {
+		if keyRetryAt := throttles[attempt.Key].RetryAt(attempt); keyRetryAt.After(retryAt) {
+			retryAt = keyRetryAt
+		}
+	}
+	if retryAt.After(now) {
+		return auth.ErrTooManyLoginAttempts(retryAt.Sub(now))
+	}
+	return nil
+}
+
+// recordLoginFailure counts the failed login against the username and client ip, only unknown
+// users, wrong passwords and wrong two-factor codes count so server errors never lock anyone out
+func (s *AuthService) recordLoginFailure(ctx context.Context, keys []loginAttemptKey, loginErr error, now time.Time) {
+	if !s.loginThrottled() {
+		return
+	}
+	e, ok := loginErr.(common.ErrCodeProvider)
+	if !ok {
+		return
+	}
+	switch e.Code() {
+	case common.ErrCodeNotFound, common.ErrCodeBadRequest, common.ErrCodeInvalidAuth:
+	default:
+		return
+	}
+
+	for _, key := range keys {
+		if err := s.loginAttemptStore.RecordFailure(ctx, key.key, now, now.Add(key.throttle.Lockout)); err != nil {
+			s.logger.Warnf("failed to record login attempt: %s", err)
+		}
+	}
+}
+
+// resetLoginAttempts forgets the user's failed logins once they are given a session, the client
+// ip's are kept so logging into one account does not help guess the passwords of others
+func (s *AuthService) resetLoginAttempts(ctx context.Context, user auth.User) {
+	if !s.loginThrottled() {
+		return
+	}
+	if err := s.loginAttemptStore.DeleteByKeys(ctx, loginAttemptUserKeys(user)); err != nil {
+		s.logger.Warnf("failed to reset login attempts: %s", err)
+	}
+}
+
+// loginAttemptUserKeys are the keys of the user's failed logins by either their name or email
+func loginAttemptUserKeys(user auth.User) []string {
+	return []string{loginAttemptKeyUser + user.Name, loginAttemptKeyUser + user.Email}
+}
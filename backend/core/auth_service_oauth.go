@@ -0,0 +1,174 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+)
+
+const (
+	oauthStateTTL = 10 * time.Minute
+
+	// taken names are retried with a random suffix this many times
+	oauthNameAttempts     = 5
+	oauthNameSuffixLength = 3
+)
+
+// StartOAuth begins a login with the provider, the state is kept by the client
+// until the provider sends the user back to the callback with its code
+func (s *AuthService) StartOAuth(ctx context.Context, providerName string) (auth.OAuthState, string, error) {
+	provider, ok := s.oidcProviders[providerName]
+	if !ok {
+		return auth.OAuthState{}, "", common.NewErr("cannot find oauth provider", common.ErrCodeNotFound)
+	}
+
+	state, err := auth.NewOAuthState(providerName, s.jwtIssuer, time.Now(), oauthStateTTL)
+	if err != nil {
+		return auth.OAuthState{}, "", common.WrapErr(fmt.Errorf("cannot make oauth state: %s", err), common.ErrCodeServer)
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, state)
+	if err != nil {
+		return auth.OAuthState{}, "", common.WrapErr(fmt.Errorf("failed to start %s login: %s", providerName, err), common.ErrCodeServerUnavailable)
+	}
+
+	return state, authURL, nil
+}
+
+// LoginOAuth redeems the provider's code for the user's claims, the user is found by
+// their identity with the provider, linked by their verified email or else created
+func (s *AuthService) LoginOAuth(ctx context.Context, providerName string, state auth.OAuthState, callbackState, code string) (_ auth.User, _ auth.Tokens, err error) {
+	now := time.Now()
+
+	event := auth.AuditEvent{Action: auth.AuditActionLoginOAuth}
+	defer func() { s.audit(ctx, event, err) }()
+
+	provider, ok := s.oidcProviders[providerName]
+	if !ok {
+		return auth.User{}, auth.Tokens{}, common.NewErr("cannot find oauth provider", common.ErrCodeNotFound)
+	}
+
+	if state.Provider != providerName || subtle.ConstantTimeCompare([]byte(state.State), []byte(callbackState)) != 1 {
+		return auth.User{}, auth.Tokens{}, auth.ErrInvalidOAuthState
+	}
+
+	claims, err := provider.Exchange(ctx, state, code)
+	if err != nil {
+		return auth.User{}, auth.Tokens{}, common.WrapErr(fmt.Errorf("failed to login with %s: %s", providerName, err), common.ErrCodeInvalidAuth)
+	}
+
+	user, err := s.findOAuthUser(ctx, providerName, claims)
+	if err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+	event = auditUser(auth.AuditActionLoginOAuth, user.ID)
+
+	// users created by a provider have no password and so never have a second factor
+	password, err := s.passwordStore.FindByUsername(ctx, user.Name)
+	if err != nil {
+		if e, ok := err.(common.ErrCodeProvider); !ok || e.Code() != common.ErrCodeNotFound {
+			return auth.User{}, auth.Tokens{}, err
+		}
+	} else if password.TOTPEnabled() {
+		tokens, err := s.makeTOTPChallenge(ctx, user, now)
+		if err != nil {
+			return auth.User{}, auth.Tokens{}, err
+		}
+		return user, tokens, nil
+	}
+
+	return s.makeLoginSession(ctx, user.ID, now)
+}
+
+func (s *AuthService) findOAuthUser(ctx context.Context, providerName string, claims auth.OIDCClaims) (auth.User, error) {
+	identity := auth.Identity{providerName, claims.Subject}
+
+	user, err := s.userStore.FindByIdentity(ctx, identity)
+	if err == nil {
+		return user, nil
+	}
+	if e, ok := err.(common.ErrCodeProvider); !ok || e.Code() != common.ErrCodeNotFound {
+		return auth.User{}, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return auth.User{}, common.NewErr("provider has not verified the user's email", common.ErrCodeBadRequest)
+	}
+
+	user, err = s.userStore.FindByEmail(ctx, auth.NormalizeEmail(claims.Email))
+	if err == nil {
+		// an unverified user could have been registered by anyone with this email,
+		// linking it would let them login as whoever owns the provider's account
+		if user.Status == auth.UserStatusUnverified {
+			return auth.User{}, auth.ErrEmailNotVerified
+		}
+
+		s.logger.With(common.LoggerFieldUserID, user.ID.Hex()).Infof("linked %s identity", providerName)
+		return s.userStore.AddIdentity(ctx, user.ID, identity)
+	}
+	if e, ok := err.(common.ErrCodeProvider); !ok || e.Code() != common.ErrCodeNotFound {
+		return auth.User{}, err
+	}
+
+	if err := s.checkRegistration(auth.NormalizeEmail(claims.Email), ""); err != nil {
+		return auth.User{}, err
+	}
+
+	name, err := s.oauthUserName(ctx, claims)
+	if err != nil {
+		return auth.User{}, err
+	}
+
+	user = auth.User{
+		Name:       name,
+		Email:      auth.NormalizeEmail(claims.Email),
+		Status:     auth.UserStatusVerified,
+		Identities: []auth.Identity{identity},
+	}
+	if err := user.Validate(); err != nil {
+		return auth.User{}, common.WrapErr(fmt.Errorf("failed to make user: %s", err), common.ErrCodeBadRequest)
+	}
+
+	if err := s.userStore.Insert(ctx, user); err != nil {
+		return auth.User{}, err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, user.ID.Hex()).Infof("created user from %s identity", providerName)
+
+	return user, nil
+}
+
+// oauthUserName picks a name for a new user from the provider's claims,
+// a random suffix is added when the name is already taken
+func (s *AuthService) oauthUserName(ctx context.Context, claims auth.OIDCClaims) (string, error) {
+	// names cannot contain an @, some providers prefer the user's email as their name
+	baseName := strings.SplitN(claims.PreferredUsername, "@", 2)[0]
+	if baseName == "" {
+		baseName = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+
+	name := baseName
+	for i := 0; i < oauthNameAttempts; i++ {
+		_, err := s.userStore.FindByName(ctx, name)
+		if err, ok := err.(common.ErrCodeProvider); ok && err.Code() == common.ErrCodeNotFound {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		suffix := make([]byte, oauthNameSuffixLength)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", common.WrapErr(fmt.Errorf("cannot make user name: %s", err), common.ErrCodeServer)
+		}
+		name = baseName + "_" + hex.EncodeToString(suffix)
+	}
+	return "", common.NewErr("cannot find an available user name", common.ErrCodeServer)
+}
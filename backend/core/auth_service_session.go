@@ -0,0 +1,77 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/core/mail"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type sessionClientKey struct{}
+
+// AttachSessionClient keeps the client a request came from
+// so the sessions started or refreshed by it can record it
+func AttachSessionClient(ctx context.Context, client auth.SessionClient) context.Context {
+	return context.WithValue(ctx, sessionClientKey{}, client)
+}
+
+func ctxSessionClient(ctx context.Context) auth.SessionClient {
+	client, _ := ctx.Value(sessionClientKey{}).(auth.SessionClient)
+	return client
+}
+
+// makeLoginSession starts a session for a user that just logged in, forgets
+// their failed logins and remembers the client they logged in from
+func (s *AuthService) makeLoginSession(ctx context.Context, userID primitive.ObjectID, now time.Time) (auth.User, auth.Tokens, error) {
+	user, tokens, err := s.makeSession(ctx, userID, primitive.NilObjectID, auth.RefreshToken{}, now)
+	if err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+
+	s.resetLoginAttempts(ctx, user)
+	s.checkLoginClient(ctx, user, now)
+
+	return user, tokens, nil
+}
+
+// checkLoginClient tells the user when they log in from an ip range or user agent
+// not seen before, failing to do so never fails the login
+func (s *AuthService) checkLoginClient(ctx context.Context, user auth.User, now time.Time) {
+	client := ctxSessionClient(ctx)
+
+	ipRange, userAgent := user.UnknownClient(client)
+	if ipRange == "" && userAgent == "" {
+		return
+	}
+
+	logger := s.logger.With(common.LoggerFieldUserID, user.ID.Hex())
+
+	if err := s.userStore.AddKnownClient(ctx, user.ID, ipRange, userAgent); err != nil {
+		logger.Warnf("failed to remember login client: %s", err)
+		return
+	}
+
+	// there is nothing to compare the first login against
+	if !s.newDeviceNotice || (len(user.KnownIPRanges) == 0 && len(user.KnownUserAgents) == 0) {
+		return
+	}
+
+	if err := s.sendMail(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "New sign-in to your account",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nYour account was signed in to from a new device:\n\n%s\nfrom %s at %s\n\nIf this was not you, change your password and sign out of your other sessions.\n",
+			user.Name,
+			client.UserAgent,
+			client.IPAddress,
+			now.UTC().Format(time.RFC1123),
+		),
+	}); err != nil {
+		logger.Warnf("failed to send new device notice: %s", err)
+	}
+}
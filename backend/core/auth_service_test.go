@@ -2,6 +2,10 @@ package core
 
 import (
 	"context"
+	"encoding/base32"
+	"errors"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -9,8 +13,11 @@ import (
 	"github.com/shake-on-it/app-tmpl/backend/common"
 	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
 	u "github.com/shake-on-it/app-tmpl/backend/common/test/utils"
+	"github.com/shake-on-it/app-tmpl/backend/core/mail"
+	"github.com/shake-on-it/app-tmpl/backend/core/mongodb"
 	"github.com/shake-on-it/app-tmpl/backend/core/namespaces"
 
+	jwt "github.com/golang-jwt/jwt/v4"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -29,6 +36,26 @@ func TestAuthService(t *testing.T) {
 	refreshTokenStore, err := NewRefreshTokenStore(client)
 	assert.Nil(t, err)
 
+	apiKeyStore, err := NewAPIKeyStore(client)
+	assert.Nil(t, err)
+
+	loginAttemptStore, err := NewLoginAttemptStore(client)
+	assert.Nil(t, err)
+
+	auditStore, err := NewAuditStore(client)
+	assert.Nil(t, err)
+
+	userDataStore, err := NewUserDataStore(client)
+	assert.Nil(t, err)
+
+	inviteStore, err := NewInviteStore(client)
+	assert.Nil(t, err)
+
+	transactor := mongodb.NewTransactor(client)
+
+	crypter := u.NewCrypter(t)
+	mailer := &testMailer{}
+
 	s := NewAuthService(
 		common.Config{
 			Auth: common.AuthConfig{
@@ -40,9 +67,20 @@ func TestAuthService(t *testing.T) {
 				BaseURL: "http://localhost",
 			},
 		},
+		crypter,
+		nil,
+		nil,
+		u.NewLogger(t),
+		mailer,
+		transactor,
 		userStore,
 		passwordStore,
 		refreshTokenStore,
+		apiKeyStore,
+		loginAttemptStore,
+		auditStore,
+		userDataStore,
+		inviteStore,
 	)
 
 	creds := auth.Credentials{
@@ -71,10 +109,49 @@ func TestAuthService(t *testing.T) {
 		assert.Equal(t, password.Iterations, defaultHashRounds)
 		assert.Equal(t, password.KeyLength, defaultHashKeyLength)
 
+		assert.Equal(t, len(mailer.messages), 1)
+		assert.Equal(t, mailer.messages[0].To, "email@domain.com")
+		assert.Equal(t, mailer.messages[0].Subject, "Verify your email")
+
+		t.Run("and not create another user with the same email in another case", func(t *testing.T) {
+			_, err := s.CreateUser(context.Background(), auth.Registration{
+				Credentials: auth.Credentials{"other-user", "password"},
+				Email:       " Email@Domain.com ",
+			})
+			assert.Equal(t, err, common.NewErr("user already exists with this name or email", common.ErrCodeConflict))
+
+			_, err = s.CreateUser(context.Background(), auth.Registration{
+				Credentials: auth.Credentials{"other@user", "password"},
+				Email:       "other@domain.com",
+			})
+			assert.Equal(t, err, common.NewErr("failed to make user: name must not contain @", common.ErrCodeBadRequest))
+		})
+
+		t.Run("and find the user to login by their email in any case", func(t *testing.T) {
+			_, _, err := s.Login(context.Background(), auth.Credentials{"EMAIL@domain.com", "wrong password"}, "")
+			assert.Equal(t, err, common.NewErr("invalid password", common.ErrCodeBadRequest))
+		})
+
+		t.Run("and still login a user who registered with an @ in their name", func(t *testing.T) {
+			legacyCreds := auth.Credentials{"legacy@user", "password"}
+
+			legacyUser := auth.User{Name: legacyCreds.Username, Email: "legacy@domain.com"}
+			assert.Nil(t, legacyUser.Validate())
+			assert.Nil(t, userStore.Insert(context.Background(), legacyUser))
+
+			legacyPassword, err := s.makeSaltedPassword(legacyCreds)
+			assert.Nil(t, err)
+			assert.Nil(t, passwordStore.Insert(context.Background(), legacyPassword))
+
+			user, _, err := s.Login(context.Background(), legacyCreds, "")
+			assert.Nil(t, err)
+			assert.Equal(t, user.ID, legacyUser.ID)
+		})
+
 		t.Run("and login with those credentials", func(t *testing.T) {
 			now := time.Now()
 
-			user, tokens, err := s.Login(context.Background(), creds)
+			user, tokens, err := s.Login(context.Background(), creds, "")
 			assert.Nil(t, err)
 
 			assert.Equal(t, user.Name, creds.Username)
@@ -119,6 +196,9 @@ func TestAuthService(t *testing.T) {
 				assert.True(t, newTokens.AccessToken.IssuedAt.After(tokens.AccessToken.IssuedAt))
 				assert.True(t, newTokens.RefreshToken.IssuedAt.After(tokens.RefreshToken.IssuedAt))
 
+				assert.True(t, newTokens.RefreshToken.CreatedAt.Equal(tokens.RefreshToken.CreatedAt.Truncate(time.Millisecond)))
+				assert.Equal(t, newTokens.RefreshToken.LastSeenAt, newTokens.RefreshToken.IssuedAt)
+
 				assert.Equal(t, newTokens.AccessToken.ExpiresAt, newTokens.AccessToken.IssuedAt.Add(time.Hour))
 				assert.Equal(t, newTokens.RefreshToken.ExpiresAt, newTokens.RefreshToken.IssuedAt.Add(24*time.Hour))
 
@@ -144,12 +224,144 @@ func TestAuthService(t *testing.T) {
 
 					assert.True(t, len(refreshTokensByID) == 2)
 					assert.True(t, refreshTokensByID[tokens.RefreshToken.SessionID].Consumed)
+					assert.Equal(t, refreshTokensByID[newTokens.RefreshToken.SessionID].FamilyID, refreshTokensByID[tokens.RefreshToken.SessionID].FamilyID)
+				})
+
+				t.Run("and reusing the old refresh token should revoke the session family", func(t *testing.T) {
+					_, _, err := s.RefreshAccess(context.Background(), tokens.RefreshToken)
+					assert.Equal(t, err, auth.ErrSessionRevoked)
+
+					user, err := userStore.FindByID(context.Background(), user.ID)
+					assert.Nil(t, err)
+					assert.Equal(t, len(user.Sessions), 0)
+
+					_, err = refreshTokenStore.FindByID(context.Background(), newTokens.RefreshToken.SessionID)
+					assert.Equal(t, err, common.NewErr("cannot find session", common.ErrCodeNotFound))
+
+					_, _, err = s.RefreshAccess(context.Background(), newTokens.RefreshToken)
+					assert.Equal(t, err, auth.ErrInvalidSession)
 				})
 			})
 		})
 
+		t.Run("and give sessions from before families were tracked a family", func(t *testing.T) {
+			legacyAccessToken := s.makeAccessToken(primitive.NewObjectID(), user.ID, time.Now())
+			legacyToken := s.makeRefreshToken(legacyAccessToken, primitive.NilObjectID)
+			assert.Nil(t, refreshTokenStore.Insert(context.Background(), legacyToken))
+			_, err := userStore.AddSession(context.Background(), user.ID, legacyToken.SessionID)
+			assert.Nil(t, err)
+
+			_, tokens, err := s.RefreshAccess(context.Background(), legacyToken)
+			assert.Nil(t, err)
+			assert.Equal(t, tokens.RefreshToken.FamilyID, legacyToken.SessionID)
+
+			_, newTokens, err := s.RefreshAccess(context.Background(), tokens.RefreshToken)
+			assert.Nil(t, err)
+			assert.Equal(t, newTokens.RefreshToken.FamilyID, legacyToken.SessionID)
+
+			t.Run("and revoke the family when the legacy token is reused", func(t *testing.T) {
+				_, _, err := s.RefreshAccess(context.Background(), legacyToken)
+				assert.Equal(t, err, auth.ErrSessionRevoked)
+
+				_, err = refreshTokenStore.FindByID(context.Background(), newTokens.RefreshToken.SessionID)
+				assert.Equal(t, err, common.NewErr("cannot find session", common.ErrCodeNotFound))
+
+				user, err := userStore.FindByID(context.Background(), user.ID)
+				assert.Nil(t, err)
+				for _, sessionID := range user.Sessions {
+					assert.NotEqual(t, sessionID, newTokens.RefreshToken.SessionID)
+				}
+			})
+		})
+
+		t.Run("and list and revoke a single session", func(t *testing.T) {
+			ctx := AttachSessionClient(context.Background(), auth.SessionClient{"browser", "203.0.113.7"})
+
+			_, tokens, err := s.Login(ctx, creds, "203.0.113.7")
+			assert.Nil(t, err)
+
+			_, otherTokens, err := s.Login(context.Background(), creds, "")
+			assert.Nil(t, err)
+
+			sessions, err := s.Sessions(context.Background(), user.ID, tokens.AccessToken.SessionID)
+			assert.Nil(t, err)
+			assert.Equal(t, len(sessions), 2)
+
+			var current auth.Session
+			for _, session := range sessions {
+				if session.Current {
+					current = session
+				}
+			}
+			assert.Equal(t, current.ID, tokens.AccessToken.SessionID)
+			assert.Equal(t, current.ExpiresAt, tokens.RefreshToken.ExpiresAt)
+			assert.Equal(t, current.UserAgent, "browser")
+			assert.Equal(t, current.IPAddress, "203.0.113.7")
+			assert.True(t, current.CreatedAt.Equal(tokens.RefreshToken.CreatedAt.Truncate(time.Millisecond)))
+			assert.True(t, current.LastSeenAt.Equal(tokens.RefreshToken.LastSeenAt.Truncate(time.Millisecond)))
+
+			assert.Nil(t, s.RevokeSession(context.Background(), user.ID, tokens.AccessToken.SessionID))
+
+			sessions, err = s.Sessions(context.Background(), user.ID, tokens.AccessToken.SessionID)
+			assert.Nil(t, err)
+			assert.Equal(t, len(sessions), 1)
+			assert.Equal(t, sessions[0].ID, otherTokens.AccessToken.SessionID)
+			assert.False(t, sessions[0].Current)
+
+			assert.Equal(t, s.RevokeSession(context.Background(), user.ID, tokens.AccessToken.SessionID), common.NewErr("cannot find session", common.ErrCodeNotFound))
+		})
+
+		t.Run("and tell the user about logins from new devices", func(t *testing.T) {
+			noticeMailer := &testMailer{}
+			noticeService := NewAuthService(
+				common.Config{
+					Auth: common.AuthConfig{
+						AccessTokenExpirySecs:  3600,
+						RefreshTokenExpiryDays: 1,
+						PasswordSalt:           "abcdefghijkl",
+						NewDeviceNotice:        true,
+					},
+				},
+				crypter,
+				nil,
+				nil,
+				u.NewLogger(t),
+				noticeMailer,
+				transactor,
+				userStore,
+				passwordStore,
+				refreshTokenStore,
+				apiKeyStore,
+				loginAttemptStore,
+				auditStore,
+				userDataStore,
+				inviteStore,
+			)
+
+			knownCtx := AttachSessionClient(context.Background(), auth.SessionClient{"browser", "203.0.113.8"})
+			_, _, err := noticeService.Login(knownCtx, creds, "203.0.113.8")
+			assert.Nil(t, err)
+			assert.Equal(t, len(noticeMailer.messages), 0)
+
+			newCtx := AttachSessionClient(context.Background(), auth.SessionClient{"other browser", "203.0.113.8"})
+			_, _, err = noticeService.Login(newCtx, creds, "203.0.113.8")
+			assert.Nil(t, err)
+			assert.Equal(t, len(noticeMailer.messages), 1)
+			assert.Equal(t, noticeMailer.messages[0].Subject, "New sign-in to your account")
+			assert.True(t, strings.Contains(noticeMailer.messages[0].Body, "other browser"))
+
+			_, _, err = noticeService.Login(newCtx, creds, "203.0.113.8")
+			assert.Nil(t, err)
+			assert.Equal(t, len(noticeMailer.messages), 1)
+
+			knownUser, err := userStore.FindByID(context.Background(), user.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, knownUser.KnownIPRanges, []string{"203.0.113.0/24"})
+			assert.Equal(t, knownUser.KnownUserAgents, []string{"browser", "other browser"})
+		})
+
 		t.Run("and logout of those credentials", func(t *testing.T) {
-			assert.Nil(t, s.Logout(context.Background(), user.ID))
+			assert.Nil(t, s.LogoutAll(context.Background(), user.ID))
 
 			user, err := userStore.FindByID(context.Background(), user.ID)
 			assert.Nil(t, err)
@@ -178,7 +390,7 @@ func TestAuthService(t *testing.T) {
 		t.Run("and login again", func(t *testing.T) {
 			now := time.Now()
 
-			user, tokens, err := s.Login(context.Background(), creds)
+			user, tokens, err := s.Login(context.Background(), creds, "")
 			assert.Nil(t, err)
 
 			assert.Equal(t, user.Name, creds.Username)
@@ -200,5 +412,1022 @@ func TestAuthService(t *testing.T) {
 
 			assert.False(t, tokens.RefreshToken.Consumed)
 		})
+
+		t.Run("and sweep sessions without a refresh token", func(t *testing.T) {
+			_, tokens, err := s.Login(context.Background(), creds, "")
+			assert.Nil(t, err)
+
+			_, err = client.
+				Database(namespaces.DBAuth).
+				Collection(namespaces.CollRefreshTokens).
+				DeleteOne(context.Background(), bson.D{{namespaces.FieldID, tokens.RefreshToken.SessionID}})
+			assert.Nil(t, err)
+
+			count, err := s.SweepSessions(context.Background())
+			assert.Nil(t, err)
+			assert.Equal(t, count, 1)
+
+			user, err := userStore.FindByID(context.Background(), user.ID)
+			assert.Nil(t, err)
+			for _, sessionID := range user.Sessions {
+				assert.NotEqual(t, sessionID, tokens.RefreshToken.SessionID)
+			}
+			assert.Equal(t, len(user.Sessions), 1)
+		})
+
+		t.Run("and change the password", func(t *testing.T) {
+			_, tokens, err := s.Login(context.Background(), creds, "")
+			assert.Nil(t, err)
+
+			err = s.ChangePassword(context.Background(), user.ID, tokens.AccessToken.SessionID, auth.PasswordChange{
+				CurrentPassword: "wrong password",
+				NewPassword:     "n3w password",
+			})
+			assert.Equal(t, err, common.NewErr("invalid password", common.ErrCodeBadRequest))
+
+			assert.Nil(t, s.ChangePassword(context.Background(), user.ID, tokens.AccessToken.SessionID, auth.PasswordChange{
+				CurrentPassword: creds.Password,
+				NewPassword:     "n3w password",
+			}))
+
+			user, err := userStore.FindByID(context.Background(), user.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, user.Sessions, []primitive.ObjectID{tokens.AccessToken.SessionID})
+
+			_, _, err = s.Login(context.Background(), creds, "")
+			assert.Equal(t, err, common.NewErr("invalid password", common.ErrCodeBadRequest))
+
+			_, _, err = s.Login(context.Background(), auth.Credentials{creds.Username, "n3w password"}, "")
+			assert.Nil(t, err)
+		})
+
+		t.Run("and reset the password", func(t *testing.T) {
+			_, resetToken, err := s.RequestPasswordReset(context.Background(), "email@domain.com")
+			assert.Nil(t, err)
+			assert.Equal(t, mailer.lastToken(t, "Reset your password"), resetToken)
+
+			err = s.ResetPassword(context.Background(), auth.PasswordReset{Token: resetToken})
+			assert.Equal(t, err, common.NewErr("must have password", common.ErrCodeBadRequest))
+
+			reset := auth.PasswordReset{Token: resetToken, Password: creds.Password}
+			assert.Nil(t, s.ResetPassword(context.Background(), reset))
+
+			err = s.ResetPassword(context.Background(), reset)
+			assert.Equal(t, err, common.NewErr("password reset is invalid or has expired", common.ErrCodeBadRequest))
+
+			user, err := userStore.FindByID(context.Background(), user.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, len(user.Sessions), 0)
+
+			_, _, err = s.Login(context.Background(), creds, "")
+			assert.Nil(t, err)
+		})
+
+		t.Run("and rehash the password when the hash settings change", func(t *testing.T) {
+			argon2idService := NewAuthService(
+				common.Config{
+					Auth: common.AuthConfig{
+						AccessTokenExpirySecs:  3600,
+						RefreshTokenExpiryDays: 1,
+						PasswordSalt:           "abcdefghijkl",
+						PasswordHash: common.PasswordHashConfig{
+							Algorithm: common.PasswordHashArgon2id,
+							MemoryKiB: 1024,
+						},
+					},
+				},
+				crypter,
+				nil,
+				nil,
+				u.NewLogger(t),
+				mailer,
+				transactor,
+				userStore,
+				passwordStore,
+				refreshTokenStore,
+				apiKeyStore,
+				loginAttemptStore,
+				auditStore,
+				userDataStore,
+				inviteStore,
+			)
+
+			_, _, err := argon2idService.Login(context.Background(), creds, "")
+			assert.Nil(t, err)
+
+			password, err := passwordStore.FindByUsername(context.Background(), creds.Username)
+			assert.Nil(t, err)
+			assert.Equal(t, password.Algorithm, common.PasswordHashArgon2id)
+			assert.Equal(t, password.Memory, 1024)
+
+			_, _, err = s.Login(context.Background(), creds, "")
+			assert.Nil(t, err)
+
+			password, err = passwordStore.FindByUsername(context.Background(), creds.Username)
+			assert.Nil(t, err)
+			assert.Equal(t, password.Algorithm, common.PasswordHashPBKDF2)
+			assert.Equal(t, password.Iterations, defaultHashRounds)
+		})
+
+		t.Run("and verify the email", func(t *testing.T) {
+			verifiedOnlyService := NewAuthService(
+				common.Config{
+					Auth: common.AuthConfig{
+						AccessTokenExpirySecs:  3600,
+						RefreshTokenExpiryDays: 1,
+						PasswordSalt:           "abcdefghijkl",
+						RequireVerifiedEmail:   true,
+					},
+				},
+				crypter,
+				nil,
+				nil,
+				u.NewLogger(t),
+				mailer,
+				transactor,
+				userStore,
+				passwordStore,
+				refreshTokenStore,
+				apiKeyStore,
+				loginAttemptStore,
+				auditStore,
+				userDataStore,
+				inviteStore,
+			)
+
+			_, _, err := verifiedOnlyService.Login(context.Background(), creds, "")
+			assert.Equal(t, err, auth.ErrEmailNotVerified)
+
+			_, err = s.VerifyEmail(context.Background(), "not a token")
+			assert.Equal(t, err, auth.ErrMalformedToken)
+
+			assert.Nil(t, s.RequestVerification(context.Background(), "email@domain.com"))
+
+			verifiedUser, err := s.VerifyEmail(context.Background(), mailer.lastToken(t, "Verify your email"))
+			assert.Nil(t, err)
+			assert.Equal(t, verifiedUser.ID, user.ID)
+			assert.Equal(t, verifiedUser.Status, auth.UserStatusVerified)
+
+			_, _, err = verifiedOnlyService.Login(context.Background(), creds, "")
+			assert.Nil(t, err)
+
+			sent := len(mailer.messages)
+			assert.Nil(t, s.RequestVerification(context.Background(), "email@domain.com"))
+			assert.Equal(t, len(mailer.messages), sent)
+		})
+
+		t.Run("and enable two-factor authentication", func(t *testing.T) {
+			_, err := s.ConfirmTOTP(context.Background(), user.ID, "123456")
+			assert.Equal(t, err, common.NewErr("must enroll in totp first", common.ErrCodeBadRequest))
+
+			enrollment, err := s.EnrollTOTP(context.Background(), user.ID)
+			assert.Nil(t, err)
+			assert.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/"))
+
+			secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+			assert.Nil(t, err)
+
+			password, err := passwordStore.FindByUsername(context.Background(), creds.Username)
+			assert.Nil(t, err)
+			assert.NotEqual(t, password.TOTPPendingSecret.Data, secret)
+
+			_, err = s.ConfirmTOTP(context.Background(), user.ID, auth.TOTPCode(secret, auth.TOTPStep(time.Now())+10))
+			assert.Equal(t, err, auth.ErrInvalidTOTPCode)
+
+			recoveryCodes, err := s.ConfirmTOTP(context.Background(), user.ID, auth.TOTPCode(secret, auth.TOTPStep(time.Now())))
+			assert.Nil(t, err)
+			assert.Equal(t, len(recoveryCodes.Codes), recoveryCodeCount)
+
+			_, err = s.EnrollTOTP(context.Background(), user.ID)
+			assert.Equal(t, err, common.NewErr("two-factor authentication is already enabled", common.ErrCodeBadRequest))
+
+			t.Run("and login with a totp code", func(t *testing.T) {
+				_, tokens, err := s.Login(context.Background(), creds, "")
+				assert.Nil(t, err)
+				assert.True(t, tokens.Challenge != nil)
+				assert.Equal(t, tokens.Challenge.UserID, user.ID)
+				assert.True(t, tokens.AccessToken.SessionID.IsZero())
+
+				code := auth.TOTPCode(secret, auth.TOTPStep(time.Now()))
+
+				_, sessionTokens, err := s.LoginTOTP(context.Background(), *tokens.Challenge, code, "")
+				assert.Nil(t, err)
+				assert.False(t, sessionTokens.AccessToken.SessionID.IsZero())
+
+				_, _, err = s.LoginTOTP(context.Background(), *tokens.Challenge, code, "")
+				assert.Equal(t, err, auth.ErrInvalidSession)
+
+				_, tokens, err = s.Login(context.Background(), creds, "")
+				assert.Nil(t, err)
+
+				_, _, err = s.LoginTOTP(context.Background(), *tokens.Challenge, code, "")
+				assert.Equal(t, err, auth.ErrInvalidTOTPCode)
+
+				t.Run("or a recovery code only once", func(t *testing.T) {
+					_, _, err := s.LoginTOTP(context.Background(), *tokens.Challenge, strings.ToUpper(recoveryCodes.Codes[0]), "")
+					assert.Nil(t, err)
+
+					_, tokens, err := s.Login(context.Background(), creds, "")
+					assert.Nil(t, err)
+
+					_, _, err = s.LoginTOTP(context.Background(), *tokens.Challenge, recoveryCodes.Codes[0], "")
+					assert.Equal(t, err, auth.ErrInvalidTOTPCode)
+				})
+
+				t.Run("and only with the latest challenge", func(t *testing.T) {
+					_, oldTokens, err := s.Login(context.Background(), creds, "")
+					assert.Nil(t, err)
+
+					_, tokens, err := s.Login(context.Background(), creds, "")
+					assert.Nil(t, err)
+
+					_, _, err = s.LoginTOTP(context.Background(), *oldTokens.Challenge, recoveryCodes.Codes[1], "")
+					assert.Equal(t, err, auth.ErrInvalidSession)
+
+					_, _, err = s.LoginTOTP(context.Background(), *tokens.Challenge, recoveryCodes.Codes[1], "")
+					assert.Nil(t, err)
+				})
+			})
+
+			t.Run("and lock out wrong totp codes", func(t *testing.T) {
+				throttledService := NewAuthService(
+					common.Config{
+						Auth: common.AuthConfig{
+							AccessTokenExpirySecs:  3600,
+							RefreshTokenExpiryDays: 1,
+							PasswordSalt:           "abcdefghijkl",
+							LoginThrottle: common.LoginThrottleConfig{
+								MaxAttempts:   3,
+								MaxIPAttempts: 3,
+								LockoutMins:   1,
+							},
+						},
+					},
+					crypter,
+					nil,
+					nil,
+					u.NewLogger(t),
+					mailer,
+					transactor,
+					userStore,
+					passwordStore,
+					refreshTokenStore,
+					apiKeyStore,
+					loginAttemptStore,
+					auditStore,
+					userDataStore,
+					inviteStore,
+				)
+
+				_, tokens, err := throttledService.Login(context.Background(), creds, "10.0.1.1")
+				assert.Nil(t, err)
+
+				wrongCode := auth.TOTPCode(secret, auth.TOTPStep(time.Now())+10)
+				for i := 0; i < 2; i++ {
+					_, _, err := throttledService.LoginTOTP(context.Background(), *tokens.Challenge, wrongCode, "10.0.1.1")
+					assert.Equal(t, err, auth.ErrInvalidTOTPCode)
+				}
+
+				// the password alone issues no session and so does not forget the wrong codes
+				_, tokens, err = throttledService.Login(context.Background(), creds, "10.0.1.1")
+				assert.Nil(t, err)
+
+				_, _, err = throttledService.LoginTOTP(context.Background(), *tokens.Challenge, wrongCode, "10.0.1.1")
+				assert.Equal(t, err, auth.ErrInvalidTOTPCode)
+
+				_, _, err = throttledService.LoginTOTP(context.Background(), *tokens.Challenge, recoveryCodes.Codes[2], "10.0.1.2")
+				assert.Equal(t, err, auth.ErrTooManyLoginAttempts(time.Minute))
+
+				_, _, err = throttledService.Login(context.Background(), auth.Credentials{user.Email, creds.Password}, "10.0.1.2")
+				assert.Equal(t, err, auth.ErrTooManyLoginAttempts(time.Minute))
+
+				assert.Nil(t, throttledService.UnlockUser(context.Background(), user.ID, user.ID))
+
+				_, _, err = throttledService.LoginTOTP(context.Background(), *tokens.Challenge, recoveryCodes.Codes[2], "10.0.1.2")
+				assert.Nil(t, err)
+			})
+
+			t.Run("and disable two-factor authentication", func(t *testing.T) {
+				err := s.DisableTOTP(context.Background(), user.ID, "wrong password")
+				assert.Equal(t, err, common.NewErr("invalid password", common.ErrCodeBadRequest))
+
+				assert.Nil(t, s.DisableTOTP(context.Background(), user.ID, creds.Password))
+
+				_, tokens, err := s.Login(context.Background(), creds, "")
+				assert.Nil(t, err)
+				assert.True(t, tokens.Challenge == nil)
+			})
+		})
+
+		t.Run("and manage api keys", func(t *testing.T) {
+			_, err := s.CreateAPIKey(context.Background(), user.ID, auth.APIKeyCreate{Name: "script", Scopes: []string{"everything"}})
+			assert.Equal(t, err, common.NewErr("failed to make api key: unknown scope: everything", common.ErrCodeBadRequest))
+
+			newAPIKey, err := s.CreateAPIKey(context.Background(), user.ID, auth.APIKeyCreate{Name: "script", Scopes: []string{auth.APIKeyScopeUserRead}})
+			assert.Nil(t, err)
+			assert.True(t, strings.HasPrefix(newAPIKey.Key, auth.APIKeyPrefix+newAPIKey.ID.Hex()+"_"))
+
+			apiKey, apiKeyUser, err := s.CheckAPIKey(context.Background(), newAPIKey.Key)
+			assert.Nil(t, err)
+			assert.Equal(t, apiKey.ID, newAPIKey.ID)
+			assert.Equal(t, apiKeyUser.ID, user.ID)
+
+			_, _, err = s.CheckAPIKey(context.Background(), newAPIKey.Key+"x")
+			assert.Equal(t, err, auth.ErrInvalidAPIKey)
+
+			expiredAt := time.Now().Add(time.Second)
+			expiringAPIKey, err := s.CreateAPIKey(context.Background(), user.ID, auth.APIKeyCreate{Name: "expiring", ExpiresAt: &expiredAt})
+			assert.Nil(t, err)
+
+			apiKeys, err := s.APIKeys(context.Background(), user.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, len(apiKeys), 2)
+			assert.True(t, apiKeys[0].LastUsedAt != nil)
+
+			time.Sleep(time.Until(expiredAt))
+			_, _, err = s.CheckAPIKey(context.Background(), expiringAPIKey.Key)
+			assert.Equal(t, err, auth.ErrAPIKeyExpired)
+
+			assert.Nil(t, s.RevokeAPIKey(context.Background(), user.ID, newAPIKey.ID))
+			assert.Equal(t, s.RevokeAPIKey(context.Background(), user.ID, newAPIKey.ID), common.NewErr("cannot find api key", common.ErrCodeNotFound))
+
+			_, _, err = s.CheckAPIKey(context.Background(), newAPIKey.Key)
+			assert.Equal(t, err, auth.ErrInvalidAPIKey)
+		})
+
+		t.Run("and introspect and revoke its tokens", func(t *testing.T) {
+			_, tokens, err := s.Login(context.Background(), creds, "")
+			assert.Nil(t, err)
+
+			accessToken, err := s.SignToken(&tokens.AccessToken)
+			assert.Nil(t, err)
+			refreshToken, err := s.SignToken(&tokens.RefreshToken)
+			assert.Nil(t, err)
+
+			introspection, err := s.IntrospectToken(context.Background(), accessToken, "")
+			assert.Nil(t, err)
+			assert.True(t, introspection.Active)
+			assert.Equal(t, introspection.TokenType, auth.TokenTypeHintAccessToken)
+			assert.Equal(t, introspection.Subject, user.ID.Hex())
+			assert.Equal(t, introspection.Username, user.Name)
+			assert.Equal(t, introspection.SessionID, tokens.AccessToken.SessionID.Hex())
+			assert.Equal(t, introspection.ExpiresAt, tokens.AccessToken.ExpiresAt.Unix())
+
+			introspection, err = s.IntrospectToken(context.Background(), refreshToken, auth.TokenTypeHintAccessToken)
+			assert.Nil(t, err)
+			assert.True(t, introspection.Active)
+			assert.Equal(t, introspection.TokenType, auth.TokenTypeHintRefreshToken)
+
+			newAPIKey, err := s.CreateAPIKey(context.Background(), user.ID, auth.APIKeyCreate{Name: "service", Scopes: []string{auth.APIKeyScopeUserRead}})
+			assert.Nil(t, err)
+
+			introspection, err = s.IntrospectToken(context.Background(), newAPIKey.Key, "")
+			assert.Nil(t, err)
+			assert.True(t, introspection.Active)
+			assert.Equal(t, introspection.TokenType, auth.TokenTypeHintAPIKey)
+			assert.Equal(t, introspection.Scope, auth.APIKeyScopeUserRead)
+
+			userToken, err := s.SignUserToken(user)
+			assert.Nil(t, err)
+
+			for _, token := range []string{"not a token", newAPIKey.Key + "x", userToken} {
+				introspection, err := s.IntrospectToken(context.Background(), token, "")
+				assert.Nil(t, err)
+				assert.Equal(t, introspection, auth.Introspection{})
+			}
+
+			assert.Nil(t, s.RevokeToken(context.Background(), refreshToken, auth.TokenTypeHintRefreshToken))
+			assert.Nil(t, s.RevokeToken(context.Background(), refreshToken, auth.TokenTypeHintRefreshToken))
+
+			for _, token := range []string{accessToken, refreshToken} {
+				introspection, err := s.IntrospectToken(context.Background(), token, "")
+				assert.Nil(t, err)
+				assert.False(t, introspection.Active)
+			}
+
+			assert.Nil(t, s.RevokeToken(context.Background(), newAPIKey.Key, ""))
+			assert.Nil(t, s.RevokeToken(context.Background(), newAPIKey.Key, ""))
+
+			introspection, err = s.IntrospectToken(context.Background(), newAPIKey.Key, "")
+			assert.Nil(t, err)
+			assert.False(t, introspection.Active)
+		})
+
+		t.Run("and lock out failed logins", func(t *testing.T) {
+			throttledService := NewAuthService(
+				common.Config{
+					Auth: common.AuthConfig{
+						AccessTokenExpirySecs:  3600,
+						RefreshTokenExpiryDays: 1,
+						PasswordSalt:           "abcdefghijkl",
+						LoginThrottle: common.LoginThrottleConfig{
+							MaxAttempts:   3,
+							MaxIPAttempts: 3,
+							LockoutMins:   1,
+						},
+					},
+				},
+				crypter,
+				nil,
+				nil,
+				u.NewLogger(t),
+				mailer,
+				transactor,
+				userStore,
+				passwordStore,
+				refreshTokenStore,
+				apiKeyStore,
+				loginAttemptStore,
+				auditStore,
+				userDataStore,
+				inviteStore,
+			)
+
+			wrongCreds := auth.Credentials{creds.Username, "wrong password"}
+			for i := 0; i < 2; i++ {
+				_, _, err := throttledService.Login(context.Background(), wrongCreds, "10.0.0.1")
+				assert.Equal(t, err, common.NewErr("invalid password", common.ErrCodeBadRequest))
+			}
+
+			t.Run("but forget them after logging in", func(t *testing.T) {
+				_, _, err := throttledService.Login(context.Background(), creds, "10.0.0.1")
+				assert.Nil(t, err)
+
+				for i := 0; i < 2; i++ {
+					_, _, err := throttledService.Login(context.Background(), wrongCreds, "10.0.0.2")
+					assert.Equal(t, err, common.NewErr("invalid password", common.ErrCodeBadRequest))
+				}
+			})
+
+			t.Run("and then lock out the user however they log in", func(t *testing.T) {
+				_, _, err := throttledService.Login(context.Background(), auth.Credentials{user.Email, "wrong password"}, "10.0.0.3")
+				assert.Equal(t, err, common.NewErr("invalid password", common.ErrCodeBadRequest))
+
+				_, _, err = throttledService.Login(context.Background(), creds, "10.0.0.4")
+				assert.Equal(t, err, auth.ErrTooManyLoginAttempts(time.Minute))
+
+				_, _, err = throttledService.Login(context.Background(), auth.Credentials{user.Email, creds.Password}, "10.0.0.4")
+				assert.Equal(t, err, auth.ErrTooManyLoginAttempts(time.Minute))
+			})
+
+			t.Run("and then lock out the client ip", func(t *testing.T) {
+				_, _, err := throttledService.Login(context.Background(), auth.Credentials{"unknown", "password"}, "10.0.0.1")
+				assert.Equal(t, err, common.NewErr("cannot find user", common.ErrCodeNotFound))
+
+				_, _, err = throttledService.Login(context.Background(), auth.Credentials{"unknown", "password"}, "10.0.0.1")
+				assert.Equal(t, err, auth.ErrTooManyLoginAttempts(time.Minute))
+			})
+
+			t.Run("until an admin unlocks the user", func(t *testing.T) {
+				assert.Nil(t, throttledService.UnlockUser(context.Background(), user.ID, user.ID))
+
+				_, _, err := throttledService.Login(context.Background(), creds, "10.0.0.4")
+				assert.Nil(t, err)
+			})
+		})
+
+		t.Run("and record an audit event for each account operation", func(t *testing.T) {
+			page, err := s.AuditEvents(context.Background(), auth.AuditQuery{UserID: user.ID, Action: auth.AuditActionUnlockUser})
+			assert.Nil(t, err)
+			assert.Equal(t, len(page.Events), 1)
+			assert.Equal(t, page.Events[0].ActorID, user.ID)
+			assert.Equal(t, page.Events[0].Outcome, auth.AuditOutcomeSuccess)
+			assert.Equal(t, page.Next, "")
+
+			t.Run("and page through them newest first", func(t *testing.T) {
+				page, err := s.AuditEvents(context.Background(), auth.AuditQuery{UserID: user.ID, Action: auth.AuditActionLogin, Limit: 1})
+				assert.Nil(t, err)
+				assert.Equal(t, len(page.Events), 1)
+				assert.Equal(t, page.Events[0].Outcome, auth.AuditOutcomeSuccess)
+				assert.Equal(t, page.Next, page.Events[0].ID.Hex())
+
+				before, err := primitive.ObjectIDFromHex(page.Next)
+				assert.Nil(t, err)
+
+				page, err = s.AuditEvents(context.Background(), auth.AuditQuery{UserID: user.ID, Action: auth.AuditActionLogin, Before: before, Limit: 1})
+				assert.Nil(t, err)
+				assert.Equal(t, len(page.Events), 1)
+				assert.Equal(t, page.Events[0].Outcome, auth.AuditOutcomeDenied)
+				assert.Equal(t, page.Events[0].Error, "invalid password")
+			})
+		})
+
+		t.Run("and export everything stored about the user", func(t *testing.T) {
+			export, err := s.ExportUser(context.Background(), user.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, export.User.ID, user.ID)
+			assert.Equal(t, len(export.Data), len(namespaces.Registry))
+
+			users := export.Data[namespaces.Namespace{&namespaces.DBAuth, &namespaces.CollUsers}.String()]
+			assert.Equal(t, len(users), 1)
+			assert.Equal(t, users[0][namespaces.FieldName], user.Name)
+
+			passwords := export.Data[namespaces.Namespace{&namespaces.DBAuth, &namespaces.CollPasswords}.String()]
+			assert.Equal(t, len(passwords), 1)
+			_, ok := passwords[0][namespaces.FieldHashedPassword]
+			assert.False(t, ok)
+		})
+
+		t.Run("and delete the user once they enter their password", func(t *testing.T) {
+			assert.Equal(t, s.DeleteUser(context.Background(), user.ID, primitive.NilObjectID, "wrong password"), common.NewErr("invalid password", common.ErrCodeBadRequest))
+
+			tokens, err := s.makeTOTPChallenge(context.Background(), user, time.Now())
+			assert.Nil(t, err)
+
+			assert.Nil(t, s.DeleteUser(context.Background(), user.ID, primitive.NilObjectID, creds.Password))
+
+			password, err := passwordStore.FindByUsername(context.Background(), user.Name)
+			assert.Nil(t, err)
+			assert.True(t, password.TOTPChallengeID.IsZero())
+
+			_, _, err = s.LoginTOTP(context.Background(), *tokens.Challenge, "000000", "")
+			assert.Equal(t, err, auth.ErrInvalidSession)
+
+			_, _, err = s.makeLoginSession(context.Background(), user.ID, time.Now())
+			assert.Equal(t, err, common.NewErr("cannot find user", common.ErrCodeNotFound))
+
+			_, _, err = s.Login(context.Background(), creds, "")
+			assert.Equal(t, err, common.NewErr("cannot find user", common.ErrCodeNotFound))
+
+			deletedUser, err := userStore.FindByID(context.Background(), user.ID)
+			assert.Nil(t, err)
+			assert.True(t, deletedUser.Deleted())
+			assert.Equal(t, len(deletedUser.Sessions), 0)
+
+			t.Run("and then purge its data", func(t *testing.T) {
+				count, err := s.PurgeUsers(context.Background(), time.Now())
+				assert.Nil(t, err)
+				assert.Equal(t, count, 1)
+
+				_, err = userStore.FindByID(context.Background(), user.ID)
+				assert.Equal(t, err, common.NewErr("cannot find user", common.ErrCodeNotFound))
+
+				_, err = passwordStore.FindByUsername(context.Background(), user.Name)
+				assert.NotNil(t, err)
+
+				page, err := s.AuditEvents(context.Background(), auth.AuditQuery{UserID: user.ID, Action: auth.AuditActionPurgeUser})
+				assert.Nil(t, err)
+				assert.Equal(t, len(page.Events), 1)
+			})
+		})
 	})
+
+	t.Run("should delete a user without a password once they login again", func(t *testing.T) {
+		oidcUser := auth.User{
+			Name:       "oidc-only-user",
+			Email:      "oidc-only-user@domain.com",
+			Status:     auth.UserStatusVerified,
+			Identities: []auth.Identity{{"fake", "subject"}},
+		}
+		assert.Nil(t, oidcUser.Validate())
+		assert.Nil(t, userStore.Insert(context.Background(), oidcUser))
+
+		_, oldTokens, err := s.makeSession(context.Background(), oidcUser.ID, primitive.NilObjectID, auth.RefreshToken{}, time.Now().Add(-time.Hour))
+		assert.Nil(t, err)
+
+		err = s.DeleteUser(context.Background(), oidcUser.ID, oldTokens.AccessToken.SessionID, "")
+		assert.Equal(t, err, auth.ErrMustReauthenticate)
+
+		_, tokens, err := s.makeLoginSession(context.Background(), oidcUser.ID, time.Now())
+		assert.Nil(t, err)
+
+		assert.Nil(t, s.DeleteUser(context.Background(), oidcUser.ID, tokens.AccessToken.SessionID, ""))
+
+		deletedUser, err := userStore.FindByID(context.Background(), oidcUser.ID)
+		assert.Nil(t, err)
+		assert.True(t, deletedUser.Deleted())
+	})
+
+	t.Run("should only register users the registration mode lets in", func(t *testing.T) {
+		newService := func(registration common.RegistrationConfig) AuthService {
+			return NewAuthService(
+				common.Config{
+					Auth: common.AuthConfig{
+						AccessTokenExpirySecs:  3600,
+						RefreshTokenExpiryDays: 1,
+						PasswordSalt:           "abcdefghijkl",
+						Registration:           registration,
+					},
+				},
+				crypter,
+				nil,
+				nil,
+				u.NewLogger(t),
+				&testMailer{},
+				transactor,
+				userStore,
+				passwordStore,
+				refreshTokenStore,
+				apiKeyStore,
+				loginAttemptStore,
+				auditStore,
+				userDataStore,
+				inviteStore,
+			)
+		}
+
+		t.Run("and none when closed", func(t *testing.T) {
+			closedService := newService(common.RegistrationConfig{Mode: common.RegistrationModeClosed})
+
+			_, err := closedService.CreateUser(context.Background(), auth.Registration{
+				Credentials: auth.Credentials{"closed-user", "password"},
+				Email:       "closed-user@domain.com",
+			})
+			assert.Equal(t, err, auth.ErrRegistrationClosed)
+		})
+
+		t.Run("and only allowed domains", func(t *testing.T) {
+			allowlistService := newService(common.RegistrationConfig{
+				Mode:           common.RegistrationModeDomainAllowlist,
+				AllowedDomains: []string{"Allowed.com"},
+			})
+
+			_, err := allowlistService.CreateUser(context.Background(), auth.Registration{
+				Credentials: auth.Credentials{"other-domain-user", "password"},
+				Email:       "user@other.com",
+			})
+			assert.Equal(t, err, auth.ErrEmailDomainNotAllowed)
+
+			_, err = allowlistService.CreateUser(context.Background(), auth.Registration{
+				Credentials: auth.Credentials{"allowed-domain-user", "password"},
+				Email:       "user@allowed.com",
+			})
+			assert.Nil(t, err)
+		})
+
+		t.Run("and only once per invite", func(t *testing.T) {
+			inviteService := newService(common.RegistrationConfig{
+				Mode:              common.RegistrationModeInvite,
+				InviteExpiryHours: 1,
+			})
+
+			_, err := inviteService.CreateUser(context.Background(), auth.Registration{
+				Credentials: auth.Credentials{"uninvited-user", "password"},
+				Email:       "uninvited-user@domain.com",
+			})
+			assert.Equal(t, err, auth.ErrInviteRequired)
+
+			inviterID := primitive.NewObjectID()
+			newInvite, err := inviteService.CreateInvite(context.Background(), inviterID, auth.InviteCreate{UserType: auth.UserTypeNormal})
+			assert.Nil(t, err)
+
+			user, err := inviteService.CreateUser(context.Background(), auth.Registration{
+				Credentials: auth.Credentials{"invited-user", "password"},
+				Email:       "invited-user@domain.com",
+				InviteCode:  newInvite.Code,
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, user.Type, auth.UserTypeNormal)
+			assert.Equal(t, user.InvitedBy, inviterID)
+
+			_, err = inviteService.CreateUser(context.Background(), auth.Registration{
+				Credentials: auth.Credentials{"reinvited-user", "password"},
+				Email:       "reinvited-user@domain.com",
+				InviteCode:  newInvite.Code,
+			})
+			assert.Equal(t, err, auth.ErrInvalidInvite)
+
+			invites, err := inviteService.Invites(context.Background())
+			assert.Nil(t, err)
+			assert.Equal(t, len(invites), 1)
+			assert.Equal(t, invites[0].UsedBy, user.ID)
+		})
+	})
+
+	t.Run("should only accept new passwords the password policy allows", func(t *testing.T) {
+		breached, err := auth.ReadBreachedPasswords(strings.NewReader("5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3\n"))
+		assert.Nil(t, err)
+
+		policyService := NewAuthService(
+			common.Config{
+				Auth: common.AuthConfig{
+					AccessTokenExpirySecs:  3600,
+					RefreshTokenExpiryDays: 1,
+					PasswordSalt:           "abcdefghijkl",
+					PasswordPolicy: common.PasswordPolicyConfig{
+						MinLength:           8,
+						MinCharacterClasses: 2,
+					},
+				},
+			},
+			crypter,
+			nil,
+			breached,
+			u.NewLogger(t),
+			&testMailer{},
+			transactor,
+			userStore,
+			passwordStore,
+			refreshTokenStore,
+			apiKeyStore,
+			loginAttemptStore,
+			auditStore,
+			userDataStore,
+			inviteStore,
+		)
+
+		_, err = policyService.CreateUser(context.Background(), auth.Registration{
+			Credentials: auth.Credentials{"policy-user", "password"},
+			Email:       "policy-user@domain.com",
+		})
+		assert.Equal(t, err, common.NewErr("password does not meet the password policy", common.ErrCodeBadRequest))
+		assert.Equal(t, err.(common.ErrDataProvider).Data()[auth.ErrDataPasswordViolations], []auth.PasswordViolation{
+			{auth.PasswordRuleCharacterClasses, 2},
+			{auth.PasswordRuleBreached, 0},
+		})
+
+		_, err = userStore.FindByName(context.Background(), "policy-user")
+		assert.Equal(t, err, common.NewErr("cannot find user", common.ErrCodeNotFound))
+
+		policyUser, err := policyService.CreateUser(context.Background(), auth.Registration{
+			Credentials: auth.Credentials{"policy-user", "c0rrect horse"},
+			Email:       "policy-user@domain.com",
+		})
+		assert.Nil(t, err)
+
+		_, tokens, err := policyService.Login(context.Background(), auth.Credentials{"policy-user", "c0rrect horse"}, "")
+		assert.Nil(t, err)
+
+		err = policyService.ChangePassword(context.Background(), policyUser.ID, tokens.AccessToken.SessionID, auth.PasswordChange{
+			CurrentPassword: "c0rrect horse",
+			NewPassword:     "Policy-User 2",
+		})
+		assert.Equal(t, err.(common.ErrDataProvider).Data()[auth.ErrDataPasswordViolations], []auth.PasswordViolation{
+			{auth.PasswordRuleUserInfo, 0},
+		})
+
+		assert.Nil(t, policyService.ChangePassword(context.Background(), policyUser.ID, tokens.AccessToken.SessionID, auth.PasswordChange{
+			CurrentPassword: "c0rrect horse",
+			NewPassword:     "battery stapl3",
+		}))
+
+		_, resetToken, err := policyService.RequestPasswordReset(context.Background(), "policy-user@domain.com")
+		assert.Nil(t, err)
+
+		err = policyService.ResetPassword(context.Background(), auth.PasswordReset{Token: resetToken, Password: "password"})
+		assert.Equal(t, err, common.NewErr("password does not meet the password policy", common.ErrCodeBadRequest))
+
+		assert.Nil(t, policyService.ResetPassword(context.Background(), auth.PasswordReset{Token: resetToken, Password: "stapl3 battery"}))
+
+		_, _, err = policyService.Login(context.Background(), auth.Credentials{"policy-user", "stapl3 battery"}, "")
+		assert.Nil(t, err)
+	})
+
+	t.Run("should let an admin impersonate a user", func(t *testing.T) {
+		admin := auth.User{Name: "impersonating-admin", Email: "impersonating-admin@domain.com", Type: auth.UserTypeAdmin}
+		assert.Nil(t, admin.Validate())
+		assert.Nil(t, userStore.Insert(context.Background(), admin))
+
+		_, adminTokens, err := s.makeSession(context.Background(), admin.ID, primitive.NilObjectID, auth.RefreshToken{}, time.Now())
+		assert.Nil(t, err)
+
+		target, err := s.CreateUser(context.Background(), auth.Registration{
+			Credentials: auth.Credentials{"impersonated-user", "password"},
+			Email:       "impersonated-user@domain.com",
+		})
+		assert.Nil(t, err)
+
+		_, _, err = s.Impersonate(context.Background(), adminTokens.AccessToken, admin.ID)
+		assert.Equal(t, err, common.NewErr("cannot impersonate yourself", common.ErrCodeBadRequest))
+
+		user, tokens, err := s.Impersonate(context.Background(), adminTokens.AccessToken, target.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, user.ID, target.ID)
+		assert.Equal(t, tokens.AccessToken.UserID, target.ID)
+		assert.Equal(t, tokens.AccessToken.Actor, admin.ID)
+		assert.Equal(t, tokens.RefreshToken.Actor, admin.ID)
+
+		admin, err = userStore.FindByID(context.Background(), admin.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, len(admin.Sessions), 0)
+
+		t.Run("and keep the actor when refreshing", func(t *testing.T) {
+			_, refreshedTokens, err := s.RefreshAccess(context.Background(), tokens.RefreshToken)
+			assert.Nil(t, err)
+			assert.Equal(t, refreshedTokens.AccessToken.Actor, admin.ID)
+			tokens = refreshedTokens
+
+			sessions, err := s.Sessions(context.Background(), target.ID, tokens.AccessToken.SessionID)
+			assert.Nil(t, err)
+			assert.Equal(t, len(sessions), 1)
+			assert.Equal(t, *sessions[0].ImpersonatedBy, admin.ID)
+		})
+
+		t.Run("and not impersonate again while impersonating", func(t *testing.T) {
+			_, _, err := s.Impersonate(context.Background(), tokens.AccessToken, admin.ID)
+			assert.Equal(t, err, auth.ErrImpersonating)
+		})
+
+		t.Run("and name the admin on audit events made while impersonating", func(t *testing.T) {
+			ctx := AttachAuditImpersonator(context.Background(), admin.ID)
+			assert.Nil(t, s.Logout(ctx, target.ID, primitive.NewObjectID()))
+
+			page, err := s.AuditEvents(context.Background(), auth.AuditQuery{UserID: admin.ID, Action: auth.AuditActionLogout})
+			assert.Nil(t, err)
+			assert.Equal(t, len(page.Events), 1)
+			assert.Equal(t, page.Events[0].ActorID, target.ID)
+			assert.Equal(t, page.Events[0].ImpersonatorID, admin.ID)
+		})
+
+		t.Run("and then return the admin to a session of their own", func(t *testing.T) {
+			user, adminTokens, err := s.EndImpersonation(context.Background(), tokens.AccessToken)
+			assert.Nil(t, err)
+			assert.Equal(t, user.ID, admin.ID)
+			assert.Equal(t, adminTokens.AccessToken.UserID, admin.ID)
+			assert.False(t, adminTokens.AccessToken.Impersonating())
+
+			target, err := userStore.FindByID(context.Background(), target.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, len(target.Sessions), 0)
+
+			_, _, err = s.EndImpersonation(context.Background(), adminTokens.AccessToken)
+			assert.Equal(t, err, auth.ErrNotImpersonating)
+
+			page, err := s.AuditEvents(context.Background(), auth.AuditQuery{UserID: admin.ID, Action: auth.AuditActionEndImpersonation})
+			assert.Nil(t, err)
+			assert.Equal(t, len(page.Events), 2)
+			assert.Equal(t, page.Events[1].Outcome, auth.AuditOutcomeSuccess)
+		})
+
+		t.Run("but never impersonate another admin", func(t *testing.T) {
+			otherAdmin := auth.User{Name: "impersonated-admin", Email: "impersonated-admin@domain.com", Type: auth.UserTypeMe}
+			assert.Nil(t, otherAdmin.Validate())
+			assert.Nil(t, userStore.Insert(context.Background(), otherAdmin))
+
+			_, _, err := s.Impersonate(context.Background(), adminTokens.AccessToken, otherAdmin.ID)
+			assert.Equal(t, err, auth.ErrCannotImpersonate)
+		})
+	})
+}
+
+func TestAuthServiceParseToken(t *testing.T) {
+	s := NewAuthService(
+		common.Config{
+			Auth: common.AuthConfig{
+				JWTSecret:     "secret",
+				ClockSkewSecs: 30,
+			},
+			Server: common.ServerConfig{
+				BaseURL: "http://localhost",
+			},
+		},
+		nil,
+		nil,
+		nil,
+		u.NewLogger(t),
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	now := time.Now()
+	accessToken := s.makeAccessToken(primitive.NewObjectID(), primitive.NewObjectID(), now)
+	refreshToken := s.makeRefreshToken(accessToken, primitive.NewObjectID())
+	userToken := auth.UserToken{auth.User{ID: accessToken.UserID, Name: "name", Email: "email@domain.com"}, s.jwtIssuer, now}
+
+	sign := func(claims jwt.Claims) string {
+		token, err := s.SignToken(claims)
+		assert.Nil(t, err)
+		return token
+	}
+
+	t.Run("should parse each kind of token", func(t *testing.T) {
+		var parsedAccessToken auth.AccessToken
+		assert.Nil(t, s.ParseToken(sign(&accessToken), &parsedAccessToken))
+		assert.Equal(t, parsedAccessToken.SessionID, accessToken.SessionID)
+
+		var parsedRefreshToken auth.RefreshToken
+		assert.Nil(t, s.ParseToken(sign(&refreshToken), &parsedRefreshToken))
+		assert.Equal(t, parsedRefreshToken.SessionID, accessToken.SessionID)
+
+		impersonationToken := accessToken
+		impersonationToken.Actor = primitive.NewObjectID()
+		var parsedImpersonationToken auth.AccessToken
+		assert.Nil(t, s.ParseToken(sign(&impersonationToken), &parsedImpersonationToken))
+		assert.Equal(t, parsedImpersonationToken.Actor, impersonationToken.Actor)
+		assert.False(t, parsedAccessToken.Impersonating())
+
+		var parsedUserToken auth.UserToken
+		assert.Nil(t, s.ParseToken(sign(&userToken), &parsedUserToken))
+		assert.Equal(t, parsedUserToken.User.ID, accessToken.UserID)
+		assert.Equal(t, parsedUserToken.User.Email, "email@domain.com")
+	})
+
+	t.Run("should tell access and refresh tokens apart whatever the hint", func(t *testing.T) {
+		for _, hint := range []string{"", auth.TokenTypeHintAccessToken, auth.TokenTypeHintRefreshToken} {
+			tokenType, parsedToken, err := s.parseSessionToken(sign(&accessToken), hint)
+			assert.Nil(t, err)
+			assert.Equal(t, tokenType, auth.TokenTypeHintAccessToken)
+			assert.Equal(t, parsedToken.SessionID, accessToken.SessionID)
+
+			tokenType, parsedToken, err = s.parseSessionToken(sign(&refreshToken), hint)
+			assert.Nil(t, err)
+			assert.Equal(t, tokenType, auth.TokenTypeHintRefreshToken)
+			assert.Equal(t, parsedToken.SessionID, accessToken.SessionID)
+
+			_, _, err = s.parseSessionToken(sign(&userToken), hint)
+			assert.NotNil(t, err)
+		}
+	})
+
+	t.Run("should not parse one kind of token as another", func(t *testing.T) {
+		errWrongType := auth.ErrInvalidToken(errors.New("token has wrong type"))
+
+		assert.Equal(t, s.ParseToken(sign(&refreshToken), &auth.AccessToken{}), errWrongType)
+		assert.Equal(t, s.ParseToken(sign(&accessToken), &auth.RefreshToken{}), errWrongType)
+
+		challenge := auth.TOTPChallenge{primitive.NewObjectID(), accessToken.UserID, s.jwtIssuer, now, now.Add(time.Minute)}
+		assert.Equal(t, s.ParseToken(sign(&challenge), &auth.AccessToken{}), auth.ErrInvalidToken(errors.New("token has wrong audience")))
+		assert.Equal(t, s.ParseToken(sign(&accessToken), &auth.TOTPChallenge{}), auth.ErrInvalidToken(errors.New("token has wrong audience")))
+	})
+
+	t.Run("should not parse a token from another issuer", func(t *testing.T) {
+		otherToken := accessToken
+		otherToken.Issuer = "http://elsewhere"
+		assert.Equal(t, s.ParseToken(sign(&otherToken), &auth.AccessToken{}), auth.ErrInvalidToken(errors.New("token has wrong issuer")))
+	})
+
+	t.Run("should not parse a token for another audience", func(t *testing.T) {
+		otherToken := accessToken
+		otherToken.Audience = []string{"api/admin/v2"}
+		assert.Equal(t, s.ParseToken(sign(&otherToken), &auth.AccessToken{}), auth.ErrInvalidToken(errors.New("token has wrong audience")))
+	})
+
+	t.Run("should allow for clock skew", func(t *testing.T) {
+		skewedToken := s.makeAccessToken(accessToken.SessionID, accessToken.UserID, now.Add(20*time.Second))
+		assert.Nil(t, s.ParseToken(sign(&skewedToken), &auth.AccessToken{}))
+
+		expiredToken := s.makeAccessToken(accessToken.SessionID, accessToken.UserID, now.Add(-s.jwtDurationAccess-20*time.Second))
+		assert.Nil(t, s.ParseToken(sign(&expiredToken), &auth.AccessToken{}))
+
+		t.Run("but only so far", func(t *testing.T) {
+			futureToken := s.makeAccessToken(accessToken.SessionID, accessToken.UserID, now.Add(time.Minute))
+			assert.Equal(t, s.ParseToken(sign(&futureToken), &auth.AccessToken{}), auth.ErrInvalidToken(errors.New("token is not valid yet")))
+
+			expiredToken := s.makeAccessToken(accessToken.SessionID, accessToken.UserID, now.Add(-s.jwtDurationAccess-time.Minute))
+			assert.Equal(t, s.ParseToken(sign(&expiredToken), &auth.AccessToken{}), auth.ErrInvalidToken(errors.New("token is expired")))
+		})
+	})
+}
+
+type testMailer struct {
+	messages []mail.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg mail.Message) error {
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// lastToken finds the token linked to in the last message sent with the subject
+func (m *testMailer) lastToken(t *testing.T, subject string) string {
+	t.Helper()
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].Subject != subject {
+			continue
+		}
+		for _, line := range strings.Split(m.messages[i].Body, "\n") {
+			if link, err := url.Parse(line); err == nil && link.Query().Get("token") != "" {
+				return link.Query().Get("token")
+			}
+		}
+	}
+	t.Fatalf("failed to find a token in messages with subject: %s", subject)
+	return ""
+}
+
+func TestAuthServiceCheckServiceClient(t *testing.T) {
+	s := NewAuthService(
+		common.Config{
+			Auth: common.AuthConfig{
+				ServiceClients: []common.ServiceClientConfig{{"billing", "secret"}},
+			},
+		},
+		nil,
+		nil,
+		nil,
+		u.NewLogger(t),
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+
+	assert.Nil(t, s.CheckServiceClient("billing", "secret"))
+	assert.Equal(t, s.CheckServiceClient("billing", "wrong secret"), auth.ErrInvalidClient)
+	assert.Equal(t, s.CheckServiceClient("unknown", "secret"), auth.ErrInvalidClient)
+	assert.Equal(t, s.CheckServiceClient("", ""), auth.ErrInvalidClient)
 }
@@ -0,0 +1,245 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+var (
+	errTOTPUnavailable = common.NewErr("two-factor authentication is unavailable", common.ErrCodeServerUnavailable)
+
+	recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+// EnrollTOTP starts enrollment with a new secret, it is not used
+// to login until confirmed with a code from the user's authenticator
+func (s *AuthService) EnrollTOTP(ctx context.Context, userID primitive.ObjectID) (_ auth.TOTPEnrollment, err error) {
+	defer func() { s.audit(ctx, auditUser(auth.AuditActionEnrollTOTP, userID), err) }()
+
+	if s.crypter == nil {
+		return auth.TOTPEnrollment{}, errTOTPUnavailable
+	}
+
+	user, err := s.userStore.FindByID(ctx, userID)
+	if err != nil {
+		return auth.TOTPEnrollment{}, err
+	}
+
+	password, err := s.passwordStore.FindByUsername(ctx, user.Name)
+	if err != nil {
+		return auth.TOTPEnrollment{}, err
+	}
+	if password.TOTPEnabled() {
+		return auth.TOTPEnrollment{}, common.NewErr("two-factor authentication is already enabled", common.ErrCodeBadRequest)
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		return auth.TOTPEnrollment{}, common.WrapErr(fmt.Errorf("cannot make totp secret: %s", err), common.ErrCodeServer)
+	}
+
+	encryptedSecret, err := s.crypter.Encrypt(secret)
+	if err != nil {
+		return auth.TOTPEnrollment{}, common.WrapErr(fmt.Errorf("failed to encrypt totp secret: %s", err), common.ErrCodeServer)
+	}
+
+	if err := s.passwordStore.SetPendingTOTP(ctx, user.Name, primitive.Binary{Data: encryptedSecret}); err != nil {
+		return auth.TOTPEnrollment{}, err
+	}
+
+	return auth.TOTPEnrollment{
+		Secret: auth.TOTPEncodeSecret(secret),
+		URI:    auth.TOTPURI(s.totpIssuer, user.Name, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables the pending secret and returns the user's recovery codes,
+// these are only ever returned here since just their hashes are stored
+func (s *AuthService) ConfirmTOTP(ctx context.Context, userID primitive.ObjectID, code string) (_ auth.RecoveryCodes, err error) {
+	defer func() { s.audit(ctx, auditUser(auth.AuditActionConfirmTOTP, userID), err) }()
+
+	user, err := s.userStore.FindByID(ctx, userID)
+	if err != nil {
+		return auth.RecoveryCodes{}, err
+	}
+
+	password, err := s.passwordStore.FindByUsername(ctx, user.Name)
+	if err != nil {
+		return auth.RecoveryCodes{}, err
+	}
+	if len(password.TOTPPendingSecret.Data) == 0 {
+		return auth.RecoveryCodes{}, common.NewErr("must enroll in totp first", common.ErrCodeBadRequest)
+	}
+
+	secret, err := s.decryptTOTPSecret(password.TOTPPendingSecret)
+	if err != nil {
+		return auth.RecoveryCodes{}, err
+	}
+
+	if _, ok := auth.ValidateTOTP(secret, code, time.Now()); !ok {
+		return auth.RecoveryCodes{}, auth.ErrInvalidTOTPCode
+	}
+
+	recoveryCodes, err := makeRecoveryCodes()
+	if err != nil {
+		return auth.RecoveryCodes{}, err
+	}
+
+	hashedCodes := make([]string, 0, len(recoveryCodes))
+	for _, recoveryCode := range recoveryCodes {
+		hashedCodes = append(hashedCodes, hashRecoveryCode(recoveryCode))
+	}
+
+	if err := s.passwordStore.EnableTOTP(ctx, user.Name, password.TOTPPendingSecret, hashedCodes); err != nil {
+		return auth.RecoveryCodes{}, err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, user.ID.Hex()).Info("enabled two-factor authentication")
+
+	return auth.RecoveryCodes{recoveryCodes}, nil
+}
+
+func (s *AuthService) DisableTOTP(ctx context.Context, userID primitive.ObjectID, currentPassword string) (err error) {
+	defer func() { s.audit(ctx, auditUser(auth.AuditActionDisableTOTP, userID), err) }()
+
+	user, err := s.userStore.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.verifyPassword(ctx, auth.Credentials{user.Name, currentPassword}); err != nil {
+		return err
+	}
+
+	if err := s.passwordStore.DisableTOTP(ctx, user.Name); err != nil {
+		return err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, user.ID.Hex()).Info("disabled two-factor authentication")
+
+	return nil
+}
+
+// LoginTOTP completes a login with a code from the user's authenticator or one of their recovery codes.
+// Wrong codes count as failed logins of the user and client ip, as wrong passwords do
+func (s *AuthService) LoginTOTP(ctx context.Context, challenge auth.TOTPChallenge, code, ipAddress string) (_ auth.User, _ auth.Tokens, err error) {
+	now := time.Now()
+
+	defer func() { s.audit(ctx, auditUser(auth.AuditActionLoginTOTP, challenge.UserID), err) }()
+
+	user, err := s.userStore.FindByID(ctx, challenge.UserID)
+	if err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+	if user.Deleted() {
+		return auth.User{}, auth.Tokens{}, auth.ErrInvalidSession
+	}
+
+	attemptKeys := s.userLoginAttemptKeys(user, ipAddress)
+	if err := s.checkLoginAttempts(ctx, attemptKeys, now); err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+
+	password, err := s.passwordStore.FindByUsername(ctx, user.Name)
+	if err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+	if !password.TOTPEnabled() || password.TOTPChallengeID != challenge.ID {
+		return auth.User{}, auth.Tokens{}, auth.ErrInvalidSession
+	}
+
+	if err := s.verifyTOTPCode(ctx, user, password, code, now); err != nil {
+		s.recordLoginFailure(ctx, attemptKeys, err, now)
+		return auth.User{}, auth.Tokens{}, err
+	}
+
+	if err := s.passwordStore.ConsumeTOTPChallenge(ctx, user.Name, challenge.ID); err != nil {
+		return auth.User{}, auth.Tokens{}, err
+	}
+
+	return s.makeLoginSession(ctx, user.ID, now)
+}
+
+// makeTOTPChallenge issues the challenge a user with a second factor exchanges
+// for a session, any challenge issued before it can no longer be used
+func (s *AuthService) makeTOTPChallenge(ctx context.Context, user auth.User, now time.Time) (auth.Tokens, error) {
+	challenge := auth.TOTPChallenge{
+		ID:        primitive.NewObjectID(),
+		UserID:    user.ID,
+		Issuer:    s.jwtIssuer,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.totpChallengeTTL),
+	}
+	if err := s.passwordStore.SetTOTPChallenge(ctx, user.Name, challenge.ID); err != nil {
+		return auth.Tokens{}, err
+	}
+	return auth.Tokens{Challenge: &challenge}, nil
+}
+
+// verifyTOTPCode uses up the code so it cannot be replayed,
+// codes of the authenticator's length are told apart from recovery codes
+func (s *AuthService) verifyTOTPCode(ctx context.Context, user auth.User, password auth.Password, code string, now time.Time) error {
+	if len(code) != auth.TOTPDigits {
+		if err := s.passwordStore.ConsumeRecoveryCode(ctx, user.Name, hashRecoveryCode(code)); err != nil {
+			return err
+		}
+		s.logger.With(common.LoggerFieldUserID, user.ID.Hex()).Warn("used a recovery code to login")
+		return nil
+	}
+
+	secret, err := s.decryptTOTPSecret(password.TOTPSecret)
+	if err != nil {
+		return err
+	}
+
+	step, ok := auth.ValidateTOTP(secret, code, now)
+	if !ok {
+		return auth.ErrInvalidTOTPCode
+	}
+	return s.passwordStore.UseTOTPStep(ctx, user.Name, step)
+}
+
+func (s *AuthService) decryptTOTPSecret(encryptedSecret primitive.Binary) ([]byte, error) {
+	if s.crypter == nil {
+		return nil, errTOTPUnavailable
+	}
+	secret, err := s.crypter.Decrypt(encryptedSecret.Data)
+	if err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to decrypt totp secret: %s", err), common.ErrCodeServer)
+	}
+	return secret, nil
+}
+
+func makeRecoveryCodes() ([]string, error) {
+	raw := make([]byte, recoveryCodeEncoding.DecodedLen(recoveryCodeLength))
+
+	recoveryCodes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		if _, err := rand.Read(raw); err != nil {
+			return nil, common.WrapErr(fmt.Errorf("cannot make recovery codes: %s", err), common.ErrCodeServer)
+		}
+		code := recoveryCodeEncoding.EncodeToString(raw)[:recoveryCodeLength]
+		recoveryCodes = append(recoveryCodes, code[:recoveryCodeLength/2]+"-"+code[recoveryCodeLength/2:])
+	}
+	return recoveryCodes, nil
+}
+
+// hashRecoveryCode ignores case and separators so codes can be typed however they were written down
+func hashRecoveryCode(recoveryCode string) string {
+	normalized := strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(recoveryCode))
+	return hashToken(normalized)
+}
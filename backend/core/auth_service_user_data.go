@@ -0,0 +1,123 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// reauthWindow is how recently users without a password must have logged in to confirm it is them
+const reauthWindow = 10 * time.Minute
+
+// DeleteUser soft deletes the user once they confirm it is them, they can no longer
+// login and their sessions and api keys are revoked right away while the rest of their
+// data is purged when the grace period passes, or right away if so configured
+func (s *AuthService) DeleteUser(ctx context.Context, userID, sessionID primitive.ObjectID, currentPassword string) (err error) {
+	defer func() { s.audit(ctx, auditUser(auth.AuditActionDeleteUser, userID), err) }()
+
+	user, err := s.userStore.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.reauthenticate(ctx, user, sessionID, currentPassword, time.Now()); err != nil {
+		return err
+	}
+
+	if s.purgeImmediately {
+		return s.purgeUser(ctx, user)
+	}
+
+	if err := s.userStore.MarkDeleted(ctx, user.ID, time.Now()); err != nil {
+		return err
+	}
+
+	if err := s.logoutAll(ctx, user.ID); err != nil {
+		return err
+	}
+
+	if err := s.passwordStore.ClearTOTPChallenge(ctx, user.Name); err != nil {
+		return err
+	}
+
+	if err := s.apiKeyStore.DeleteByUserID(ctx, user.ID); err != nil {
+		return err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, user.ID.Hex()).Info("deleted user")
+
+	return nil
+}
+
+// reauthenticate confirms it is the user by their password, users created by an oidc
+// provider have none and instead must have logged into the session just now
+func (s *AuthService) reauthenticate(ctx context.Context, user auth.User, sessionID primitive.ObjectID, currentPassword string, now time.Time) error {
+	_, err := s.verifyPassword(ctx, auth.Credentials{user.Name, currentPassword})
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(common.ErrCodeProvider); !ok || e.Code() != common.ErrCodeNotFound {
+		return err
+	}
+
+	session, err := s.refreshTokenStore.FindByID(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if session.UserID != user.ID || now.Sub(session.CreatedAt) > reauthWindow {
+		return auth.ErrMustReauthenticate
+	}
+	return nil
+}
+
+// PurgeUsers removes the data of every user deleted longer than the grace period ago
+func (s *AuthService) PurgeUsers(ctx context.Context, now time.Time) (int, error) {
+	users, err := s.userStore.FindDeleted(ctx, now.Add(-s.accountGrace))
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, user := range users {
+		if err := s.purgeUser(ctx, user); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (s *AuthService) purgeUser(ctx context.Context, user auth.User) (err error) {
+	defer func() {
+		s.audit(ctx, auth.AuditEvent{Action: auth.AuditActionPurgeUser, Username: user.Name, TargetType: auth.AuditTargetUser, TargetID: user.ID}, err)
+	}()
+
+	if err := s.userDataStore.Purge(ctx, user); err != nil {
+		return err
+	}
+
+	s.logger.With(common.LoggerFieldUserID, user.ID.Hex()).Info("purged user")
+
+	return nil
+}
+
+// ExportUser collects everything stored about the user from every namespace
+func (s *AuthService) ExportUser(ctx context.Context, userID primitive.ObjectID) (_ auth.UserExport, err error) {
+	defer func() { s.audit(ctx, auditUser(auth.AuditActionExportUser, userID), err) }()
+
+	user, err := s.userStore.FindByID(ctx, userID)
+	if err != nil {
+		return auth.UserExport{}, err
+	}
+
+	data, err := s.userDataStore.Export(ctx, user)
+	if err != nil {
+		return auth.UserExport{}, err
+	}
+
+	return auth.UserExport{user, time.Now(), data}, nil
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/core/mongodb"
+	"github.com/shake-on-it/app-tmpl/backend/core/namespaces"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type InviteStore interface {
+	Find(ctx context.Context) ([]auth.Invite, error)
+
+	Insert(ctx context.Context, invite auth.Invite) error
+
+	Consume(ctx context.Context, hashedCode string, usedBy primitive.ObjectID, now time.Time) (auth.Invite, error)
+	Release(ctx context.Context, id primitive.ObjectID) error
+
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+func NewInviteStore(client *mongo.Client) (InviteStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), common.TimeoutServerOp)
+	defer cancel()
+
+	coll, err := mongodb.NewColl(ctx, client, namespaces.DBAuth, namespaces.CollInvites, mongodb.Index{
+		Unique: true,
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldHashedCode, 1}),
+	}, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldExpiresAt, 1}),
+		ExpireAfterSeconds: mongodb.ExpireAfter(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &inviteStore{coll}, nil
+}
+
+type inviteStore struct {
+	coll *mongo.Collection
+}
+
+func (s *inviteStore) Find(ctx context.Context) ([]auth.Invite, error) {
+	cursor, err := s.coll.Find(
+		ctx,
+		bson.D{},
+		options.Find().SetSort(bson.D{{namespaces.FieldID, 1}}),
+	)
+	if err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to find invites: %s", err), common.ErrCodeServer)
+	}
+
+	invites := []auth.Invite{}
+	if err := cursor.All(ctx, &invites); err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to read invites: %s", err), common.ErrCodeServer)
+	}
+	return invites, nil
+}
+
+func (s *inviteStore) Insert(ctx context.Context, invite auth.Invite) error {
+	if _, err := s.coll.InsertOne(ctx, invite); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to create invite: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
+
+// Consume marks the invite used in a single update so it can only ever be used once,
+// unknown, used and expired invites are all reported the same way
+func (s *inviteStore) Consume(ctx context.Context, hashedCode string, usedBy primitive.ObjectID, now time.Time) (auth.Invite, error) {
+	var invite auth.Invite
+	if err := s.coll.FindOneAndUpdate(
+		ctx,
+		bson.D{
+			{namespaces.FieldHashedCode, hashedCode},
+			{namespaces.FieldUsedAt, bson.D{{"$exists", false}}},
+			{namespaces.FieldExpiresAt, bson.D{{"$gt", now}}},
+		},
+		bson.D{{"$set", bson.D{
+			{namespaces.FieldUsedBy, usedBy},
+			{namespaces.FieldUsedAt, now},
+		}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&invite); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.Invite{}, auth.ErrInvalidInvite
+		}
+		return auth.Invite{}, common.WrapErr(fmt.Errorf("failed to use invite: %s", err), common.ErrCodeServer)
+	}
+	return invite, nil
+}
+
+// Release makes a consumed invite usable again when the registration it was used for failed
+func (s *inviteStore) Release(ctx context.Context, id primitive.ObjectID) error {
+	if _, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldID, id}},
+		bson.D{{"$unset", bson.D{
+			{namespaces.FieldUsedBy, 1},
+			{namespaces.FieldUsedAt, 1},
+		}}},
+	); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to release invite: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
+
+func (s *inviteStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.coll.DeleteOne(ctx, bson.D{{namespaces.FieldID, id}})
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to delete invite: %s", err), common.ErrCodeServer)
+	}
+	if res.DeletedCount == 0 {
+		return common.NewErr("cannot find invite", common.ErrCodeNotFound)
+	}
+	return nil
+}
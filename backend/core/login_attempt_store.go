@@ -0,0 +1,93 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/core/mongodb"
+	"github.com/shake-on-it/app-tmpl/backend/core/namespaces"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type LoginAttemptStore interface {
+	FindByKeys(ctx context.Context, keys []string) ([]auth.LoginAttempts, error)
+
+	RecordFailure(ctx context.Context, key string, failedAt, expiresAt time.Time) error
+
+	DeleteByKeys(ctx context.Context, keys []string) error
+}
+
+func NewLoginAttemptStore(client *mongo.Client) (LoginAttemptStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), common.TimeoutServerOp)
+	defer cancel()
+
+	coll, err := mongodb.NewColl(ctx, client, namespaces.DBAuth, namespaces.CollLoginAttempts, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldExpiresAt, 1}),
+		ExpireAfterSeconds: mongodb.ExpireAfter(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &loginAttemptStore{coll}, nil
+}
+
+type loginAttemptStore struct {
+	coll *mongo.Collection
+}
+
+// FindByKeys finds the attempts that have not yet expired, the ttl index
+// only removes expired documents every so often so they are filtered here too
+func (s *loginAttemptStore) FindByKeys(ctx context.Context, keys []string) ([]auth.LoginAttempts, error) {
+	cursor, err := s.coll.Find(ctx, bson.D{
+		{namespaces.FieldID, bson.D{{"$in", keys}}},
+		{namespaces.FieldExpiresAt, bson.D{{"$gt", time.Now()}}},
+	})
+	if err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to find login attempts: %s", err), common.ErrCodeServer)
+	}
+
+	attempts := []auth.LoginAttempts{}
+	if err := cursor.All(ctx, &attempts); err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to read login attempts: %s", err), common.ErrCodeServer)
+	}
+	return attempts, nil
+}
+
+// RecordFailure counts another failure, the count starts over
+// when the previous failures have expired but not yet been removed
+func (s *loginAttemptStore) RecordFailure(ctx context.Context, key string, failedAt, expiresAt time.Time) error {
+	if _, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldID, key}},
+		mongo.Pipeline{
+			{{"$set", bson.D{
+				{namespaces.FieldFailures, bson.D{{"$cond", bson.A{
+					bson.D{{"$gt", bson.A{"$" + namespaces.FieldExpiresAt, failedAt}}},
+					bson.D{{"$add", bson.A{"$" + namespaces.FieldFailures, 1}}},
+					1,
+				}}}},
+				{namespaces.FieldLastFailureAt, failedAt},
+				{namespaces.FieldExpiresAt, expiresAt},
+			}}},
+		},
+		options.Update().SetUpsert(true),
+	); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to record login attempt: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
+
+func (s *loginAttemptStore) DeleteByKeys(ctx context.Context, keys []string) error {
+	if _, err := s.coll.DeleteMany(ctx, bson.D{{namespaces.FieldID, bson.D{{"$in", keys}}}}); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to delete login attempts: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	fileExtEmail = ".eml"
+)
+
+// fileMailer writes every message to its own file, for use in development and tests
+type fileMailer struct {
+	from string
+	dir  string
+}
+
+func newFileMailer(from, dir string) (Mailer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create mail dir: %s", err)
+	}
+	return &fileMailer{from, dir}, nil
+}
+
+func (m *fileMailer) Send(ctx context.Context, msg Message) error {
+	now := time.Now()
+
+	// object ids sort by creation time so the messages list in the order they were sent
+	name := primitive.NewObjectID().Hex() + fileExtEmail
+	if err := ioutil.WriteFile(filepath.Join(m.dir, name), msg.build(m.from, now), 0644); err != nil {
+		return fmt.Errorf("failed to write mail: %s", err)
+	}
+	return nil
+}
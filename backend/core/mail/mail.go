@@ -0,0 +1,65 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+func NewMailer(config common.MailConfig, logger common.Logger) (Mailer, error) {
+	switch config.Backend {
+	case common.MailBackendFile:
+		return newFileMailer(config.From, config.Dir)
+	case common.MailBackendSMTP:
+		return newSMTPMailer(config), nil
+	}
+	return &logMailer{config.From, logger}, nil
+}
+
+// build renders the message as an rfc 5322 plain text email
+func (msg Message) build(from string, date time.Time) []byte {
+	var buf bytes.Buffer
+	for _, header := range []struct{ key, value string }{
+		{"From", from},
+		{"To", msg.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "8bit"},
+	} {
+		buf.WriteString(fmt.Sprintf("%s: %s\r\n", header.key, stripNewlines(header.value)))
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+func stripNewlines(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+type logMailer struct {
+	from   string
+	logger common.Logger
+}
+
+func (m *logMailer) Send(ctx context.Context, msg Message) error {
+	m.logger.Infof("sending mail from %s to %s: %s\n%s", m.from, msg.To, msg.Subject, msg.Body)
+	return nil
+}
@@ -0,0 +1,183 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+	u "github.com/shake-on-it/app-tmpl/backend/common/test/utils"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+
+	mailer, err := NewMailer(common.MailConfig{
+		Backend: common.MailBackendFile,
+		From:    "app@domain.com",
+		Dir:     dir,
+	}, u.NewLogger(t))
+	assert.Nil(t, err)
+
+	assert.Nil(t, mailer.Send(context.Background(), Message{
+		To:      "user@domain.com",
+		Subject: "Hello",
+		Body:    "line one\nline two",
+	}))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+fileExtEmail))
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), 1)
+
+	data, err := ioutil.ReadFile(files[0])
+	assert.Nil(t, err)
+
+	assert.True(t, strings.Contains(string(data), "From: app@domain.com\r\n"))
+	assert.True(t, strings.Contains(string(data), "To: user@domain.com\r\n"))
+	assert.True(t, strings.Contains(string(data), "Subject: Hello\r\n"))
+	assert.True(t, strings.HasSuffix(string(data), "\r\n\r\nline one\r\nline two"))
+}
+
+func TestSMTPMailer(t *testing.T) {
+	server := newFakeSMTPServer(t)
+
+	mailer, err := NewMailer(common.MailConfig{
+		Backend:      common.MailBackendSMTP,
+		From:         "App <app@domain.com>",
+		SMTPHost:     "127.0.0.1",
+		SMTPPort:     server.port,
+		SMTPUsername: "smtp-user",
+		SMTPPassword: "smtp-password",
+	}, u.NewLogger(t))
+	assert.Nil(t, err)
+
+	assert.Nil(t, mailer.Send(context.Background(), Message{
+		To:      "user@domain.com",
+		Subject: "Hello",
+		Body:    "hello there",
+	}))
+
+	received := <-server.received
+	assert.Equal(t, received.auth, "\x00smtp-user\x00smtp-password")
+	assert.Equal(t, received.from, "<app@domain.com>")
+	assert.Equal(t, received.to, []string{"<user@domain.com>"})
+	assert.True(t, strings.Contains(received.data, "From: App <app@domain.com>\r\n"))
+	assert.True(t, strings.Contains(received.data, "Subject: Hello\r\n"))
+	assert.True(t, strings.HasSuffix(received.data, "\r\n\r\nhello there\r\n"))
+
+	t.Run("should fail when the server rejects the recipient", func(t *testing.T) {
+		err := mailer.Send(context.Background(), Message{
+			To:      "rejected@domain.com",
+			Subject: "Hello",
+			Body:    "hello there",
+		})
+		assert.NotNil(t, err)
+		<-server.received
+	})
+}
+
+type fakeSMTPMessage struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+type fakeSMTPServer struct {
+	port     int
+	received chan fakeSMTPMessage
+}
+
+// newFakeSMTPServer accepts plain auth and rejects any recipient named "rejected"
+func newFakeSMTPServer(t *testing.T) fakeSMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	server := fakeSMTPServer{
+		port:     listener.Addr().(*net.TCPAddr).Port,
+		received: make(chan fakeSMTPMessage, 1),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.handle(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	var msg fakeSMTPMessage
+	defer func() { s.received <- msg }()
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			auth, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTH PLAIN "))
+			msg.auth = string(auth)
+			reply("235 authenticated")
+		case "MAIL":
+			msg.from = strings.TrimPrefix(line, "MAIL FROM:")
+			reply("250 ok")
+		case "RCPT":
+			to := strings.TrimPrefix(line, "RCPT TO:")
+			if strings.Contains(to, "rejected") {
+				reply("550 no such user")
+				continue
+			}
+			msg.to = append(msg.to, to)
+			reply("250 ok")
+		case "DATA":
+			reply("354 send data")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			msg.data = data.String()
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 " + strconv.Quote(cmd) + " not implemented")
+		}
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func NewColl(ctx context.Context, client *mongo.Client, db, coll string, indexes ...Index) (*mongo.Collection, error) {
@@ -41,8 +43,35 @@ type Index struct {
 	Name                    string   `bson:"name"`
 	Key                     IndexKey `bson:"key"`
 	Unique                  bool     `bson:"unique"`
-	ExpireAfterSeconds      int      `bson:"expire_after_seconds,omitempty"`
-	PartialFilterExpression bson.D   `bson:"partial_filter_expression,omitempty"`
+	ExpireAfterSeconds      *int     `bson:"expireAfterSeconds,omitempty"`
+	PartialFilterExpression bson.D   `bson:"partialFilterExpression,omitempty"`
+
+	// Collation is how the index compares strings, only
+	// queries made with the same collation can use the index
+	Collation *Collation `bson:"collation,omitempty"`
+}
+
+// Collation compares strings by the rules of a locale,
+// a strength of 2 tells apart accents but not case
+type Collation struct {
+	Locale   string `bson:"locale"`
+	Strength int    `bson:"strength,omitempty"`
+}
+
+var (
+	CollationCaseInsensitive = &Collation{"en", 2}
+)
+
+// Options is the collation for queries that should use indexes with it
+func (c Collation) Options() *options.Collation {
+	return &options.Collation{Locale: c.Locale, Strength: c.Strength}
+}
+
+// ExpireAfter builds the ttl of an index, where a zero duration
+// expires documents at the time stored in the indexed field
+func ExpireAfter(d time.Duration) *int {
+	secs := int(d.Seconds())
+	return &secs
 }
 
 type IndexField struct {
@@ -0,0 +1,105 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Transactor runs writes to several collections as one. Deployments that support
+// transactions run them in one, otherwise the writes made so far are undone on failure
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context, tx *Tx) error) error
+}
+
+// Tx collects how to undo each write made in the callback, they only
+// run when there is no real transaction to abort instead
+type Tx struct {
+	undos []func(ctx context.Context) error
+}
+
+// OnAbort adds how to undo the write just made, undos run in reverse order
+func (tx *Tx) OnAbort(undo func(ctx context.Context) error) {
+	tx.undos = append(tx.undos, undo)
+}
+
+func NewTransactor(client *mongo.Client) Transactor {
+	return &transactor{client: client}
+}
+
+type transactor struct {
+	client *mongo.Client
+
+	mu        sync.Mutex
+	checked   bool
+	supported bool
+}
+
+func (t *transactor) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx *Tx) error) error {
+	supported, err := t.supportsTransactions(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !supported {
+		return compensate(ctx, fn)
+	}
+
+	session, err := t.client.StartSession()
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to start mongodb session: %s", err), common.ErrCodeServer)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx, &Tx{})
+	})
+	return err
+}
+
+// supportsTransactions checks once whether the deployment is a replica set or sharded,
+// standalone servers cannot run transactions
+func (t *transactor) supportsTransactions(ctx context.Context) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.checked {
+		return t.supported, nil
+	}
+
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := t.client.Database("admin").RunCommand(ctx, bson.D{{"hello", 1}}).Decode(&hello); err != nil {
+		return false, common.WrapErr(fmt.Errorf("failed to check mongodb deployment: %s", err), common.ErrCodeServer)
+	}
+
+	t.checked = true
+	t.supported = hello.SetName != "" || hello.Msg == "isdbgrid"
+	return t.supported, nil
+}
+
+func compensate(ctx context.Context, fn func(ctx context.Context, tx *Tx) error) error {
+	var tx Tx
+	err := fn(ctx, &tx)
+	if err == nil {
+		return nil
+	}
+
+	// the request may be why the callback failed so undo without its deadline
+	undoCtx, cancel := context.WithTimeout(context.Background(), common.TimeoutServerOp)
+	defer cancel()
+
+	for i := len(tx.undos) - 1; i >= 0; i-- {
+		if undoErr := tx.undos[i](undoCtx); undoErr != nil {
+			return common.WrapErr(fmt.Errorf("%s, then failed to undo its writes: %s", err, undoErr), common.ErrCodeServer)
+		}
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestCompensate(t *testing.T) {
+	t.Run("should not undo anything when the callback succeeds", func(t *testing.T) {
+		var undone []string
+		err := compensate(context.Background(), func(ctx context.Context, tx *Tx) error {
+			tx.OnAbort(func(ctx context.Context) error {
+				undone = append(undone, "first")
+				return nil
+			})
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, len(undone), 0)
+	})
+
+	t.Run("should undo the writes in reverse order when the callback fails", func(t *testing.T) {
+		writeErr := common.NewErr("failed to write", common.ErrCodeBadRequest)
+
+		var undone []string
+		err := compensate(context.Background(), func(ctx context.Context, tx *Tx) error {
+			for _, name := range []string{"first", "second"} {
+				name := name
+				tx.OnAbort(func(ctx context.Context) error {
+					undone = append(undone, name)
+					return nil
+				})
+			}
+			return writeErr
+		})
+		assert.Equal(t, err, writeErr)
+		assert.Equal(t, undone, []string{"second", "first"})
+	})
+
+	t.Run("should fail as a server error when a write cannot be undone", func(t *testing.T) {
+		err := compensate(context.Background(), func(ctx context.Context, tx *Tx) error {
+			tx.OnAbort(func(ctx context.Context) error { return errors.New("oops") })
+			return errors.New("failed to write")
+		})
+		assert.Equal(t, err, common.NewErr("failed to write, then failed to undo its writes: oops", common.ErrCodeServer))
+	})
+}
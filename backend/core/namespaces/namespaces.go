@@ -4,7 +4,14 @@ var (
 	DBApp    = "tmpl_app"
 	CollBets = "bets"
 
+	DBAudit         = "tmpl_audit"
+	CollAuditEvents = "events"
+
 	DBAuth            = "tmpl_auth"
+	CollAPIKeys       = "api_keys"
+	CollInvites       = "invites"
+	CollLoginAttempts = "login_attempts"
+	CollRateLimits    = "rate_limits"
 	CollRefreshTokens = "refresh_tokens"
 	CollPasswords     = "passwords"
 	CollUsers         = "users"
@@ -15,9 +22,18 @@ type Namespace struct {
 	Collection *string
 }
 
+func (ns Namespace) String() string {
+	return *ns.Database + "." + *ns.Collection
+}
+
 var (
 	Registry = []Namespace{
 		{&DBApp, &CollBets},
+		{&DBAudit, &CollAuditEvents},
+		{&DBAuth, &CollAPIKeys},
+		{&DBAuth, &CollInvites},
+		{&DBAuth, &CollLoginAttempts},
+		{&DBAuth, &CollRateLimits},
 		{&DBAuth, &CollRefreshTokens},
 		{&DBAuth, &CollPasswords},
 		{&DBAuth, &CollUsers},
@@ -25,14 +41,63 @@ var (
 )
 
 const (
-	FieldID       = "_id"
-	FieldName     = "name"
-	FieldSessions = "sessions"
+	FieldID        = "_id"
+	FieldEmail     = "email"
+	FieldName      = "name"
+	FieldSessions  = "sessions"
+	FieldStatus    = "status"
+	FieldDeletedAt = "deleted_at"
+
+	FieldKnownIPRanges   = "known_ip_ranges"
+	FieldKnownUserAgents = "known_user_agents"
+
+	FieldIdentities = "identities"
+	FieldProvider   = "provider"
+	FieldSubject    = "subject"
 
 	FieldConsumed = "consumed"
+	FieldExp      = "exp"
+	FieldFamilyID = "family_id"
 	FieldSub      = "sub"
 
+	FieldUserID     = "user_id"
+	FieldHashedKey  = "hashed_key"
+	FieldExpiresAt  = "expires_at"
+	FieldLastUsedAt = "last_used_at"
+
+	FieldFailures      = "failures"
+	FieldLastFailureAt = "last_failure_at"
+
+	FieldAction         = "action"
+	FieldActorID        = "actor_id"
+	FieldCreatedAt      = "created_at"
+	FieldImpersonatorID = "impersonator_id"
+	FieldTargetID       = "target_id"
+	FieldTargetType     = "target_type"
+
+	FieldCreatedBy  = "created_by"
+	FieldHashedCode = "hashed_code"
+	FieldUsedAt     = "used_at"
+	FieldUsedBy     = "used_by"
+
+	FieldAllowed   = "allowed"
+	FieldTokens    = "tokens"
+	FieldUpdatedAt = "updated_at"
+
 	FieldUsername       = "username"
 	FieldSalt           = "salt"
 	FieldHashedPassword = "hashed_password"
+	FieldIterations     = "iterations"
+	FieldKeyLength      = "key_length"
+	FieldDigestType     = "digest_type"
+	FieldAlgorithm      = "algorithm"
+	FieldMemory         = "memory"
+	FieldParallelism    = "parallelism"
+	FieldTOTPSecret     = "totp_secret"
+	FieldTOTPPending    = "totp_pending_secret"
+	FieldTOTPLastStep   = "totp_last_step"
+	FieldTOTPChallenge  = "totp_challenge_id"
+	FieldRecoveryCodes  = "recovery_codes"
+	FieldResetToken     = "reset_token"
+	FieldResetExpiresAt = "reset_expires_at"
 )
@@ -0,0 +1,229 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	defaultHashKeyLength = 12
+	defaultHashRounds    = 4096
+
+	defaultBcryptCost = 12
+
+	defaultArgon2idKeyLength   = 32
+	defaultArgon2idMemoryKiB   = 64 * 1024
+	defaultArgon2idParallelism = 4
+	defaultArgon2idTime        = 3
+)
+
+// PasswordHasher hashes passwords with a single algorithm and set of parameters.
+// Verify always uses the parameters stored alongside the password, NeedsRehash
+// reports whether those differ from the hasher's own
+type PasswordHasher interface {
+	Algorithm() string
+	Hash(creds auth.Credentials, salt []byte) (auth.Password, error)
+	Verify(password auth.Password, attempt string) (bool, error)
+	NeedsRehash(password auth.Password) bool
+}
+
+// NewPasswordHasher makes the hasher for the configured algorithm,
+// the pepper is mixed into every hash alongside the per password salt
+func NewPasswordHasher(config common.PasswordHashConfig, pepper []byte) PasswordHasher {
+	switch config.Algorithm {
+	case common.PasswordHashBcrypt:
+		cost := orDefault(config.Iterations, defaultBcryptCost)
+		if cost < bcrypt.MinCost {
+			cost = bcrypt.MinCost
+		}
+		return &bcryptHasher{pepper, cost}
+	case common.PasswordHashArgon2id:
+		return &argon2idHasher{
+			pepper,
+			orDefault(config.Iterations, defaultArgon2idTime),
+			orDefault(config.MemoryKiB, defaultArgon2idMemoryKiB),
+			orDefault(config.Parallelism, defaultArgon2idParallelism),
+			orDefault(config.KeyLength, defaultArgon2idKeyLength),
+		}
+	}
+
+	digestType := config.DigestType
+	if digestType == auth.DigestTypeEmpty {
+		digestType = auth.DigestTypeSHA256
+	}
+	return &pbkdf2Hasher{
+		pepper,
+		orDefault(config.Iterations, defaultHashRounds),
+		orDefault(config.KeyLength, defaultHashKeyLength),
+		digestType,
+	}
+}
+
+type pbkdf2Hasher struct {
+	pepper     []byte
+	iterations int
+	keyLength  int
+	digestType string
+}
+
+func (h *pbkdf2Hasher) Algorithm() string {
+	return common.PasswordHashPBKDF2
+}
+
+func (h *pbkdf2Hasher) Hash(creds auth.Credentials, salt []byte) (auth.Password, error) {
+	return auth.Password{
+		Username:       creds.Username,
+		Salt:           primitive.Binary{Data: salt},
+		HashedPassword: primitive.Binary{Data: h.hash(creds.Password, salt, h.iterations, h.keyLength, h.digestType)},
+		Iterations:     h.iterations,
+		KeyLength:      h.keyLength,
+		DigestType:     h.digestType,
+		Algorithm:      common.PasswordHashPBKDF2,
+	}, nil
+}
+
+func (h *pbkdf2Hasher) Verify(password auth.Password, attempt string) (bool, error) {
+	hashedAttempt := h.hash(attempt, password.Salt.Data, password.Iterations, password.KeyLength, password.DigestType)
+	return subtle.ConstantTimeCompare(password.HashedPassword.Data, hashedAttempt) == 1, nil
+}
+
+func (h *pbkdf2Hasher) NeedsRehash(password auth.Password) bool {
+	return password.HashAlgorithm() != common.PasswordHashPBKDF2 ||
+		password.Iterations != h.iterations ||
+		password.KeyLength != h.keyLength ||
+		password.DigestType != h.digestType
+}
+
+func (h *pbkdf2Hasher) hash(password string, salt []byte, iterations, keyLength int, digestType string) []byte {
+	return []byte(hex.EncodeToString(pbkdf2.Key(
+		[]byte(password),
+		pepperedSalt(h.pepper, salt),
+		iterations,
+		keyLength,
+		auth.DigestHash(digestType),
+	)))
+}
+
+// bcryptHasher pre-hashes the password with an hmac so the pepper and salt
+// are used and long passwords are not truncated at bcrypt's 72 byte limit
+type bcryptHasher struct {
+	pepper []byte
+	cost   int
+}
+
+func (h *bcryptHasher) Algorithm() string {
+	return common.PasswordHashBcrypt
+}
+
+func (h *bcryptHasher) Hash(creds auth.Credentials, salt []byte) (auth.Password, error) {
+	hashed, err := bcrypt.GenerateFromPassword(h.preHash(creds.Password, salt), h.cost)
+	if err != nil {
+		return auth.Password{}, common.WrapErr(fmt.Errorf("failed to hash password: %s", err), common.ErrCodeServer)
+	}
+	return auth.Password{
+		Username:       creds.Username,
+		Salt:           primitive.Binary{Data: salt},
+		HashedPassword: primitive.Binary{Data: hashed},
+		Iterations:     h.cost,
+		DigestType:     auth.DigestTypeSHA256,
+		Algorithm:      common.PasswordHashBcrypt,
+	}, nil
+}
+
+func (h *bcryptHasher) Verify(password auth.Password, attempt string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(password.HashedPassword.Data, h.preHash(attempt, password.Salt.Data))
+	switch err {
+	case nil:
+		return true, nil
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return false, nil
+	}
+	return false, common.WrapErr(fmt.Errorf("failed to verify password: %s", err), common.ErrCodeServer)
+}
+
+func (h *bcryptHasher) NeedsRehash(password auth.Password) bool {
+	return password.HashAlgorithm() != common.PasswordHashBcrypt ||
+		password.Iterations != h.cost
+}
+
+func (h *bcryptHasher) preHash(password string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, h.pepper)
+	mac.Write(salt)
+	mac.Write([]byte(password))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+type argon2idHasher struct {
+	pepper      []byte
+	time        int
+	memoryKiB   int
+	parallelism int
+	keyLength   int
+}
+
+func (h *argon2idHasher) Algorithm() string {
+	return common.PasswordHashArgon2id
+}
+
+func (h *argon2idHasher) Hash(creds auth.Credentials, salt []byte) (auth.Password, error) {
+	return auth.Password{
+		Username:       creds.Username,
+		Salt:           primitive.Binary{Data: salt},
+		HashedPassword: primitive.Binary{Data: h.hash(creds.Password, salt, h.time, h.memoryKiB, h.parallelism, h.keyLength)},
+		Iterations:     h.time,
+		KeyLength:      h.keyLength,
+		Memory:         h.memoryKiB,
+		Parallelism:    h.parallelism,
+		Algorithm:      common.PasswordHashArgon2id,
+	}, nil
+}
+
+func (h *argon2idHasher) Verify(password auth.Password, attempt string) (bool, error) {
+	if password.Iterations < 1 || password.Parallelism < 1 {
+		return false, common.NewErr("failed to verify password: invalid argon2id parameters", common.ErrCodeServer)
+	}
+	hashedAttempt := h.hash(attempt, password.Salt.Data, password.Iterations, password.Memory, password.Parallelism, password.KeyLength)
+	return subtle.ConstantTimeCompare(password.HashedPassword.Data, hashedAttempt) == 1, nil
+}
+
+func (h *argon2idHasher) NeedsRehash(password auth.Password) bool {
+	return password.HashAlgorithm() != common.PasswordHashArgon2id ||
+		password.Iterations != h.time ||
+		password.Memory != h.memoryKiB ||
+		password.Parallelism != h.parallelism ||
+		password.KeyLength != h.keyLength
+}
+
+func (h *argon2idHasher) hash(password string, salt []byte, time, memoryKiB, parallelism, keyLength int) []byte {
+	return []byte(hex.EncodeToString(argon2.IDKey(
+		[]byte(password),
+		pepperedSalt(h.pepper, salt),
+		uint32(time),
+		uint32(memoryKiB),
+		uint8(parallelism),
+		uint32(keyLength),
+	)))
+}
+
+func pepperedSalt(pepper, salt []byte) []byte {
+	peppered := make([]byte, 0, len(pepper)+len(salt))
+	return append(append(peppered, pepper...), salt...)
+}
+
+func orDefault(value, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
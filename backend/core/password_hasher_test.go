@@ -0,0 +1,77 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	pepper := []byte("abcdefghijkl")
+	salt := []byte("123456789012")
+	creds := auth.Credentials{Username: "username", Password: "password"}
+
+	for _, tc := range []struct {
+		description string
+		config      common.PasswordHashConfig
+		upgraded    common.PasswordHashConfig
+	}{
+		{
+			"pbkdf2",
+			common.PasswordHashConfig{Algorithm: common.PasswordHashPBKDF2},
+			common.PasswordHashConfig{Algorithm: common.PasswordHashPBKDF2, Iterations: 2 * defaultHashRounds},
+		},
+		{
+			"bcrypt",
+			common.PasswordHashConfig{Algorithm: common.PasswordHashBcrypt, Iterations: 4},
+			common.PasswordHashConfig{Algorithm: common.PasswordHashBcrypt, Iterations: 5},
+		},
+		{
+			"argon2id",
+			common.PasswordHashConfig{Algorithm: common.PasswordHashArgon2id, MemoryKiB: 1024},
+			common.PasswordHashConfig{Algorithm: common.PasswordHashArgon2id, MemoryKiB: 2048},
+		},
+	} {
+		t.Run("should hash and verify passwords with "+tc.description, func(t *testing.T) {
+			hasher := NewPasswordHasher(tc.config, pepper)
+			assert.Equal(t, hasher.Algorithm(), tc.config.Algorithm)
+
+			password, err := hasher.Hash(creds, salt)
+			assert.Nil(t, err)
+			assert.Nil(t, password.Validate())
+			assert.Equal(t, password.Algorithm, tc.config.Algorithm)
+
+			ok, err := hasher.Verify(password, creds.Password)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+
+			ok, err = hasher.Verify(password, "wrong password")
+			assert.Nil(t, err)
+			assert.False(t, ok)
+
+			ok, err = NewPasswordHasher(tc.config, []byte("other pepper")).Verify(password, creds.Password)
+			assert.Nil(t, err)
+			assert.False(t, ok)
+
+			assert.False(t, hasher.NeedsRehash(password))
+			assert.True(t, NewPasswordHasher(tc.upgraded, pepper).NeedsRehash(password))
+
+			ok, err = NewPasswordHasher(tc.upgraded, pepper).Verify(password, creds.Password)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+		})
+	}
+
+	t.Run("should treat passwords without an algorithm as pbkdf2", func(t *testing.T) {
+		hasher := NewPasswordHasher(common.PasswordHashConfig{}, pepper)
+
+		password, err := hasher.Hash(creds, salt)
+		assert.Nil(t, err)
+		password.Algorithm = ""
+
+		assert.False(t, hasher.NeedsRehash(password))
+		assert.True(t, NewPasswordHasher(common.PasswordHashConfig{Algorithm: common.PasswordHashArgon2id}, pepper).NeedsRehash(password))
+	})
+}
@@ -3,6 +3,7 @@ package core
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/shake-on-it/app-tmpl/backend/auth"
 	"github.com/shake-on-it/app-tmpl/backend/common"
@@ -14,12 +15,29 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+var (
+	errPasswordResetInvalid = common.NewErr("password reset is invalid or has expired", common.ErrCodeBadRequest)
+)
+
 type PasswordStore interface {
 	FindByUsername(ctx context.Context, username string) (auth.Password, error)
 
 	Insert(ctx context.Context, password auth.Password) error
 
-	UpdatePassword(ctx context.Context, username string, salt, hashedPassword primitive.Binary) error
+	UpdatePassword(ctx context.Context, password auth.Password) error
+
+	SetResetToken(ctx context.Context, username, resetToken string, expiresAt time.Time) error
+	FindByResetToken(ctx context.Context, resetToken string, now time.Time) (auth.Password, error)
+	ResetPassword(ctx context.Context, resetToken string, password auth.Password, now time.Time) error
+
+	SetPendingTOTP(ctx context.Context, username string, secret primitive.Binary) error
+	EnableTOTP(ctx context.Context, username string, secret primitive.Binary, recoveryCodes []string) error
+	DisableTOTP(ctx context.Context, username string) error
+	UseTOTPStep(ctx context.Context, username string, step int64) error
+	SetTOTPChallenge(ctx context.Context, username string, challengeID primitive.ObjectID) error
+	ConsumeTOTPChallenge(ctx context.Context, username string, challengeID primitive.ObjectID) error
+	ClearTOTPChallenge(ctx context.Context, username string) error
+	ConsumeRecoveryCode(ctx context.Context, username, recoveryCode string) error
 }
 
 func NewPasswordStore(client *mongo.Client) (PasswordStore, error) {
@@ -30,6 +48,11 @@ func NewPasswordStore(client *mongo.Client) (PasswordStore, error) {
 		Unique: true,
 		Key: mongodb.NewIndexKey(
 			mongodb.IndexField{namespaces.FieldUsername, 1}),
+	}, mongodb.Index{
+		Unique: true,
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldResetToken, 1}),
+		PartialFilterExpression: bson.D{{namespaces.FieldResetToken, bson.D{{"$exists", true}}}},
 	})
 	if err != nil {
 		return nil, err
@@ -55,21 +78,256 @@ func (s *passwordStore) FindByUsername(ctx context.Context, username string) (au
 
 func (s *passwordStore) Insert(ctx context.Context, password auth.Password) error {
 	if _, err := s.coll.InsertOne(ctx, password); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return common.NewErr("password already exists for this user", common.ErrCodeConflict)
+		}
 		return common.WrapErr(fmt.Errorf("failed to create password: %s", err), common.ErrCodeServer)
 	}
 	return nil
 }
 
-func (s *passwordStore) UpdatePassword(ctx context.Context, username string, salt, hashedPassword primitive.Binary) error {
+func (s *passwordStore) UpdatePassword(ctx context.Context, password auth.Password) error {
+	res, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldUsername, password.Username}},
+		passwordUpdate(password),
+	)
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to update password: %s", err), common.ErrCodeServer)
+	}
+	if res.MatchedCount == 0 {
+		return common.NewErr("must register first", common.ErrCodeNotFound)
+	}
+	return nil
+}
+
+func (s *passwordStore) SetResetToken(ctx context.Context, username, resetToken string, expiresAt time.Time) error {
+	res, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldUsername, username}},
+		bson.D{{"$set", bson.D{
+			{namespaces.FieldResetToken, resetToken},
+			{namespaces.FieldResetExpiresAt, expiresAt},
+		}}},
+	)
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to set password reset: %s", err), common.ErrCodeServer)
+	}
+	if res.MatchedCount == 0 {
+		return common.NewErr("must register first", common.ErrCodeNotFound)
+	}
+	return nil
+}
+
+func (s *passwordStore) FindByResetToken(ctx context.Context, resetToken string, now time.Time) (auth.Password, error) {
+	var password auth.Password
+	if err := s.coll.FindOne(ctx, resetTokenFilter(resetToken, now)).Decode(&password); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.Password{}, errPasswordResetInvalid
+		}
+		return auth.Password{}, common.WrapErr(fmt.Errorf("failed to find password reset: %s", err), common.ErrCodeServer)
+	}
+	return password, nil
+}
+
+// ResetPassword sets the new password only if the reset token is still valid,
+// the token is used up by the same update so it can only ever be redeemed once
+func (s *passwordStore) ResetPassword(ctx context.Context, resetToken string, password auth.Password, now time.Time) error {
+	filter := append(resetTokenFilter(resetToken, now), bson.E{namespaces.FieldUsername, password.Username})
+
+	res, err := s.coll.UpdateOne(ctx, filter, passwordUpdate(password))
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to reset password: %s", err), common.ErrCodeServer)
+	}
+	if res.MatchedCount == 0 {
+		return errPasswordResetInvalid
+	}
+	return nil
+}
+
+func (s *passwordStore) SetPendingTOTP(ctx context.Context, username string, secret primitive.Binary) error {
+	res, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldUsername, username}},
+		bson.D{{"$set", bson.D{
+			{namespaces.FieldTOTPPending, secret},
+		}}},
+	)
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to set pending totp: %s", err), common.ErrCodeServer)
+	}
+	if res.MatchedCount == 0 {
+		return common.NewErr("must register first", common.ErrCodeNotFound)
+	}
+	return nil
+}
+
+// EnableTOTP promotes the pending secret, the secret must still be pending
+// so that a concurrent enrollment cannot swap it out from under the user
+func (s *passwordStore) EnableTOTP(ctx context.Context, username string, secret primitive.Binary, recoveryCodes []string) error {
+	res, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{
+			{namespaces.FieldUsername, username},
+			{namespaces.FieldTOTPPending, secret},
+		},
+		bson.D{
+			{"$set", bson.D{
+				{namespaces.FieldTOTPSecret, secret},
+				{namespaces.FieldRecoveryCodes, recoveryCodes},
+			}},
+			{"$unset", bson.D{
+				{namespaces.FieldTOTPPending, 1},
+				{namespaces.FieldTOTPLastStep, 1},
+			}},
+		},
+	)
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to enable totp: %s", err), common.ErrCodeServer)
+	}
+	if res.MatchedCount == 0 {
+		return common.NewErr("must enroll in totp first", common.ErrCodeBadRequest)
+	}
+	return nil
+}
+
+func (s *passwordStore) DisableTOTP(ctx context.Context, username string) error {
 	if _, err := s.coll.UpdateOne(
 		ctx,
 		bson.D{{namespaces.FieldUsername, username}},
+		bson.D{{"$unset", bson.D{
+			{namespaces.FieldTOTPSecret, 1},
+			{namespaces.FieldTOTPPending, 1},
+			{namespaces.FieldTOTPLastStep, 1},
+			{namespaces.FieldTOTPChallenge, 1},
+			{namespaces.FieldRecoveryCodes, 1},
+		}}},
+	); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to disable totp: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted code so it cannot be replayed
+func (s *passwordStore) UseTOTPStep(ctx context.Context, username string, step int64) error {
+	res, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{
+			{namespaces.FieldUsername, username},
+			{"$or", bson.A{
+				bson.D{{namespaces.FieldTOTPLastStep, bson.D{{"$exists", false}}}},
+				bson.D{{namespaces.FieldTOTPLastStep, bson.D{{"$lt", step}}}},
+			}},
+		},
+		bson.D{{"$set", bson.D{
+			{namespaces.FieldTOTPLastStep, step},
+		}}},
+	)
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to use totp code: %s", err), common.ErrCodeServer)
+	}
+	if res.MatchedCount == 0 {
+		return auth.ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+// SetTOTPChallenge replaces the user's pending challenge, only the latest one issued can be used
+func (s *passwordStore) SetTOTPChallenge(ctx context.Context, username string, challengeID primitive.ObjectID) error {
+	res, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldUsername, username}},
+		bson.D{{"$set", bson.D{
+			{namespaces.FieldTOTPChallenge, challengeID},
+		}}},
+	)
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to set totp challenge: %s", err), common.ErrCodeServer)
+	}
+	if res.MatchedCount == 0 {
+		return common.NewErr("must register first", common.ErrCodeNotFound)
+	}
+	return nil
+}
+
+// ConsumeTOTPChallenge uses up the challenge so it is exchanged for at most one session
+func (s *passwordStore) ConsumeTOTPChallenge(ctx context.Context, username string, challengeID primitive.ObjectID) error {
+	res, err := s.coll.UpdateOne(
+		ctx,
 		bson.D{
-			{namespaces.FieldSalt, salt},
-			{namespaces.FieldHashedPassword, hashedPassword},
+			{namespaces.FieldUsername, username},
+			{namespaces.FieldTOTPChallenge, challengeID},
 		},
+		bson.D{{"$unset", bson.D{
+			{namespaces.FieldTOTPChallenge, 1},
+		}}},
+	)
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to use totp challenge: %s", err), common.ErrCodeServer)
+	}
+	if res.MatchedCount == 0 {
+		return auth.ErrInvalidSession
+	}
+	return nil
+}
+
+// ClearTOTPChallenge drops any pending challenge, users without a password never have one
+func (s *passwordStore) ClearTOTPChallenge(ctx context.Context, username string) error {
+	if _, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldUsername, username}},
+		bson.D{{"$unset", bson.D{
+			{namespaces.FieldTOTPChallenge, 1},
+		}}},
 	); err != nil {
-		return common.WrapErr(fmt.Errorf("failed to update password: %s", err), common.ErrCodeServer)
+		return common.WrapErr(fmt.Errorf("failed to clear totp challenge: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
+
+func (s *passwordStore) ConsumeRecoveryCode(ctx context.Context, username, recoveryCode string) error {
+	res, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{
+			{namespaces.FieldUsername, username},
+			{namespaces.FieldRecoveryCodes, recoveryCode},
+		},
+		bson.D{{"$pull", bson.D{
+			{namespaces.FieldRecoveryCodes, recoveryCode},
+		}}},
+	)
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to use recovery code: %s", err), common.ErrCodeServer)
+	}
+	if res.MatchedCount == 0 {
+		return auth.ErrInvalidTOTPCode
 	}
 	return nil
 }
+
+func resetTokenFilter(resetToken string, now time.Time) bson.D {
+	return bson.D{
+		{namespaces.FieldResetToken, resetToken},
+		{namespaces.FieldResetExpiresAt, bson.D{{"$gt", now}}},
+	}
+}
+
+// passwordUpdate replaces the password's hash and drops any reset pending for it
+func passwordUpdate(password auth.Password) bson.D {
+	return bson.D{
+		{"$set", bson.D{
+			{namespaces.FieldSalt, password.Salt},
+			{namespaces.FieldHashedPassword, password.HashedPassword},
+			{namespaces.FieldIterations, password.Iterations},
+			{namespaces.FieldKeyLength, password.KeyLength},
+			{namespaces.FieldDigestType, password.DigestType},
+			{namespaces.FieldAlgorithm, password.HashAlgorithm()},
+			{namespaces.FieldMemory, password.Memory},
+			{namespaces.FieldParallelism, password.Parallelism},
+		}},
+		{"$unset", bson.D{
+			{namespaces.FieldResetToken, 1},
+			{namespaces.FieldResetExpiresAt, 1},
+		}},
+	}
+}
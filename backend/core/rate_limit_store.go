@@ -0,0 +1,171 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/core/mongodb"
+	"github.com/shake-on-it/app-tmpl/backend/core/namespaces"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	rateLimitSweepInterval = time.Minute
+)
+
+// RateLimitBucket holds the requests a caller has left, it refills evenly over the
+// limit's period so it is always full again once a period passes without requests
+type RateLimitBucket struct {
+	Key       string    `bson:"_id"`
+	Tokens    float64   `bson:"tokens"`
+	Allowed   bool      `bson:"allowed"`
+	UpdatedAt time.Time `bson:"updated_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// Remaining is how many more requests are allowed right now
+func (b RateLimitBucket) Remaining() int {
+	return int(math.Floor(b.Tokens))
+}
+
+// ResetAfter is how long until the bucket is full again
+func (b RateLimitBucket) ResetAfter(burst int, period time.Duration) time.Duration {
+	return time.Duration((float64(burst) - b.Tokens) * float64(period) / float64(burst))
+}
+
+// RetryAfter is how long until the next request is allowed
+func (b RateLimitBucket) RetryAfter(burst int, period time.Duration) time.Duration {
+	if b.Tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.Tokens) * float64(period) / float64(burst))
+}
+
+// ErrRateLimited tells the client how long to wait before trying again
+func ErrRateLimited(retryAfter time.Duration) error {
+	return common.NewErr(
+		"too many requests",
+		common.ErrCodeTooManyRequests,
+		common.ErrDatum{common.ErrDataRetryAfterSecs, int(math.Ceil(retryAfter.Seconds()))},
+	)
+}
+
+type RateLimitStore interface {
+	// Take counts a request against the key's bucket, the returned
+	// bucket tells whether it was allowed and what is left after it
+	Take(ctx context.Context, key string, burst int, period time.Duration, now time.Time) (RateLimitBucket, error)
+}
+
+// NewMemoryRateLimitStore keeps buckets in this process only,
+// each instance of the server then limits its callers on its own
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]RateLimitBucket{}}
+}
+
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]RateLimitBucket
+	nextSweep time.Time
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, burst int, period time.Duration, now time.Time) (RateLimitBucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.After(s.nextSweep) {
+		for bucketKey, bucket := range s.buckets {
+			if !now.Before(bucket.ExpiresAt) {
+				delete(s.buckets, bucketKey)
+			}
+		}
+		s.nextSweep = now.Add(rateLimitSweepInterval)
+	}
+
+	tokens := float64(burst)
+	if bucket, ok := s.buckets[key]; ok {
+		var refilled float64
+		if elapsed := now.Sub(bucket.UpdatedAt); elapsed > 0 {
+			refilled = float64(elapsed) * float64(burst) / float64(period)
+		}
+		tokens = math.Min(tokens, bucket.Tokens+refilled)
+	}
+
+	bucket := RateLimitBucket{key, tokens, tokens >= 1, now, now.Add(period)}
+	if bucket.Allowed {
+		bucket.Tokens--
+	}
+	s.buckets[key] = bucket
+
+	return bucket, nil
+}
+
+// NewRateLimitStore keeps buckets in mongodb so every instance of the server shares them
+func NewRateLimitStore(client *mongo.Client) (RateLimitStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), common.TimeoutServerOp)
+	defer cancel()
+
+	coll, err := mongodb.NewColl(ctx, client, namespaces.DBAuth, namespaces.CollRateLimits, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldExpiresAt, 1}),
+		ExpireAfterSeconds: mongodb.ExpireAfter(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimitStore{coll}, nil
+}
+
+type rateLimitStore struct {
+	coll *mongo.Collection
+}
+
+// Take refills and takes from the bucket in a single update so concurrent requests
+// from any instance cannot both spend the same token, a missing bucket starts full
+func (s *rateLimitStore) Take(ctx context.Context, key string, burst int, period time.Duration, now time.Time) (RateLimitBucket, error) {
+	tokensPerMilli := float64(burst) / float64(period.Milliseconds())
+
+	var bucket RateLimitBucket
+	if err := s.coll.FindOneAndUpdate(
+		ctx,
+		bson.D{{namespaces.FieldID, key}},
+		mongo.Pipeline{
+			{{"$set", bson.D{
+				{namespaces.FieldTokens, bson.D{{"$min", bson.A{
+					burst,
+					bson.D{{"$add", bson.A{
+						bson.D{{"$ifNull", bson.A{"$" + namespaces.FieldTokens, burst}}},
+						bson.D{{"$multiply", bson.A{
+							bson.D{{"$max", bson.A{
+								0,
+								bson.D{{"$subtract", bson.A{now, bson.D{{"$ifNull", bson.A{"$" + namespaces.FieldUpdatedAt, now}}}}}},
+							}}},
+							tokensPerMilli,
+						}}},
+					}}},
+				}}}},
+			}}},
+			{{"$set", bson.D{
+				{namespaces.FieldAllowed, bson.D{{"$gte", bson.A{"$" + namespaces.FieldTokens, 1}}}},
+				{namespaces.FieldTokens, bson.D{{"$cond", bson.A{
+					bson.D{{"$gte", bson.A{"$" + namespaces.FieldTokens, 1}}},
+					bson.D{{"$subtract", bson.A{"$" + namespaces.FieldTokens, 1}}},
+					"$" + namespaces.FieldTokens,
+				}}}},
+				{namespaces.FieldUpdatedAt, bson.D{{"$max", bson.A{now, bson.D{{"$ifNull", bson.A{"$" + namespaces.FieldUpdatedAt, now}}}}}}},
+				{namespaces.FieldExpiresAt, now.Add(period)},
+			}}},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&bucket); err != nil {
+		return RateLimitBucket{}, common.WrapErr(fmt.Errorf("failed to take from rate limit: %s", err), common.ErrCodeServer)
+	}
+	return bucket, nil
+}
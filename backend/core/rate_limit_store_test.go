@@ -0,0 +1,56 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("should allow a burst of requests then refill over the period", func(t *testing.T) {
+		store := NewMemoryRateLimitStore()
+
+		for i := 0; i < 3; i++ {
+			bucket, err := store.Take(context.Background(), "key", 3, 3*time.Second, now)
+			assert.Nil(t, err)
+			assert.True(t, bucket.Allowed)
+			assert.Equal(t, bucket.Remaining(), 2-i)
+		}
+
+		bucket, err := store.Take(context.Background(), "key", 3, 3*time.Second, now)
+		assert.Nil(t, err)
+		assert.False(t, bucket.Allowed)
+		assert.Equal(t, bucket.RetryAfter(3, 3*time.Second), time.Second)
+		assert.Equal(t, bucket.ResetAfter(3, 3*time.Second), 3*time.Second)
+
+		bucket, err = store.Take(context.Background(), "key", 3, 3*time.Second, now.Add(time.Second))
+		assert.Nil(t, err)
+		assert.True(t, bucket.Allowed)
+		assert.Equal(t, bucket.Remaining(), 0)
+
+		bucket, err = store.Take(context.Background(), "key", 3, 3*time.Second, now.Add(time.Minute))
+		assert.Nil(t, err)
+		assert.True(t, bucket.Allowed)
+		assert.Equal(t, bucket.Remaining(), 2)
+	})
+
+	t.Run("should keep a bucket per key", func(t *testing.T) {
+		store := NewMemoryRateLimitStore()
+
+		bucket, err := store.Take(context.Background(), "key1", 1, time.Minute, now)
+		assert.Nil(t, err)
+		assert.True(t, bucket.Allowed)
+
+		bucket, err = store.Take(context.Background(), "key1", 1, time.Minute, now)
+		assert.Nil(t, err)
+		assert.False(t, bucket.Allowed)
+
+		bucket, err = store.Take(context.Background(), "key2", 1, time.Minute, now)
+		assert.Nil(t, err)
+		assert.True(t, bucket.Allowed)
+	})
+}
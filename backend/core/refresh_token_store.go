@@ -12,16 +12,21 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type RefreshTokenStore interface {
-	Check(ctx context.Context, id primitive.ObjectID) (bool, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (auth.RefreshToken, error)
+	FindByUserID(ctx context.Context, userID primitive.ObjectID) ([]auth.RefreshToken, error)
 
 	Insert(ctx context.Context, refreshToken auth.RefreshToken) error
 
-	Consume(ctx context.Context, id primitive.ObjectID) error
+	Consume(ctx context.Context, id primitive.ObjectID) (auth.RefreshToken, error)
 
+	Delete(ctx context.Context, userID, id primitive.ObjectID) error
+	DeleteByFamilyID(ctx context.Context, familyID primitive.ObjectID) ([]primitive.ObjectID, error)
 	DeleteByUserID(ctx context.Context, userID primitive.ObjectID) error
+	DeleteByUserIDExcept(ctx context.Context, userID, id primitive.ObjectID) error
 }
 
 func NewRefreshTokenStore(client *mongo.Client) (RefreshTokenStore, error) {
@@ -31,6 +36,13 @@ func NewRefreshTokenStore(client *mongo.Client) (RefreshTokenStore, error) {
 	coll, err := mongodb.NewColl(ctx, client, namespaces.DBAuth, namespaces.CollRefreshTokens, mongodb.Index{
 		Key: mongodb.NewIndexKey(
 			mongodb.IndexField{namespaces.FieldSub, 1}),
+	}, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldFamilyID, 1}),
+	}, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldExp, 1}),
+		ExpireAfterSeconds: mongodb.ExpireAfter(0),
 	})
 	if err != nil {
 		return nil, err
@@ -43,15 +55,31 @@ type refreshTokenStore struct {
 	coll *mongo.Collection
 }
 
-func (s *refreshTokenStore) Check(ctx context.Context, id primitive.ObjectID) (bool, error) {
-	res := s.coll.FindOne(ctx, bson.D{{namespaces.FieldID, id}})
-	if err := res.Err(); err != nil {
-		return false, common.WrapErr(fmt.Errorf("failed to find refresh token: %s", err), common.ErrCodeServer)
+func (s *refreshTokenStore) FindByID(ctx context.Context, id primitive.ObjectID) (auth.RefreshToken, error) {
+	var refreshToken auth.RefreshToken
+	if err := s.coll.FindOne(ctx, bson.D{{namespaces.FieldID, id}}).Decode(&refreshToken); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.RefreshToken{}, common.NewErr("cannot find session", common.ErrCodeNotFound)
+		}
+		return auth.RefreshToken{}, common.WrapErr(fmt.Errorf("failed to find refresh token: %s", err), common.ErrCodeServer)
 	}
+	return refreshToken, nil
+}
 
-	var refreshToken auth.RefreshToken
-	res.Decode(&refreshToken)
-	return !refreshToken.Consumed, nil
+func (s *refreshTokenStore) FindByUserID(ctx context.Context, userID primitive.ObjectID) ([]auth.RefreshToken, error) {
+	cursor, err := s.coll.Find(ctx, bson.D{
+		{namespaces.FieldSub, userID},
+		{namespaces.FieldConsumed, false},
+	})
+	if err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to find sessions: %s", err), common.ErrCodeServer)
+	}
+
+	refreshTokens := []auth.RefreshToken{}
+	if err := cursor.All(ctx, &refreshTokens); err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to read sessions: %s", err), common.ErrCodeServer)
+	}
+	return refreshTokens, nil
 }
 
 func (s *refreshTokenStore) Insert(ctx context.Context, refreshToken auth.RefreshToken) error {
@@ -61,8 +89,8 @@ func (s *refreshTokenStore) Insert(ctx context.Context, refreshToken auth.Refres
 	return nil
 }
 
-func (s *refreshTokenStore) Consume(ctx context.Context, id primitive.ObjectID) error {
-	res, err := s.coll.UpdateOne(
+func (s *refreshTokenStore) Consume(ctx context.Context, id primitive.ObjectID) (auth.RefreshToken, error) {
+	res := s.coll.FindOneAndUpdate(
 		ctx,
 		bson.D{
 			{namespaces.FieldID, id},
@@ -71,19 +99,69 @@ func (s *refreshTokenStore) Consume(ctx context.Context, id primitive.ObjectID)
 		bson.D{{"$set", bson.D{
 			{namespaces.FieldConsumed, true},
 		}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
 	)
-	if err != nil {
-		return common.WrapErr(fmt.Errorf("failed to refresh session: %s", err), common.ErrCodeServer)
+	if err := res.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.RefreshToken{}, auth.ErrSessionExpired
+		}
+		return auth.RefreshToken{}, common.WrapErr(fmt.Errorf("failed to refresh session: %s", err), common.ErrCodeServer)
 	}
-	if res.MatchedCount == 0 {
-		return common.NewErr("session has expired", common.ErrCodeInvalidAuth)
+
+	var refreshToken auth.RefreshToken
+	if err := res.Decode(&refreshToken); err != nil {
+		return auth.RefreshToken{}, common.WrapErr(fmt.Errorf("failed to read session: %s", err), common.ErrCodeServer)
+	}
+	return refreshToken, nil
+}
+
+func (s *refreshTokenStore) Delete(ctx context.Context, userID, id primitive.ObjectID) error {
+	if _, err := s.coll.DeleteOne(ctx, bson.D{
+		{namespaces.FieldID, id},
+		{namespaces.FieldSub, userID},
+	}); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to delete session: %s", err), common.ErrCodeServer)
 	}
 	return nil
 }
 
+func (s *refreshTokenStore) DeleteByFamilyID(ctx context.Context, familyID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	filter := bson.D{{namespaces.FieldFamilyID, familyID}}
+
+	cursor, err := s.coll.Find(ctx, filter, options.Find().SetProjection(bson.D{{namespaces.FieldID, 1}}))
+	if err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to find session family: %s", err), common.ErrCodeServer)
+	}
+
+	var refreshTokens []auth.RefreshToken
+	if err := cursor.All(ctx, &refreshTokens); err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to read session family: %s", err), common.ErrCodeServer)
+	}
+
+	if _, err := s.coll.DeleteMany(ctx, filter); err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to delete session family: %s", err), common.ErrCodeServer)
+	}
+
+	sessionIDs := make([]primitive.ObjectID, 0, len(refreshTokens))
+	for _, refreshToken := range refreshTokens {
+		sessionIDs = append(sessionIDs, refreshToken.SessionID)
+	}
+	return sessionIDs, nil
+}
+
 func (s *refreshTokenStore) DeleteByUserID(ctx context.Context, userID primitive.ObjectID) error {
 	if _, err := s.coll.DeleteMany(ctx, bson.D{{namespaces.FieldSub, userID}}); err != nil {
 		return common.WrapErr(fmt.Errorf("failed to delete sessions: %s", err), common.ErrCodeServer)
 	}
 	return nil
 }
+
+func (s *refreshTokenStore) DeleteByUserIDExcept(ctx context.Context, userID, id primitive.ObjectID) error {
+	if _, err := s.coll.DeleteMany(ctx, bson.D{
+		{namespaces.FieldSub, userID},
+		{namespaces.FieldID, bson.D{{"$ne", id}}},
+	}); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to delete sessions: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common"
+	"github.com/shake-on-it/app-tmpl/backend/core/mongodb"
+	"github.com/shake-on-it/app-tmpl/backend/core/namespaces"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// userData says how to find a user's documents in a namespace, secrets
+// are left out of exports and retained documents are not purged
+type userData struct {
+	filter   func(user auth.User) bson.D
+	secrets  []string
+	retained bool
+}
+
+var (
+	userDataByNamespace = map[namespaces.Namespace]userData{
+		{&namespaces.DBApp, &namespaces.CollBets}: {
+			filter: func(user auth.User) bson.D {
+				return bson.D{{namespaces.FieldUserID, user.ID}}
+			},
+		},
+		// audit events are kept for the audit log's retention so account operations stay accountable
+		{&namespaces.DBAudit, &namespaces.CollAuditEvents}: {
+			filter: func(user auth.User) bson.D {
+				return bson.D{{"$or", bson.A{
+					bson.D{{namespaces.FieldActorID, user.ID}},
+					bson.D{{namespaces.FieldImpersonatorID, user.ID}},
+					bson.D{
+						{namespaces.FieldTargetType, auth.AuditTargetUser},
+						{namespaces.FieldTargetID, user.ID},
+					},
+				}}}
+			},
+			retained: true,
+		},
+		{&namespaces.DBAuth, &namespaces.CollAPIKeys}: {
+			filter: func(user auth.User) bson.D {
+				return bson.D{{namespaces.FieldUserID, user.ID}}
+			},
+			secrets: []string{namespaces.FieldHashedKey},
+		},
+		{&namespaces.DBAuth, &namespaces.CollInvites}: {
+			filter: func(user auth.User) bson.D {
+				return bson.D{{"$or", bson.A{
+					bson.D{{namespaces.FieldCreatedBy, user.ID}},
+					bson.D{{namespaces.FieldUsedBy, user.ID}},
+				}}}
+			},
+			secrets: []string{namespaces.FieldHashedCode},
+		},
+		{&namespaces.DBAuth, &namespaces.CollLoginAttempts}: {
+			filter: func(user auth.User) bson.D {
+				return bson.D{{namespaces.FieldID, bson.D{{"$in", loginAttemptUserKeys(user)}}}}
+			},
+		},
+		{&namespaces.DBAuth, &namespaces.CollRateLimits}: {
+			filter: func(user auth.User) bson.D {
+				return bson.D{{namespaces.FieldID, primitive.Regex{Pattern: "^user:" + user.ID.Hex() + " "}}}
+			},
+		},
+		{&namespaces.DBAuth, &namespaces.CollRefreshTokens}: {
+			filter: func(user auth.User) bson.D {
+				return bson.D{{namespaces.FieldSub, user.ID}}
+			},
+		},
+		{&namespaces.DBAuth, &namespaces.CollPasswords}: {
+			filter: func(user auth.User) bson.D {
+				return bson.D{{namespaces.FieldUsername, user.Name}}
+			},
+			secrets: []string{
+				namespaces.FieldSalt,
+				namespaces.FieldHashedPassword,
+				namespaces.FieldTOTPSecret,
+				namespaces.FieldTOTPPending,
+				namespaces.FieldRecoveryCodes,
+				namespaces.FieldResetToken,
+			},
+		},
+		{&namespaces.DBAuth, &namespaces.CollUsers}: {
+			filter: func(user auth.User) bson.D {
+				return bson.D{{namespaces.FieldID, user.ID}}
+			},
+		},
+	}
+)
+
+// UserDataStore reaches across every namespace in the registry for what is stored about a user
+type UserDataStore interface {
+	Export(ctx context.Context, user auth.User) (map[string][]bson.M, error)
+
+	Purge(ctx context.Context, user auth.User) error
+}
+
+func NewUserDataStore(client *mongo.Client) (UserDataStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), common.TimeoutServerOp)
+	defer cancel()
+
+	// bets are the only user data without a store of their own
+	if _, err := mongodb.NewColl(ctx, client, namespaces.DBApp, namespaces.CollBets, mongodb.Index{
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldUserID, 1}),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &userDataStore{client}, nil
+}
+
+type userDataStore struct {
+	client *mongo.Client
+}
+
+func (s *userDataStore) Export(ctx context.Context, user auth.User) (map[string][]bson.M, error) {
+	export := make(map[string][]bson.M, len(namespaces.Registry))
+	for _, ns := range namespaces.Registry {
+		data, err := findUserData(ns)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := options.Find().SetSort(bson.D{{namespaces.FieldID, 1}})
+		if len(data.secrets) > 0 {
+			projection := make(bson.D, 0, len(data.secrets))
+			for _, field := range data.secrets {
+				projection = append(projection, bson.E{field, 0})
+			}
+			opts.SetProjection(projection)
+		}
+
+		cursor, err := s.coll(ns).Find(ctx, data.filter(user), opts)
+		if err != nil {
+			return nil, common.WrapErr(fmt.Errorf("failed to export %s: %s", ns, err), common.ErrCodeServer)
+		}
+
+		docs := []bson.M{}
+		if err := cursor.All(ctx, &docs); err != nil {
+			return nil, common.WrapErr(fmt.Errorf("failed to read %s export: %s", ns, err), common.ErrCodeServer)
+		}
+		export[ns.String()] = docs
+	}
+	return export, nil
+}
+
+// Purge removes everything the user owns, the user itself is removed
+// last so a purge that fails part way is found and retried
+func (s *userDataStore) Purge(ctx context.Context, user auth.User) error {
+	var users namespaces.Namespace
+	for _, ns := range namespaces.Registry {
+		data, err := findUserData(ns)
+		if err != nil {
+			return err
+		}
+		if data.retained {
+			continue
+		}
+		if ns.Collection == &namespaces.CollUsers {
+			users = ns
+			continue
+		}
+		if err := s.purge(ctx, ns, data.filter(user)); err != nil {
+			return err
+		}
+	}
+	return s.purge(ctx, users, userDataByNamespace[users].filter(user))
+}
+
+func (s *userDataStore) purge(ctx context.Context, ns namespaces.Namespace, filter bson.D) error {
+	if _, err := s.coll(ns).DeleteMany(ctx, filter); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to purge %s: %s", ns, err), common.ErrCodeServer)
+	}
+	return nil
+}
+
+func (s *userDataStore) coll(ns namespaces.Namespace) *mongo.Collection {
+	return s.client.Database(*ns.Database).Collection(*ns.Collection)
+}
+
+// findUserData fails for namespaces added to the registry without saying where their user data is,
+// so nothing is left out of an export or purge by accident
+func findUserData(ns namespaces.Namespace) (userData, error) {
+	data, ok := userDataByNamespace[ns]
+	if !ok {
+		return userData{}, common.NewErr(fmt.Sprintf("cannot find user data for %s", ns), common.ErrCodeServer)
+	}
+	return data, nil
+}
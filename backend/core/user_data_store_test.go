@@ -0,0 +1,18 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+	"github.com/shake-on-it/app-tmpl/backend/core/namespaces"
+)
+
+func TestUserData(t *testing.T) {
+	t.Run("should say where the user data is in every registered namespace", func(t *testing.T) {
+		for _, ns := range namespaces.Registry {
+			_, err := findUserData(ns)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, len(userDataByNamespace), len(namespaces.Registry))
+	})
+}
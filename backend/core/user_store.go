@@ -3,6 +3,8 @@ package core
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/shake-on-it/app-tmpl/backend/auth"
 	"github.com/shake-on-it/app-tmpl/backend/common"
@@ -18,12 +20,28 @@ import (
 type UserStore interface {
 	FindByID(ctx context.Context, id primitive.ObjectID) (auth.User, error)
 	FindByName(ctx context.Context, name string) (auth.User, error)
+	FindByEmail(ctx context.Context, email string) (auth.User, error)
+	FindByIdentity(ctx context.Context, identity auth.Identity) (auth.User, error)
 
 	Insert(ctx context.Context, user auth.User) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+
+	AddIdentity(ctx context.Context, id primitive.ObjectID, identity auth.Identity) (auth.User, error)
+
+	MarkVerified(ctx context.Context, id primitive.ObjectID) (auth.User, error)
+	MarkDeleted(ctx context.Context, id primitive.ObjectID, deletedAt time.Time) error
+
+	FindDeleted(ctx context.Context, deletedBefore time.Time) ([]auth.User, error)
 
 	AddSession(ctx context.Context, id, sessionID primitive.ObjectID) (auth.User, error)
 	RemoveSession(ctx context.Context, id, sessionID primitive.ObjectID) (auth.User, error)
+	RemoveSessions(ctx context.Context, id primitive.ObjectID, sessionIDs []primitive.ObjectID) error
 	ClearSessions(ctx context.Context, id primitive.ObjectID) error
+	ClearSessionsExcept(ctx context.Context, id, sessionID primitive.ObjectID) error
+
+	FindStaleSessions(ctx context.Context) (map[primitive.ObjectID][]primitive.ObjectID, error)
+
+	AddKnownClient(ctx context.Context, id primitive.ObjectID, ipRange, userAgent string) error
 }
 
 func NewUserStore(client *mongo.Client) (UserStore, error) {
@@ -34,14 +52,69 @@ func NewUserStore(client *mongo.Client) (UserStore, error) {
 		Unique: true,
 		Key: mongodb.NewIndexKey(
 			mongodb.IndexField{namespaces.FieldName, 1}),
+	}, mongodb.Index{
+		// deleted users keep their email, like their name, until their data is purged
+		Unique: true,
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldEmail, 1}),
+		Collation: mongodb.CollationCaseInsensitive,
+	}, mongodb.Index{
+		Unique: true,
+		Key: mongodb.NewIndexKey(
+			mongodb.IndexField{namespaces.FieldIdentities + "." + namespaces.FieldProvider, 1},
+			mongodb.IndexField{namespaces.FieldIdentities + "." + namespaces.FieldSubject, 1}),
+		PartialFilterExpression: bson.D{{namespaces.FieldIdentities, bson.D{{"$exists", true}}}},
 	})
 	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			if conflictErr := findEmailConflicts(ctx, client.Database(namespaces.DBAuth).Collection(namespaces.CollUsers)); conflictErr != nil {
+				return nil, conflictErr
+			}
+		}
 		return nil, err
 	}
 
 	return &userStore{coll}, nil
 }
 
+// findEmailConflicts reports the users whose emails only differ by case, they keep
+// the unique email index from being built until all but one of them are changed
+func findEmailConflicts(ctx context.Context, coll *mongo.Collection) error {
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{"$group", bson.D{
+			{namespaces.FieldID, "$" + namespaces.FieldEmail},
+			{"names", bson.D{{"$push", "$" + namespaces.FieldName}}},
+		}}},
+		{{"$match", bson.D{{"names.1", bson.D{{"$exists", true}}}}}},
+	}, options.Aggregate().SetCollation(mongodb.CollationCaseInsensitive.Options()))
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to find users with conflicting emails: %s", err), common.ErrCodeServer)
+	}
+
+	var conflicts []struct {
+		Email string   `bson:"_id"`
+		Names []string `bson:"names"`
+	}
+	if err := cursor.All(ctx, &conflicts); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to read users with conflicting emails: %s", err), common.ErrCodeServer)
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	var sb strings.Builder
+	for i, conflict := range conflicts {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		sb.WriteString(fmt.Sprintf("%s is used by %s", conflict.Email, strings.Join(conflict.Names, ", ")))
+	}
+	return common.NewErr(
+		fmt.Sprintf("users must have emails that differ by more than case, change all but one of: %s", sb.String()),
+		common.ErrCodeConflict,
+	)
+}
+
 type userStore struct {
 	coll *mongo.Collection
 }
@@ -59,7 +132,41 @@ func (s *userStore) FindByID(ctx context.Context, id primitive.ObjectID) (auth.U
 
 func (s *userStore) FindByName(ctx context.Context, name string) (auth.User, error) {
 	var user auth.User
-	if err := s.coll.FindOne(ctx, bson.D{{namespaces.FieldName, name}}).Decode(&user); err != nil {
+	if err := s.coll.FindOne(ctx, bson.D{
+		{namespaces.FieldName, name},
+		{namespaces.FieldStatus, bson.D{{"$ne", auth.UserStatusDeleted}}},
+	}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.User{}, common.NewErr("cannot find user", common.ErrCodeNotFound)
+		}
+		return auth.User{}, common.WrapErr(fmt.Errorf("failed to find user: %s", err), common.ErrCodeServer)
+	}
+	return user, nil
+}
+
+func (s *userStore) FindByEmail(ctx context.Context, email string) (auth.User, error) {
+	var user auth.User
+	if err := s.coll.FindOne(ctx, bson.D{
+		{namespaces.FieldEmail, email},
+		{namespaces.FieldStatus, bson.D{{"$ne", auth.UserStatusDeleted}}},
+	}, options.FindOne().SetCollation(mongodb.CollationCaseInsensitive.Options())).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.User{}, common.NewErr("cannot find user", common.ErrCodeNotFound)
+		}
+		return auth.User{}, common.WrapErr(fmt.Errorf("failed to find user: %s", err), common.ErrCodeServer)
+	}
+	return user, nil
+}
+
+func (s *userStore) FindByIdentity(ctx context.Context, identity auth.Identity) (auth.User, error) {
+	var user auth.User
+	if err := s.coll.FindOne(ctx, bson.D{
+		{namespaces.FieldIdentities, bson.D{{"$elemMatch", bson.D{
+			{namespaces.FieldProvider, identity.Provider},
+			{namespaces.FieldSubject, identity.Subject},
+		}}}},
+		{namespaces.FieldStatus, bson.D{{"$ne", auth.UserStatusDeleted}}},
+	}).Decode(&user); err != nil {
 		if err == mongo.ErrNoDocuments {
 			return auth.User{}, common.NewErr("cannot find user", common.ErrCodeNotFound)
 		}
@@ -70,21 +177,117 @@ func (s *userStore) FindByName(ctx context.Context, name string) (auth.User, err
 
 func (s *userStore) Insert(ctx context.Context, user auth.User) error {
 	if _, err := s.coll.InsertOne(ctx, user); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return common.NewErr("user already exists with this name or email", common.ErrCodeConflict)
+		}
 		return common.WrapErr(fmt.Errorf("failed to create user: %s", err), common.ErrCodeServer)
 	}
 	return nil
 }
 
+func (s *userStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	if _, err := s.coll.DeleteOne(ctx, bson.D{{namespaces.FieldID, id}}); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to delete user: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
+
+func (s *userStore) AddIdentity(ctx context.Context, id primitive.ObjectID, identity auth.Identity) (auth.User, error) {
+	var user auth.User
+	if err := s.coll.FindOneAndUpdate(
+		ctx,
+		bson.D{{namespaces.FieldID, id}},
+		bson.D{{"$addToSet", bson.D{
+			{namespaces.FieldIdentities, identity},
+		}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.User{}, common.NewErr("cannot find user", common.ErrCodeNotFound)
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return auth.User{}, common.NewErr("identity is already linked to another user", common.ErrCodeConflict)
+		}
+		return auth.User{}, common.WrapErr(fmt.Errorf("failed to link user identity: %s", err), common.ErrCodeServer)
+	}
+	return user, nil
+}
+
+// MarkVerified promotes an unverified user, users that already have a status are left as they are
+func (s *userStore) MarkVerified(ctx context.Context, id primitive.ObjectID) (auth.User, error) {
+	var user auth.User
+	if err := s.coll.FindOneAndUpdate(
+		ctx,
+		bson.D{
+			{namespaces.FieldID, id},
+			{namespaces.FieldStatus, auth.UserStatusUnverified},
+		},
+		bson.D{{"$set", bson.D{
+			{namespaces.FieldStatus, auth.UserStatusVerified},
+		}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return s.FindByID(ctx, id)
+		}
+		return auth.User{}, common.WrapErr(fmt.Errorf("failed to verify user: %s", err), common.ErrCodeServer)
+	}
+	return user, nil
+}
+
+// MarkDeleted hides the user from logins, its data is kept until the user is purged
+func (s *userStore) MarkDeleted(ctx context.Context, id primitive.ObjectID, deletedAt time.Time) error {
+	res, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldID, id}},
+		bson.D{{"$set", bson.D{
+			{namespaces.FieldStatus, auth.UserStatusDeleted},
+			{namespaces.FieldDeletedAt, deletedAt},
+		}}},
+	)
+	if err != nil {
+		return common.WrapErr(fmt.Errorf("failed to delete user: %s", err), common.ErrCodeServer)
+	}
+	if res.MatchedCount == 0 {
+		return common.NewErr("cannot find user", common.ErrCodeNotFound)
+	}
+	return nil
+}
+
+// FindDeleted finds the users that were deleted before the given time and are due to be purged
+func (s *userStore) FindDeleted(ctx context.Context, deletedBefore time.Time) ([]auth.User, error) {
+	cursor, err := s.coll.Find(ctx, bson.D{
+		{namespaces.FieldStatus, auth.UserStatusDeleted},
+		{namespaces.FieldDeletedAt, bson.D{{"$lte", deletedBefore}}},
+	})
+	if err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to find deleted users: %s", err), common.ErrCodeServer)
+	}
+
+	var users []auth.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to read deleted users: %s", err), common.ErrCodeServer)
+	}
+	return users, nil
+}
+
+// AddSession starts a session for the user, deleted users can no longer start any
 func (s *userStore) AddSession(ctx context.Context, id, sessionID primitive.ObjectID) (auth.User, error) {
 	res := s.coll.FindOneAndUpdate(
 		ctx,
-		bson.D{{namespaces.FieldID, id}},
+		bson.D{
+			{namespaces.FieldID, id},
+			{namespaces.FieldStatus, bson.D{{"$ne", auth.UserStatusDeleted}}},
+		},
 		bson.D{{"$push", bson.D{
 			{namespaces.FieldSessions, sessionID},
 		}}},
 		options.FindOneAndUpdate().SetReturnDocument(options.After),
 	)
 	if err := res.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.User{}, common.NewErr("cannot find user", common.ErrCodeNotFound)
+		}
 		return auth.User{}, common.WrapErr(fmt.Errorf("failed to add user session: %s", err), common.ErrCodeServer)
 	}
 
@@ -111,6 +314,19 @@ func (s *userStore) RemoveSession(ctx context.Context, id, sessionID primitive.O
 	return user, nil
 }
 
+func (s *userStore) RemoveSessions(ctx context.Context, id primitive.ObjectID, sessionIDs []primitive.ObjectID) error {
+	if _, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldID, id}},
+		bson.D{{"$pull", bson.D{
+			{namespaces.FieldSessions, bson.D{{"$in", sessionIDs}}},
+		}}},
+	); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to remove user sessions: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
+
 func (s *userStore) ClearSessions(ctx context.Context, id primitive.ObjectID) error {
 	if _, err := s.coll.UpdateOne(
 		ctx,
@@ -121,3 +337,83 @@ func (s *userStore) ClearSessions(ctx context.Context, id primitive.ObjectID) er
 	}
 	return nil
 }
+
+func (s *userStore) ClearSessionsExcept(ctx context.Context, id, sessionID primitive.ObjectID) error {
+	if _, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldID, id}},
+		bson.D{{"$pull", bson.D{
+			{namespaces.FieldSessions, bson.D{{"$ne", sessionID}}},
+		}}},
+	); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to clear user sessions: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
+
+// FindStaleSessions finds the sessions of every user that no longer have a refresh token
+func (s *userStore) FindStaleSessions(ctx context.Context) (map[primitive.ObjectID][]primitive.ObjectID, error) {
+	cursor, err := s.coll.Aggregate(ctx, mongo.Pipeline{
+		{{"$match", bson.D{{namespaces.FieldSessions + ".0", bson.D{{"$exists", true}}}}}},
+		{{"$lookup", bson.D{
+			{"from", namespaces.CollRefreshTokens},
+			{"localField", namespaces.FieldSessions},
+			{"foreignField", namespaces.FieldID},
+			{"as", namespaces.CollRefreshTokens},
+		}}},
+		{{"$project", bson.D{
+			{namespaces.FieldSessions, bson.D{{"$setDifference", bson.A{
+				"$" + namespaces.FieldSessions,
+				"$" + namespaces.CollRefreshTokens + "." + namespaces.FieldID,
+			}}}},
+		}}},
+		{{"$match", bson.D{{namespaces.FieldSessions + ".0", bson.D{{"$exists", true}}}}}},
+	})
+	if err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to find stale user sessions: %s", err), common.ErrCodeServer)
+	}
+
+	var users []auth.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, common.WrapErr(fmt.Errorf("failed to read stale user sessions: %s", err), common.ErrCodeServer)
+	}
+
+	staleSessions := make(map[primitive.ObjectID][]primitive.ObjectID, len(users))
+	for _, user := range users {
+		staleSessions[user.ID] = user.Sessions
+	}
+	return staleSessions, nil
+}
+
+// AddKnownClient remembers the ip range and user agent the user logged in from,
+// empty ones are left out and only the most recent of each are kept
+func (s *userStore) AddKnownClient(ctx context.Context, id primitive.ObjectID, ipRange, userAgent string) error {
+	push := bson.D{}
+	for _, known := range []struct {
+		field string
+		value string
+	}{
+		{namespaces.FieldKnownIPRanges, ipRange},
+		{namespaces.FieldKnownUserAgents, userAgent},
+	} {
+		if known.value == "" {
+			continue
+		}
+		push = append(push, bson.E{known.field, bson.D{
+			{"$each", bson.A{known.value}},
+			{"$slice", -auth.MaxKnownClients},
+		}})
+	}
+	if len(push) == 0 {
+		return nil
+	}
+
+	if _, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{namespaces.FieldID, id}},
+		bson.D{{"$push", push}},
+	); err != nil {
+		return common.WrapErr(fmt.Errorf("failed to add known client: %s", err), common.ErrCodeServer)
+	}
+	return nil
+}
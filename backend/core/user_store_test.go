@@ -0,0 +1,54 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/shake-on-it/app-tmpl/backend/auth"
+	"github.com/shake-on-it/app-tmpl/backend/common/test/assert"
+	u "github.com/shake-on-it/app-tmpl/backend/common/test/utils"
+	"github.com/shake-on-it/app-tmpl/backend/core/namespaces"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUserStore(t *testing.T) {
+	u.SkipUnlessMongoRunning(t)
+
+	client := u.MongoProvider().Client()
+
+	t.Run("should report the users whose emails only differ by case", func(t *testing.T) {
+		coll := client.Database(namespaces.DBAuth).Collection("test_email_conflicts")
+		defer coll.Drop(context.Background())
+
+		for _, user := range []auth.User{
+			{ID: primitive.NewObjectID(), Name: "alice", Email: "alice@example.com"},
+			{ID: primitive.NewObjectID(), Name: "alice2", Email: "Alice@Example.com"},
+			{ID: primitive.NewObjectID(), Name: "bob", Email: "bob@example.com"},
+		} {
+			_, err := coll.InsertOne(context.Background(), user)
+			assert.Nil(t, err)
+		}
+
+		err := findEmailConflicts(context.Background(), coll)
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "alice, alice2"))
+		assert.False(t, strings.Contains(err.Error(), "bob"))
+	})
+
+	t.Run("should find no conflicts when every email is unique", func(t *testing.T) {
+		coll := client.Database(namespaces.DBAuth).Collection("test_email_conflicts")
+		defer coll.Drop(context.Background())
+
+		for _, user := range []auth.User{
+			{ID: primitive.NewObjectID(), Name: "alice", Email: "alice@example.com"},
+			{ID: primitive.NewObjectID(), Name: "bob", Email: "bob@example.com"},
+		} {
+			_, err := coll.InsertOne(context.Background(), user)
+			assert.Nil(t, err)
+		}
+
+		assert.Nil(t, findEmailConflicts(context.Background(), coll))
+	})
+}